@@ -4,36 +4,44 @@ package main
 
 import (
 	"syscall"
+	"unsafe"
 )
 
 //---------------------------------EVCodes--------------------------------------//
 
 // Ref: input-event-codes.h
 const (
-	evSyn           = 0x00
-	evKey           = 0x01
-	evRel           = 0x02
-	evAbs           = 0x03
-	evMsc           = 0x04
-	relX            = 0x00
-	relY            = 0x01
-	relWheel        = 0x08
-	relHWheel       = 0x06
-	btnTouch        = 0x14a
-	synReport       = 0
-	synMtReport     = 2
-	absMtSlot       = 0x2f
-	absMtPositionX  = 0x35
-	absMtPositionY  = 0x36
-	absMtTrackingId = 0x39
-	absMax          = 0x3f
-	absCnt          = absMax + 1
-	inputPropDirect = 0x01
-	inputPropMax    = 0x1f
-	inputPropCnt    = inputPropMax + 1
+	evSyn            = 0x00
+	evKey            = 0x01
+	evRel            = 0x02
+	evAbs            = 0x03
+	evMsc            = 0x04
+	relX             = 0x00
+	relY             = 0x01
+	relWheel         = 0x08
+	relHWheel        = 0x06
+	btnTouch         = 0x14a
+	synReport        = 0
+	synMtReport      = 2
+	absMtSlot        = 0x2f
+	absMtPositionX   = 0x35
+	absMtPositionY   = 0x36
+	absMtTrackingId  = 0x39
+	absMax           = 0x3f
+	absCnt           = absMax + 1
+	inputPropPointer = 0x00
+	inputPropDirect  = 0x01
+	inputPropMax     = 0x1f
+	inputPropCnt     = inputPropMax + 1
 	//-------------------------------appends-------------------------------//
 	absMtTouchMajor = 0x30
 	absMtWidthMajor = 0x32
+	absMtPressure   = 0x3a
+	absMtToolType   = 0x37
+	mtToolFinger    = 0
+	mtToolPen       = 1
+	mtToolPalm      = 2
+	evLed           = 0x11
 )
 
 //---------------------------------IOCTL--------------------------------------//
@@ -80,10 +88,18 @@ func EVIOCGABS(abs int) int {
 	return _IOR('E', 0x40+abs, 24) //sizeof(struct input_absinfo)
 }
 
+func EVIOCGMTSLOTS(len int) int {
+	return _IOC(iocRead, 'E', 0x0a, len)
+}
+
 func EVIOCGBIT(ev, len int) int {
 	return _IOC(iocRead, 'E', 0x20+ev, len)
 }
 
+func EVIOCGLED(len int) int {
+	return _IOC(iocRead, 'E', 0x19, len)
+}
+
 func EVIOCGRAB() int {
 	return _IOW('E', 0x90, 4) //sizeof(int)
 }
@@ -134,6 +150,18 @@ const (
 	maxPhysInfoSize   = 80
 )
 
+type UinputSetup struct {
+	ID           InputID
+	Name         [uinputMaxNameSize]byte
+	FfEffectsMax uint32
+}
+
+type UinputAbsSetup struct {
+	Code    uint16
+	_       uint16 //input_absinfo按4字节对齐
+	AbsInfo AbsInfo
+}
+
 type UinputUserDev struct {
 	Name       [uinputMaxNameSize]byte
 	ID         InputID
@@ -161,10 +189,22 @@ func UISETABSBIT() int {
 	return _IOW('U', 103, 4) //sizeof(int)
 }
 
+func UISETLEDBIT() int {
+	return _IOW('U', 105, 4) //sizeof(int)
+}
+
 func UISETPROPBIT() int {
 	return _IOW('U', 110, 4) //sizeof(int)
 }
 
+func UIDEVSETUP() int {
+	return _IOW('U', 3, int(unsafe.Sizeof(UinputSetup{})))
+}
+
+func UIABSSETUP() int {
+	return _IOW('U', 4, int(unsafe.Sizeof(UinputAbsSetup{})))
+}
+
 func UIDEVCREATE() int {
 	return _IOC(iocNone, 'U', 1, 0)
 }
@@ -425,6 +465,8 @@ var keycode_2_friendly_name map[uint16]string = map[uint16]string{
 	0x115: "BTN_FORWARD",
 	0x116: "BTN_BACK",
 	0x117: "BTN_TASK",
+	0x14b: "BTN_STYLUS",
+	0x14c: "BTN_STYLUS2",
 }
 
 var friendly_name_2_keycode map[string]uint16 = map[string]uint16{
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/bitly/go-simplejson"
+	"github.com/kenshaw/evdev"
+)
+
+type device_info struct {
+	index    int
+	path     string
+	name     string
+	phys     string
+	uniq     string
+	vendor   uint16
+	product  uint16
+	dev_type dev_type //自动检测的类型
+}
+
+type device_settings struct {
+	include     bool
+	dev_type    dev_type
+	grab        bool    //是否独占设备 EVIOCGRAB
+	mouse_speed float64 //鼠标移动倍率
+}
+
+type device_rule struct {
+	name_re    *regexp.Regexp
+	phys_re    *regexp.Regexp
+	uniq_re    *regexp.Regexp
+	vendor     int //-1表示不限
+	product    int
+	path       string
+	include    *bool
+	force_type *dev_type
+	grab       *bool
+	speed      float64 //0表示不修改
+}
+
+type device_rules struct {
+	rules []*device_rule
+}
+
+var global_device_rules *device_rules = &device_rules{rules: make([]*device_rule, 0)}
+var global_device_rules_lock sync.RWMutex
+var global_device_rules_from_config = true //使用--devices时为false 重新载入配置文件时不修改规则
+var global_device_rules_changed = make(chan bool, 1)
+
+// 规则在设备检测协程中读取 重新载入配置文件时替换
+// 替换后通知设备检测协程 设置改变的设备重新读取 之前未读取的设备重新匹配
+func get_device_rules() *device_rules {
+	global_device_rules_lock.RLock()
+	defer global_device_rules_lock.RUnlock()
+	return global_device_rules
+}
+
+func set_device_rules(rules *device_rules) {
+	global_device_rules_lock.Lock()
+	defer global_device_rules_lock.Unlock()
+	global_device_rules = rules
+	select {
+	case global_device_rules_changed <- true:
+	default:
+	}
+}
+
+var dev_type_names map[string]dev_type = map[string]dev_type{
+	"mouse":    type_mouse,
+	"keyboard": type_keyboard,
+	"joystick": type_joystick,
+	"touch":    type_touch,
+	"touchpad": type_touchpad,
+	"tablet":   type_tablet,
+}
+
+func read_device_info(index int) (*device_info, error) {
+	path := fmt.Sprintf("/dev/input/event%d", index)
+	fd, err := os.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	d := evdev.Open(fd)
+	defer d.Close()
+	id := d.ID()
+	return &device_info{
+		index:    index,
+		path:     path,
+		name:     d.Name(),
+		phys:     d.Path(),
+		uniq:     d.Serial(),
+		vendor:   id.Vendor,
+		product:  id.Product,
+		dev_type: check_dev_type(d, get_input_props(fd)),
+	}, nil
+}
+
+func parse_usb_id(value *simplejson.Json) int { //支持"046d"形式的十六进制字符串或者数字
+	if str, err := value.String(); err == nil {
+		id, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(str), "0x"), 16, 16)
+		if err != nil {
+			logger.Warnf("DEVICES 无效的ID : %s", str)
+			return -1
+		}
+		return int(id)
+	}
+	if id, err := value.Int(); err == nil {
+		return id
+	}
+	return -1
+}
+
+func compile_rule_regexp(value string) *regexp.Regexp {
+	if value == "" {
+		return nil
+	}
+	re, err := regexp.Compile(value)
+	if err != nil {
+		logger.Warnf("DEVICES 无效的正则 %s : %v", value, err)
+		return nil
+	}
+	return re
+}
+
+func parse_device_rules(config *simplejson.Json) *device_rules {
+	result := &device_rules{rules: make([]*device_rule, 0)}
+	for i := range config.MustArray() {
+		rule_config := config.GetIndex(i)
+		match := rule_config.Get("MATCH")
+		rule := &device_rule{
+			name_re: compile_rule_regexp(match.Get("NAME").MustString("")),
+			phys_re: compile_rule_regexp(match.Get("PHYS").MustString("")),
+			uniq_re: compile_rule_regexp(match.Get("UNIQ").MustString("")),
+			vendor:  parse_usb_id(match.Get("VENDOR")),
+			product: parse_usb_id(match.Get("PRODUCT")),
+			path:    match.Get("PATH").MustString(""),
+			speed:   rule_config.Get("MOUSE_SPEED").MustFloat64(0),
+		}
+		if include, err := rule_config.Get("INCLUDE").Bool(); err == nil {
+			rule.include = &include
+		}
+		if grab, err := rule_config.Get("GRAB").Bool(); err == nil {
+			rule.grab = &grab
+		}
+		if type_name := rule_config.Get("TYPE").MustString(""); type_name != "" {
+			if forced, ok := dev_type_names[type_name]; ok {
+				rule.force_type = &forced
+			} else {
+				logger.Warnf("DEVICES 未知设备类型 %s", type_name)
+			}
+		}
+		result.rules = append(result.rules, rule)
+	}
+	if len(result.rules) > 0 {
+		logger.Infof("已载入%d条设备规则", len(result.rules))
+	}
+	return result
+}
+
+func load_device_rules_file(path string) (*device_rules, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config, err := simplejson.NewJson(content)
+	if err != nil {
+		return nil, err
+	}
+	return parse_device_rules(config.Get("DEVICES")), nil
+}
+
+func (self *device_rule) match(info *device_info) bool {
+	if self.name_re != nil && !self.name_re.MatchString(info.name) {
+		return false
+	}
+	if self.phys_re != nil && !self.phys_re.MatchString(info.phys) {
+		return false
+	}
+	if self.uniq_re != nil && !self.uniq_re.MatchString(info.uniq) {
+		return false
+	}
+	if self.vendor != -1 && self.vendor != int(info.vendor) {
+		return false
+	}
+	if self.product != -1 && self.product != int(info.product) {
+		return false
+	}
+	if self.path != "" && self.path != info.path {
+		return false
+	}
+	return true
+}
+
+// 按顺序使用第一条匹配的规则 未匹配则使用名称正则与自动检测的类型
+func (self *device_rules) apply(info *device_info, name_re *regexp.Regexp) *device_settings {
+	settings := &device_settings{
+		include:     name_re == nil || name_re.MatchString(info.name),
+		dev_type:    info.dev_type,
+		grab:        true,
+		mouse_speed: 1,
+	}
+	for _, rule := range self.rules {
+		if !rule.match(info) {
+			continue
+		}
+		if rule.force_type != nil {
+			settings.dev_type = *rule.force_type
+		}
+		if rule.include != nil {
+			settings.include = *rule.include
+		}
+		if rule.grab != nil {
+			settings.grab = *rule.grab
+		}
+		if rule.speed != 0 {
+			settings.mouse_speed = rule.speed
+		}
+		logger.Debugf("设备 %s(%s) 匹配规则 : %+v", info.name, info.path, *settings)
+		break
+	}
+	if settings.dev_type == type_unknown {
+		settings.include = false
+	}
+	return settings
+}
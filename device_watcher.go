@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+type device_event_kind uint8
+
+const (
+	DeviceAdded   = device_event_kind(0)
+	DeviceRemoved = device_event_kind(1)
+)
+
+const (
+	device_retry_delay     = time.Duration(400) * time.Millisecond //读取失败后重新发送的初始间隔 每次加倍
+	device_retry_max_delay = time.Duration(10) * time.Second
+	device_probe_retry     = 5 //读取设备信息失败的重试次数
+)
+
+type device_event struct {
+	kind  device_event_kind
+	index int    // /dev/input/event{index}
+	path  string //设备文件路径
+}
+
+// 监听/dev/input下设备的插入与移除 优先使用inotify 不可用时回退到轮询
+type device_watcher struct {
+	lock        sync.Mutex
+	devices     map[int]bool
+	subscribers []chan *device_event
+}
+
+var global_device_watcher *device_watcher
+var global_device_watcher_once sync.Once
+
+func get_device_watcher() *device_watcher {
+	global_device_watcher_once.Do(func() {
+		global_device_watcher = &device_watcher{
+			devices:     make(map[int]bool),
+			subscribers: make([]chan *device_event, 0),
+		}
+		global_device_watcher.rescan() //先同步一次 订阅时即可拿到已有设备
+		go global_device_watcher.run()
+	})
+	return global_device_watcher
+}
+
+func parse_event_index(name string) (int, bool) {
+	if !strings.HasPrefix(name, "event") {
+		return 0, false
+	}
+	index, err := strconv.Atoi(name[5:])
+	if err != nil {
+		return 0, false
+	}
+	return index, true
+}
+
+// 订阅设备事件 已存在的设备会立即以DeviceAdded发送
+func (self *device_watcher) subscribe() chan *device_event {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	ch := make(chan *device_event, 64+len(self.devices))
+	for index := range self.devices {
+		ch <- &device_event{kind: DeviceAdded, index: index, path: fmt.Sprintf("/dev/input/event%d", index)}
+	}
+	self.subscribers = append(self.subscribers, ch)
+	return ch
+}
+
+func (self *device_watcher) publish(kind device_event_kind, index int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if kind == DeviceAdded {
+		if self.devices[index] {
+			return
+		}
+		self.devices[index] = true
+	} else {
+		if !self.devices[index] {
+			return
+		}
+		delete(self.devices, index)
+	}
+	event := &device_event{kind: kind, index: index, path: fmt.Sprintf("/dev/input/event%d", index)}
+	for _, ch := range self.subscribers {
+		select {
+		case ch <- event:
+		case <-global_close_signal:
+			return
+		}
+	}
+}
+
+// 设备仍存在时重新发送DeviceAdded 用于读取失败或读取协程退出后再次读取
+func (self *device_watcher) reoffer(index int) {
+	path := fmt.Sprintf("/dev/input/event%d", index)
+	if _, err := os.Stat(path); err != nil {
+		return
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if !self.devices[index] {
+		return
+	}
+	event := &device_event{kind: DeviceAdded, index: index, path: path}
+	for _, ch := range self.subscribers {
+		select {
+		case ch <- event:
+		case <-global_close_signal:
+			return
+		}
+	}
+}
+
+func (self *device_watcher) reoffer_all() {
+	self.lock.Lock()
+	indexes := make([]int, 0, len(self.devices))
+	for index := range self.devices {
+		indexes = append(indexes, index)
+	}
+	self.lock.Unlock()
+	for _, index := range indexes {
+		self.reoffer(index)
+	}
+}
+
+func (self *device_watcher) rescan() { //对比目录内容 发布差异
+	files, err := ioutil.ReadDir("/dev/input")
+	if err != nil {
+		logger.Debugf("读取/dev/input失败 : %v", err)
+		return
+	}
+	exists := make(map[int]bool)
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		if index, ok := parse_event_index(file.Name()); ok {
+			exists[index] = true
+			self.publish(DeviceAdded, index)
+		}
+	}
+	self.lock.Lock()
+	removed := make([]int, 0)
+	for index := range self.devices {
+		if !exists[index] {
+			removed = append(removed, index)
+		}
+	}
+	self.lock.Unlock()
+	for _, index := range removed {
+		self.publish(DeviceRemoved, index)
+	}
+}
+
+func (self *device_watcher) run() {
+	if err := self.run_inotify(); err != nil {
+		logger.Warnf("inotify不可用(%v),使用轮询检测设备", err)
+		self.run_polling()
+	}
+}
+
+func (self *device_watcher) run_polling() {
+	for {
+		select {
+		case <-global_close_signal:
+			return
+		default:
+			self.rescan()
+			time.Sleep(time.Duration(400) * time.Millisecond)
+		}
+	}
+}
+
+func (self *device_watcher) run_inotify() error {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	_, err = unix.InotifyAddWatch(fd, "/dev/input", unix.IN_CREATE|unix.IN_DELETE|unix.IN_MOVED_TO|unix.IN_MOVED_FROM)
+	if err != nil {
+		return err
+	}
+	self.rescan() //添加监听前后可能有设备变化
+	logger.Debugf("使用inotify监听设备插入移除")
+	buf := make([]byte, 4096)
+	poll_fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+	for {
+		select {
+		case <-global_close_signal:
+			return nil
+		default:
+		}
+		n, err := unix.Poll(poll_fds, 500) //超时以检查退出信号
+		if err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			logger.Errorf("inotify poll error : %v", err)
+			self.run_polling()
+			return nil
+		}
+		if n == 0 {
+			continue
+		}
+		length, err := unix.Read(fd, buf)
+		if err != nil {
+			if err == unix.EAGAIN || err == unix.EINTR {
+				continue
+			}
+			logger.Errorf("inotify read error : %v", err)
+			self.run_polling()
+			return nil
+		}
+		for offset := 0; offset+unix.SizeofInotifyEvent <= length; {
+			event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			name_bytes := buf[offset+unix.SizeofInotifyEvent : offset+unix.SizeofInotifyEvent+int(event.Len)]
+			name := strings.TrimRight(string(name_bytes), "\x00")
+			offset += unix.SizeofInotifyEvent + int(event.Len)
+			if event.Mask&unix.IN_Q_OVERFLOW != 0 {
+				self.rescan()
+				continue
+			}
+			index, ok := parse_event_index(name)
+			if !ok {
+				continue
+			}
+			if event.Mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0 {
+				self.publish(DeviceAdded, index)
+			} else if event.Mask&(unix.IN_DELETE|unix.IN_MOVED_FROM) != 0 {
+				self.publish(DeviceRemoved, index)
+			}
+		}
+	}
+}
@@ -1,14 +1,314 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"sync"
+	"time"
+	"unsafe"
 
+	"github.com/kenshaw/evdev"
 	"golang.org/x/sys/unix"
+)
 
-	"github.com/kenshaw/evdev"
+// 直接写入真实触屏 与真实手指共存
+// 写入的事件同样会出现在设备的读取端 读取端结合EVIOCGMTSLOTS得到的初始状态维护每个slot被谁占用
+// 虚拟触点从最大的slot向下分配硬件未使用的slot 跟踪ID取ABS_MT_TRACKING_ID范围的高端 以此区分自己写入的事件
+// 真实手指占用了虚拟触点所在的slot 或驱动丢弃了虚拟触点时 虚拟触点暂停 有空闲slot后在最后的位置重新按下
+// 使用INPUT_MT_DROP_UNUSED的驱动每帧都会丢弃未更新的slot 检测到后真实手指按下期间不再重新按下 避免每帧点击一次
+
+const (
+	direct_drop_limit  = 3 //在direct_drop_window内被驱动丢弃的次数达到此值 视为驱动丢弃未更新的slot
+	direct_drop_window = time.Second
 )
 
+type direct_contact struct {
+	slot int32              //-1表示暂停
+	pack touch_control_pack //最后一次按下或移动 恢复时使用
+}
+
+type direct_touch struct {
+	lock         sync.Mutex
+	fd           int
+	attrs        *touch_attr_writer
+	translate    func(x, y int32) (int32, int32)
+	tracking_max int32
+	hw           []bool  //真实手指占用的slot
+	owner        []int32 //虚拟触点占用的slot -1表示空闲
+	released     []int   //已写入松开 读取端尚未收到的数量
+	contacts     map[int32]*direct_contact
+	read_slot    int32
+	dropped      bool //读取端缓冲区溢出 等待下一个SYN_REPORT后重新读取slot状态
+	drop_unused  bool //驱动丢弃未更新的slot 真实手指按下期间虚拟触点保持暂停
+	drop_count   int
+	drop_since   time.Time
+	events       EventMap
+}
+
+func new_direct_touch(fd int, slots int, tracking_max int32, attrs *touch_attr_writer, translate func(x, y int32) (int32, int32)) *direct_touch {
+	self := &direct_touch{
+		fd:           fd,
+		attrs:        attrs,
+		translate:    translate,
+		tracking_max: tracking_max,
+		hw:           make([]bool, slots),
+		owner:        make([]int32, slots),
+		released:     make([]int, slots),
+		contacts:     make(map[int32]*direct_contact),
+		events:       makeEventsMMap(6 * 24),
+	}
+	for i := range self.owner {
+		self.owner[i] = -1
+	}
+	return self
+}
+
+func (self *direct_touch) tracking_id(slot int32) int32 {
+	return self.tracking_max - slot
+}
+
+func (self *direct_touch) active_count() int {
+	count := 0
+	for i := range self.hw {
+		if self.hw[i] || self.owner[i] != -1 {
+			count++
+		}
+	}
+	return count
+}
+
+func (self *direct_touch) alloc_slot() int32 {
+	for slot := len(self.hw) - 1; slot >= 0; slot-- {
+		if !self.hw[slot] && self.owner[slot] == -1 && self.released[slot] == 0 {
+			return int32(slot)
+		}
+	}
+	return -1
+}
+
+// 末尾追加SYN后写入 按下与移动时附带压力、接触面积与工具类型 松开时pack为nil
+func (self *direct_touch) write(events []evdev.Event, pack *touch_control_pack) {
+	n := copy(self.events.Events, events)
+	self.events.Events[n] = evdev.Event{Type: EV_SYN, Code: SYN_REPORT, Value: 0}
+	data := self.events.data[:(n+1)*24]
+	if pack != nil {
+		self.attrs.write(data, *pack)
+	} else {
+		unix.Write(self.attrs.fd, data)
+	}
+}
+
+func (self *direct_touch) press(id int32, contact *direct_contact) {
+	slot := self.alloc_slot()
+	if slot == -1 || self.drop_unused && self.hw_count() > 0 {
+		contact.slot = -1
+		return
+	}
+	contact.slot = slot
+	self.owner[slot] = id
+	x, y := self.translate(contact.pack.x, contact.pack.y)
+	events := []evdev.Event{
+		{Type: EV_ABS, Code: ABS_MT_SLOT, Value: slot},
+		{Type: EV_ABS, Code: ABS_MT_TRACKING_ID, Value: self.tracking_id(slot)},
+		{Type: EV_ABS, Code: ABS_MT_POSITION_X, Value: x},
+		{Type: EV_ABS, Code: ABS_MT_POSITION_Y, Value: y},
+	}
+	if self.active_count() == 1 {
+		events = append(events, evdev.Event{Type: EV_KEY, Code: BTN_TOUCH, Value: DOWN})
+	}
+	self.write(events, &contact.pack)
+}
+
+func (self *direct_touch) hw_count() int {
+	count := 0
+	for _, hw := range self.hw {
+		if hw {
+			count++
+		}
+	}
+	return count
+}
+
+// 驱动丢弃了虚拟触点 短时间内多次发生则不再在真实手指按下期间重新按下
+func (self *direct_touch) note_drop() {
+	if self.drop_unused {
+		return
+	}
+	if time.Since(self.drop_since) > direct_drop_window {
+		self.drop_count, self.drop_since = 0, time.Now()
+	}
+	if self.drop_count++; self.drop_count >= direct_drop_limit {
+		self.drop_unused = true
+		logger.Warn("真实触屏驱动会丢弃每帧未更新的触点(INPUT_MT_DROP_UNUSED) 真实手指按下期间虚拟触点将保持松开 全部松开后恢复 需要同时使用时请改用uinput")
+	}
+}
+
+func (self *direct_touch) pause(slot int32, reason string) {
+	id := self.owner[slot]
+	self.owner[slot] = -1
+	if contact, ok := self.contacts[id]; ok {
+		contact.slot = -1
+		logger.Debugf("%s slot %d 虚拟触点%d暂停", reason, slot, id)
+	}
+}
+
+func (self *direct_touch) handel_control(control_data touch_control_pack) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	contact, ok := self.contacts[control_data.id]
+	switch control_data.action {
+	case TouchActionRequire:
+		if ok && contact.slot != -1 {
+			self.owner[contact.slot] = -1
+		}
+		contact = &direct_contact{slot: -1, pack: control_data}
+		self.contacts[control_data.id] = contact
+		self.press(control_data.id, contact)
+		if contact.slot == -1 {
+			logger.Debugf("虚拟触点%d暂时无法按下 等待真实手指松开", control_data.id)
+		}
+	case TouchActionMove:
+		if !ok {
+			return
+		}
+		contact.pack = control_data
+		if contact.slot == -1 {
+			self.press(control_data.id, contact)
+			return
+		}
+		x, y := self.translate(control_data.x, control_data.y)
+		self.write([]evdev.Event{
+			{Type: EV_ABS, Code: ABS_MT_SLOT, Value: contact.slot},
+			{Type: EV_ABS, Code: ABS_MT_POSITION_X, Value: x},
+			{Type: EV_ABS, Code: ABS_MT_POSITION_Y, Value: y},
+		}, &control_data)
+	case TouchActionRelease:
+		if !ok {
+			return
+		}
+		delete(self.contacts, control_data.id)
+		if contact.slot == -1 {
+			return
+		}
+		self.owner[contact.slot] = -1
+		self.released[contact.slot]++
+		events := []evdev.Event{
+			{Type: EV_ABS, Code: ABS_MT_SLOT, Value: contact.slot},
+			{Type: EV_ABS, Code: ABS_MT_TRACKING_ID, Value: -1},
+		}
+		if self.active_count() == 0 {
+			events = append(events, evdev.Event{Type: EV_KEY, Code: BTN_TOUCH, Value: UP})
+		}
+		self.write(events, nil)
+	}
+}
+
+// 读取端收到的事件 包括真实手指与自己写入的
+func (self *direct_touch) handel_event(event evdev.Event) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if event.Type == EV_SYN {
+		switch event.Code {
+		case uint16(evdev.SyncDropped):
+			self.dropped = true
+		case uint16(evdev.SyncReport):
+			if self.dropped {
+				self.dropped = false
+				self.sync_slots()
+			}
+			self.resume()
+		}
+		return
+	}
+	if self.dropped {
+		return
+	}
+	if event.Type == EV_KEY && event.Code == BTN_TOUCH && event.Value == UP {
+		for _, id := range self.owner {
+			if id != -1 { //真实手指全部松开时驱动发送了BTN_TOUCH 0 虚拟触点仍按下
+				self.write([]evdev.Event{{Type: EV_KEY, Code: BTN_TOUCH, Value: DOWN}}, nil)
+				break
+			}
+		}
+		return
+	}
+	if event.Type != EV_ABS {
+		return
+	}
+	switch event.Code {
+	case ABS_MT_SLOT:
+		if event.Value >= 0 && int(event.Value) < len(self.hw) {
+			self.read_slot = event.Value
+		}
+	case ABS_MT_TRACKING_ID:
+		slot := self.read_slot
+		if event.Value == -1 {
+			if self.released[slot] > 0 {
+				self.released[slot]--
+			} else if self.hw[slot] {
+				self.hw[slot] = false
+			} else if self.owner[slot] != -1 {
+				self.pause(slot, "驱动丢弃了")
+				self.note_drop()
+			}
+		} else if event.Value != self.tracking_id(slot) { //自己写入的按下可能在松开后才读到 只按跟踪ID区分
+			self.hw[slot] = true
+			if self.owner[slot] != -1 {
+				self.pause(slot, "真实手指占用了")
+			}
+		}
+	}
+}
+
+// 暂停的虚拟触点在空闲slot按最后的位置重新按下
+func (self *direct_touch) resume() {
+	for id, contact := range self.contacts {
+		if contact.slot == -1 {
+			self.press(id, contact)
+		}
+	}
+}
+
+// 读取每个slot当前的跟踪ID 跟踪ID不是自己分配的即为真实手指
+func (self *direct_touch) sync_slots() {
+	values := make([]int32, len(self.hw)+1)
+	values[0] = ABS_MT_TRACKING_ID
+	if err := ioctl(uintptr(self.fd), EVIOCGMTSLOTS(len(values)*4), uintptr(unsafe.Pointer(&values[0]))); err != nil {
+		logger.Warnf("读取触屏slot状态失败: %v", err)
+		return
+	}
+	for i := range self.hw {
+		slot := int32(i)
+		self.released[i] = 0
+		value := values[i+1]
+		if self.owner[i] != -1 && value == self.tracking_id(slot) {
+			continue
+		}
+		self.hw[i] = value != -1 && value != self.tracking_id(slot)
+		if self.owner[i] != -1 {
+			self.pause(slot, "slot状态已改变")
+		}
+	}
+	var abs_slot AbsInfo
+	if err := ioctl(uintptr(self.fd), EVIOCGABS(ABS_MT_SLOT), uintptr(unsafe.Pointer(&abs_slot))); err == nil && abs_slot.Value >= 0 && int(abs_slot.Value) < len(self.hw) {
+		self.read_slot = abs_slot.Value
+	}
+}
+
+// 松开所有虚拟触点 避免退出后残留在真实触屏上
+func (self *direct_touch) release_all() {
+	self.lock.Lock()
+	ids := make([]int32, 0, len(self.contacts))
+	for id := range self.contacts {
+		ids = append(ids, id)
+	}
+	self.lock.Unlock()
+	for _, id := range ids {
+		self.handel_control(touch_control_pack{action: TouchActionRelease, id: id})
+	}
+}
+
 func handel_touch_using_direct_touch(index int) touch_control_func {
 	fd, err := os.OpenFile(fmt.Sprintf("/dev/input/event%d", index), os.O_RDWR, 0)
 	if err != nil {
@@ -16,18 +316,15 @@ func handel_touch_using_direct_touch(index int) touch_control_func {
 		os.Exit(3)
 	}
 	d := evdev.Open(fd)
-	go func() {
-		<-global_close_signal
-		defer d.Close()
-	}()
+	axes := d.AbsoluteTypes()
 
-	MTPositionX := d.AbsoluteTypes()[evdev.AbsoluteMTPositionX]
-	MTPositionY := d.AbsoluteTypes()[evdev.AbsoluteMTPositionY]
+	MTPositionX := axes[evdev.AbsoluteMTPositionX]
+	MTPositionY := axes[evdev.AbsoluteMTPositionY]
 	direct_screen_x := int64(MTPositionX.Max)
 	direct_screen_y := int64(MTPositionY.Max)
 	logger.Warnf("数据将直接写入设备真实触屏 /dev/input/event%d (%d, %d)", index, direct_screen_x, direct_screen_y)
 	translateDirectXY := func(x, y int32) (int32, int32) {
-		switch global_device_orientation {
+		switch global_orientation.current() {
 		case 0:
 			return int32(int64(x) * direct_screen_x / 0x7ffffffe), int32(int64(y) * direct_screen_y / 0x7ffffffe)
 		case 1:
@@ -40,114 +337,47 @@ func handel_touch_using_direct_touch(index int) touch_control_func {
 			return int32(int64(x) * direct_screen_x / 0x7ffffffe), int32(int64(y) * direct_screen_y / 0x7ffffffe)
 		}
 	}
-	var count int32 = 0    //BTN_TOUCH 申请时为1 则按下 释放时为0 则松开
-	var last_id int32 = -1 //ABS_MT_SLOT last_id每次动作后修改 如果不等则额外发送MT_SLOT事件
+	if _, ok := axes[evdev.AbsoluteMTSlot]; !ok {
+		logger.Errorf("/dev/input/event%d 不支持ABS_MT_SLOT 无法直接写入", index)
+		os.Exit(3)
+	}
+	slots := int(axes[evdev.AbsoluteMTSlot].Max) + 1
+	tracking_max := axes[evdev.AbsoluteMTTrackingID].Max
+	if tracking_max < int32(slots) {
+		tracking_max = 65535
+	}
 	unixFd := int(fd.Fd())
+	attrs := new_touch_attr_writer(unixFd, get_touch_abs_ranges(axes))
+	direct := new_direct_touch(unixFd, slots, tracking_max, attrs, translateDirectXY)
+	direct.sync_slots()
+	logger.Infof("真实触屏共%d个slot 虚拟触点从slot %d向下分配", slots, slots-1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	event_ch := d.Poll(ctx)
 	go func() {
-		<-global_close_signal
-		fd.Close()
+		for {
+			select {
+			case <-global_close_signal:
+				cancel()
+				direct.release_all()
+				fd.Close()
+				return
+			case event := <-event_ch:
+				if event == nil {
+					logger.Warnf("无法读取真实触屏 /dev/input/event%d", index)
+					event_ch = nil
+					continue
+				}
+				direct.handel_event(event.Event)
+			}
+		}
 	}()
-	require_init := makeEventsMMap(6 * 24)
-	require := makeEventsMMap(5 * 24)
-
-	release := makeEventsMMap(2 * 24)
-	switch_release := makeEventsMMap(3 * 24)
-	switch_release_btnup := makeEventsMMap(4 * 24)
-	release_btnup := makeEventsMMap(3 * 24)
-
-	switch_move := makeEventsMMap(4 * 24)
-	move := makeEventsMMap(3 * 24)
-
-	require_init.Events[0] = evdev.Event{Type: EV_ABS, Code: ABS_MT_SLOT, Value: 0}
-	require_init.Events[1] = evdev.Event{Type: EV_ABS, Code: ABS_MT_TRACKING_ID, Value: 0}
-	require_init.Events[2] = evdev.Event{Type: EV_KEY, Code: BTN_TOUCH, Value: DOWN}
-	require_init.Events[3] = evdev.Event{Type: EV_ABS, Code: ABS_MT_POSITION_X, Value: 0}
-	require_init.Events[4] = evdev.Event{Type: EV_ABS, Code: ABS_MT_POSITION_Y, Value: 0}
-	require_init.Events[5] = evdev.Event{Type: EV_SYN, Code: 0, Value: 0}
-
-	require.Events[0] = evdev.Event{Type: EV_ABS, Code: ABS_MT_SLOT, Value: 0}
-	require.Events[1] = evdev.Event{Type: EV_ABS, Code: ABS_MT_TRACKING_ID, Value: 0}
-	require.Events[2] = evdev.Event{Type: EV_ABS, Code: ABS_MT_POSITION_X, Value: 0}
-	require.Events[3] = evdev.Event{Type: EV_ABS, Code: ABS_MT_POSITION_Y, Value: 0}
-	require.Events[4] = evdev.Event{Type: EV_SYN, Code: 0, Value: 0}
-
-	release.Events[0] = evdev.Event{Type: EV_ABS, Code: ABS_MT_TRACKING_ID, Value: -1}
-	release.Events[1] = evdev.Event{Type: EV_SYN, Code: 0, Value: 0}
-
-	switch_release.Events[0] = evdev.Event{Type: EV_ABS, Code: ABS_MT_SLOT, Value: 0}
-	switch_release.Events[1] = evdev.Event{Type: EV_ABS, Code: ABS_MT_TRACKING_ID, Value: -1}
-	switch_release.Events[2] = evdev.Event{Type: EV_SYN, Code: 0, Value: 0}
-
-	switch_release_btnup.Events[0] = evdev.Event{Type: EV_ABS, Code: ABS_MT_SLOT, Value: 0}
-	switch_release_btnup.Events[1] = evdev.Event{Type: EV_ABS, Code: ABS_MT_TRACKING_ID, Value: -1}
-	switch_release_btnup.Events[2] = evdev.Event{Type: EV_KEY, Code: BTN_TOUCH, Value: UP}
-	switch_release_btnup.Events[3] = evdev.Event{Type: EV_SYN, Code: 0, Value: 0}
-
-	release_btnup.Events[0] = evdev.Event{Type: EV_ABS, Code: ABS_MT_TRACKING_ID, Value: -1}
-	release_btnup.Events[1] = evdev.Event{Type: EV_KEY, Code: BTN_TOUCH, Value: UP}
-	release_btnup.Events[2] = evdev.Event{Type: EV_SYN, Code: 0, Value: 0}
-
-	switch_move.Events[0] = evdev.Event{Type: EV_ABS, Code: ABS_MT_SLOT, Value: 0}
-	switch_move.Events[1] = evdev.Event{Type: EV_ABS, Code: ABS_MT_POSITION_X, Value: 0}
-	switch_move.Events[2] = evdev.Event{Type: EV_ABS, Code: ABS_MT_POSITION_Y, Value: 0}
-	switch_move.Events[3] = evdev.Event{Type: EV_SYN, Code: 0, Value: 0}
-
-	move.Events[0] = evdev.Event{Type: EV_ABS, Code: ABS_MT_POSITION_X, Value: 0}
-	move.Events[1] = evdev.Event{Type: EV_ABS, Code: ABS_MT_POSITION_Y, Value: 0}
 
 	return func(control_data touch_control_pack) {
 		// logger.Tracef("direct touch handeler recv control data:%v", control_data)
 		if control_data.id == -1 { //在任何正常情况下 这里是拿不到ID=-1的控制包的因此可以直接丢弃
 			return
 		}
-		if control_data.action == TouchActionRequire {
-			x, y := translateDirectXY(control_data.x, control_data.y)
-			last_id = control_data.id
-			if count += 1; count == 1 {
-				require_init.Events[0].Value = control_data.id
-				require_init.Events[1].Value = control_data.id
-				require_init.Events[3].Value = x
-				require_init.Events[4].Value = y
-				unix.Write(unixFd, require_init.data)
-			} else {
-				require.Events[0].Value = control_data.id
-				require.Events[1].Value = control_data.id
-				require.Events[2].Value = x
-				require.Events[3].Value = y
-				unix.Write(unixFd, require.data)
-			}
-
-		} else if control_data.action == TouchActionRelease {
-			if last_id != control_data.id {
-				last_id = control_data.id
-				if count -= 1; count == 0 {
-					switch_release_btnup.Events[0].Value = control_data.id
-					unix.Write(unixFd, switch_release_btnup.data)
-				} else {
-					switch_release.Events[0].Value = control_data.id
-					unix.Write(unixFd, switch_release.data)
-				}
-			} else {
-				if count -= 1; count == 0 {
-					unix.Write(unixFd, release_btnup.data)
-				} else {
-					unix.Write(unixFd, release.data)
-				}
-			}
-		} else if control_data.action == TouchActionMove {
-			x, y := translateDirectXY(control_data.x, control_data.y)
-			if last_id != control_data.id {
-				last_id = control_data.id
-				switch_move.Events[0].Value = control_data.id
-				switch_move.Events[1].Value = x
-				switch_move.Events[2].Value = y
-				unix.Write(unixFd, switch_move.data)
-
-			} else {
-				move.Events[0].Value = x
-				move.Events[1].Value = y
-				unix.Write(unixFd, move.data)
-			}
-		}
+		direct.handel_control(control_data)
 	}
 }
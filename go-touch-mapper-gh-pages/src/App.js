@@ -1,9 +1,17 @@
 import logo from './logo.svg';
 import './App.css';
+import { useEffect, useState } from "react";
 import ConfigManager from "./components/ConfigManager"
+import RemoteController from "./components/RemoteController"
 function App() {
+  const [hash, setHash] = useState(window.location.hash)
+  useEffect(() => {
+    const onHashChange = () => setHash(window.location.hash)
+    window.addEventListener("hashchange", onHashChange)
+    return () => window.removeEventListener("hashchange", onHashChange)
+  }, [])
   return (
-   <ConfigManager/>
+    hash === "#/remote" ? <RemoteController /> : <ConfigManager />
   );
 }
 
@@ -24,6 +24,7 @@ import {
 } from "./UIcomponents"
 import { produce } from "immer"
 import FullscreenIcon from '@mui/icons-material/Fullscreen';
+import SportsEsportsIcon from '@mui/icons-material/SportsEsports';
 
 function copyToClipboard(text) {
     let transfer = document.createElement('input');
@@ -403,6 +404,7 @@ export default function ConfigManager() {
                     {selectKEY ? <a>&emsp;点击屏幕映射{selectKEY}</a> : <a>&emsp;按下某个按键并点击</a>}
                 </Grid>
                 <Grid item>
+                    <IconButton onClick={() => { window.location.hash = "#/remote" }} ><SportsEsportsIcon /></IconButton>
                     <IconButton onClick={() => document.body.requestFullscreen()} ><FullscreenIcon /></IconButton>
                 </Grid>
             </Grid>
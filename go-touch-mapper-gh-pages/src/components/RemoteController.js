@@ -0,0 +1,222 @@
+import { Button, Input, Paper, Typography } from "@mui/material";
+import { useEffect, useRef, useState } from "react";
+import { hmacSha256 } from "./hmac";
+import * as keyNameMap from "./keynamemap.json";
+
+// 浏览器远程控制 键盘 鼠标(指针锁定) 与手柄(Gamepad API) 通过 /remote/browser 发送到手机
+// 手柄按键与轴的编号与remote_control.py中的rjs一致
+// 连接后服务端发送挑战 使用密钥计算HMAC回复 认证通过前不发送任何事件
+
+const mouseButtonName = ["BTN_LEFT", "BTN_MIDDLE", "BTN_RIGHT", "BTN_SIDE", "BTN_EXTRA"]
+// 标准手柄布局的按键序号 => rjs按键编号 6 7为扳机 12~15为十字键 单独处理
+const gamepadButtonCode = { 0: 0, 1: 1, 2: 2, 3: 3, 4: 4, 5: 5, 8: 6, 9: 7, 10: 8, 11: 9, 16: 10 }
+const challengePrefix = "go-touch-mapper browser challenge"
+
+function buildUrl() {
+    const protocol = window.location.protocol === "https:" ? "wss" : "ws"
+    return `${protocol}://${window.location.host}/remote/browser`
+}
+
+export default function RemoteController() {
+    const [psk, setPsk] = useState(localStorage.getItem("remote_psk") || "")
+    const [connected, setConnected] = useState(false)
+    const [locked, setLocked] = useState(false)
+    const [gamepadCount, setGamepadCount] = useState(0)
+    const [receivers, setReceivers] = useState([])
+    const wsRef = useRef(null)
+    const authedRef = useRef(false)
+    const areaRef = useRef(null)
+    const pressedKeys = useRef(new Set())
+    const gamepadLast = useRef({})
+
+    const send = (message) => {
+        if (authedRef.current && wsRef.current && wsRef.current.readyState === WebSocket.OPEN) {
+            wsRef.current.send(JSON.stringify(message))
+        }
+    }
+
+    const sendKey = (name, value) => {
+        if (!name) return
+        if (value === 1) {
+            if (pressedKeys.current.has(name)) return
+            pressedKeys.current.add(name)
+        } else {
+            if (!pressedKeys.current.has(name)) return
+            pressedKeys.current.delete(name)
+        }
+        send({ type: "key", name: name, value: value })
+    }
+
+    const releaseKeys = () => {
+        for (let name of [...pressedKeys.current]) {
+            sendKey(name, 0)
+        }
+    }
+
+    const connect = () => {
+        if (wsRef.current) wsRef.current.close()
+        localStorage.setItem("remote_psk", psk)
+        authedRef.current = false
+        const ws = new WebSocket(buildUrl())
+        ws.onmessage = (e) => {
+            const message = JSON.parse(e.data)
+            if (message.type !== "challenge") return
+            ws.send(JSON.stringify({ type: "auth", mac: hmacSha256(psk, challengePrefix + message.nonce) }))
+            authedRef.current = true
+            setConnected(true)
+        }
+        ws.onclose = () => {
+            if (wsRef.current !== ws) return
+            authedRef.current = false
+            setConnected(false)
+            pressedKeys.current.clear()
+        }
+        wsRef.current = ws
+    }
+
+    const discover = () => {
+        fetch('/remote/discover')
+            .then(response => response.json())
+            .then(data => setReceivers(data || []))
+            .catch(err => console.log("discover failed", err))
+    }
+
+    useEffect(() => {
+        connect()
+        const beat = setInterval(() => send({ type: "beat" }), 500)
+        return () => {
+            clearInterval(beat)
+            if (wsRef.current) wsRef.current.close()
+        }
+        // eslint-disable-next-line react-hooks/exhaustive-deps
+    }, [])
+
+    // 键盘与鼠标 仅在指针锁定时发送
+    useEffect(() => {
+        const isLocked = () => document.pointerLockElement === areaRef.current
+        const onLockChange = () => {
+            setLocked(isLocked())
+            if (!isLocked()) releaseKeys()
+        }
+        const onKey = (value) => (e) => {
+            if (!isLocked()) return
+            e.preventDefault()
+            if (e.repeat) return
+            sendKey(keyNameMap[e.code.toLowerCase()], value)
+        }
+        const onKeyDown = onKey(1)
+        const onKeyUp = onKey(0)
+        const onMouseMove = (e) => {
+            if (!isLocked() || (e.movementX === 0 && e.movementY === 0)) return
+            send({ type: "rel", x: e.movementX, y: e.movementY })
+        }
+        const onMouseButton = (value) => (e) => {
+            if (!isLocked()) return
+            e.preventDefault()
+            sendKey(mouseButtonName[e.button], value)
+        }
+        const onMouseDown = onMouseButton(1)
+        const onMouseUp = onMouseButton(0)
+        const onWheel = (e) => {
+            if (!isLocked()) return
+            e.preventDefault()
+            send({ type: "rel", wheel: -Math.sign(e.deltaY), hwheel: Math.sign(e.deltaX) })
+        }
+        const onContextMenu = (e) => isLocked() && e.preventDefault()
+        const onBlur = () => releaseKeys()
+        document.addEventListener("pointerlockchange", onLockChange)
+        document.addEventListener("keydown", onKeyDown)
+        document.addEventListener("keyup", onKeyUp)
+        document.addEventListener("mousemove", onMouseMove)
+        document.addEventListener("mousedown", onMouseDown)
+        document.addEventListener("mouseup", onMouseUp)
+        document.addEventListener("wheel", onWheel, { passive: false })
+        document.addEventListener("contextmenu", onContextMenu)
+        window.addEventListener("blur", onBlur)
+        return () => {
+            document.removeEventListener("pointerlockchange", onLockChange)
+            document.removeEventListener("keydown", onKeyDown)
+            document.removeEventListener("keyup", onKeyUp)
+            document.removeEventListener("mousemove", onMouseMove)
+            document.removeEventListener("mousedown", onMouseDown)
+            document.removeEventListener("mouseup", onMouseUp)
+            document.removeEventListener("wheel", onWheel)
+            document.removeEventListener("contextmenu", onContextMenu)
+            window.removeEventListener("blur", onBlur)
+        }
+        // eslint-disable-next-line react-hooks/exhaustive-deps
+    }, [])
+
+    // 手柄 轮询状态变化
+    useEffect(() => {
+        const axisValue = (value) => Math.round(value * 32767)
+        const triggerValue = (value) => Math.round(value * 2046 - 1023)
+        const poll = () => {
+            const gamepads = [...navigator.getGamepads()].filter(gp => gp)
+            if (gamepads.length !== gamepadCount) setGamepadCount(gamepads.length)
+            for (let gp of gamepads) {
+                const last = gamepadLast.current[gp.index] || { buttons: {}, abs: {} }
+                const current = { buttons: {}, abs: {} }
+                for (let i in gamepadButtonCode) {
+                    if (gp.buttons[i]) current.buttons[gamepadButtonCode[i]] = gp.buttons[i].pressed ? 1 : 0
+                }
+                for (let i = 0; i < 4 && i < gp.axes.length; i++) {
+                    current.abs[i] = axisValue(gp.axes[i])
+                }
+                if (gp.buttons[7]) current.abs[5] = triggerValue(gp.buttons[7].value)
+                if (gp.buttons[6]) current.abs[4] = triggerValue(gp.buttons[6].value)
+                if (gp.buttons.length > 15) {
+                    current.abs[6] = (gp.buttons[15].pressed ? 1 : 0) - (gp.buttons[14].pressed ? 1 : 0)
+                    current.abs[7] = (gp.buttons[13].pressed ? 1 : 0) - (gp.buttons[12].pressed ? 1 : 0)
+                }
+                for (let code in current.buttons) {
+                    if ((last.buttons[code] || 0) !== current.buttons[code]) {
+                        send({ type: "js_btn", code: parseInt(code), value: current.buttons[code] })
+                    }
+                }
+                for (let code in current.abs) {
+                    if (last.abs[code] !== current.abs[code]) {
+                        send({ type: "js_abs", code: parseInt(code), value: current.abs[code] })
+                    }
+                }
+                gamepadLast.current[gp.index] = current
+            }
+        }
+        const interval = setInterval(poll, 4)
+        return () => clearInterval(interval)
+        // eslint-disable-next-line react-hooks/exhaustive-deps
+    }, [gamepadCount])
+
+    return <div style={{ padding: "10px" }}>
+        <Paper sx={{ padding: "10px", marginBottom: "10px" }}>
+            <Typography variant="h6">{"浏览器远程控制"}</Typography>
+            <Typography>{connected ? "已连接" : "未连接"} &emsp; 手柄：{gamepadCount}</Typography>
+            <Input placeholder="密钥(与--psk相同)" value={psk} onChange={(e) => setPsk(e.target.value)} />
+            <Button onClick={connect}>{"连接"}</Button>
+            <Button onClick={() => { window.location.hash = "" }}>{"返回"}</Button>
+            <Button onClick={discover}>{"搜索其他设备"}</Button>
+            {receivers.map(info => <Typography key={`${info.ip}:${info.port}`}>
+                <a href={`http://${info.ip}:${info.port + 1}/#/remote`}>{info.name}</a>
+                &emsp;{info.ip}:{info.port}&emsp;{info.version}{info.auth ? " 需要密钥" : ""}
+            </Typography>)}
+        </Paper>
+        <div
+            ref={areaRef}
+            onClick={() => areaRef.current.requestPointerLock()}
+            style={{
+                height: "60vh",
+                borderRadius: "10px",
+                border: "5px solid #00b894",
+                background: "#2C3A47",
+                color: "white",
+                display: "flex",
+                alignItems: "center",
+                justifyContent: "center",
+                fontSize: "24px",
+                userSelect: "none",
+            }}
+        >
+            {locked ? "正在控制 按Esc退出" : "点击此处开始控制键盘与鼠标"}
+        </div>
+    </div>
+}
@@ -0,0 +1,80 @@
+// HMAC-SHA256 控制后台通过http访问时浏览器不提供crypto.subtle 因此使用纯js实现
+// 仅用于浏览器远程控制的挑战认证 数据量很小 不考虑性能
+
+const K = [
+    0x428a2f98, 0x71374491, 0xb5c0fbcf, 0xe9b5dba5, 0x3956c25b, 0x59f111f1, 0x923f82a4, 0xab1c5ed5,
+    0xd807aa98, 0x12835b01, 0x243185be, 0x550c7dc3, 0x72be5d74, 0x80deb1fe, 0x9bdc06a7, 0xc19bf174,
+    0xe49b69c1, 0xefbe4786, 0x0fc19dc6, 0x240ca1cc, 0x2de92c6f, 0x4a7484aa, 0x5cb0a9dc, 0x76f988da,
+    0x983e5152, 0xa831c66d, 0xb00327c8, 0xbf597fc7, 0xc6e00bf3, 0xd5a79147, 0x06ca6351, 0x14292967,
+    0x27b70a85, 0x2e1b2138, 0x4d2c6dfc, 0x53380d13, 0x650a7354, 0x766a0abb, 0x81c2c92e, 0x92722c85,
+    0xa2bfe8a1, 0xa81a664b, 0xc24b8b70, 0xc76c51a3, 0xd192e819, 0xd6990624, 0xf40e3585, 0x106aa070,
+    0x19a4c116, 0x1e376c08, 0x2748774c, 0x34b0bcb5, 0x391c0cb3, 0x4ed8aa4a, 0x5b9cca4f, 0x682e6ff3,
+    0x748f82ee, 0x78a5636f, 0x84c87814, 0x8cc70208, 0x90befffa, 0xa4506ceb, 0xbef9a3f7, 0xc67178f2,
+]
+
+function sha256(bytes) {
+    const length = bytes.length
+    const padded = new Uint8Array(((length + 9 + 63) >> 6) << 6)
+    padded.set(bytes)
+    padded[length] = 0x80
+    const view = new DataView(padded.buffer)
+    view.setUint32(padded.length - 4, length * 8)
+    view.setUint32(padded.length - 8, Math.floor(length / 0x20000000))
+    const h = [0x6a09e667, 0xbb67ae85, 0x3c6ef372, 0xa54ff53a, 0x510e527f, 0x9b05688c, 0x1f83d9ab, 0x5be0cd19]
+    const w = new Uint32Array(64)
+    const rotr = (x, n) => (x >>> n) | (x << (32 - n))
+    for (let offset = 0; offset < padded.length; offset += 64) {
+        for (let i = 0; i < 16; i++) w[i] = view.getUint32(offset + i * 4)
+        for (let i = 16; i < 64; i++) {
+            const s0 = rotr(w[i - 15], 7) ^ rotr(w[i - 15], 18) ^ (w[i - 15] >>> 3)
+            const s1 = rotr(w[i - 2], 17) ^ rotr(w[i - 2], 19) ^ (w[i - 2] >>> 10)
+            w[i] = (w[i - 16] + s0 + w[i - 7] + s1) | 0
+        }
+        let [a, b, c, d, e, f, g, hh] = h
+        for (let i = 0; i < 64; i++) {
+            const t1 = (hh + (rotr(e, 6) ^ rotr(e, 11) ^ rotr(e, 25)) + ((e & f) ^ (~e & g)) + K[i] + w[i]) | 0
+            const t2 = ((rotr(a, 2) ^ rotr(a, 13) ^ rotr(a, 22)) + ((a & b) ^ (a & c) ^ (b & c))) | 0
+            hh = g
+            g = f
+            f = e
+            e = (d + t1) | 0
+            d = c
+            c = b
+            b = a
+            a = (t1 + t2) | 0
+        }
+        h[0] = (h[0] + a) | 0
+        h[1] = (h[1] + b) | 0
+        h[2] = (h[2] + c) | 0
+        h[3] = (h[3] + d) | 0
+        h[4] = (h[4] + e) | 0
+        h[5] = (h[5] + f) | 0
+        h[6] = (h[6] + g) | 0
+        h[7] = (h[7] + hh) | 0
+    }
+    const result = new Uint8Array(32)
+    const resultView = new DataView(result.buffer)
+    h.forEach((value, i) => resultView.setUint32(i * 4, value))
+    return result
+}
+
+// 返回十六进制字符串
+export function hmacSha256(key, message) {
+    const encoder = new TextEncoder()
+    let keyBytes = encoder.encode(key)
+    if (keyBytes.length > 64) keyBytes = sha256(keyBytes)
+    const inner = new Uint8Array(64)
+    const outer = new Uint8Array(64)
+    for (let i = 0; i < 64; i++) {
+        inner[i] = (keyBytes[i] || 0) ^ 0x36
+        outer[i] = (keyBytes[i] || 0) ^ 0x5c
+    }
+    const messageBytes = encoder.encode(message)
+    const innerInput = new Uint8Array(64 + messageBytes.length)
+    innerInput.set(inner)
+    innerInput.set(messageBytes, 64)
+    const outerInput = new Uint8Array(96)
+    outerInput.set(outer)
+    outerInput.set(sha256(innerInput), 64)
+    return [...sha256(outerInput)].map(b => b.toString(16).padStart(2, "0")).join("")
+}
@@ -24,6 +24,7 @@ type TouchHandler struct {
 	view_id                 int32                       //视角的触摸ID
 	wheel_id                int32                       //左摇杆的触摸ID
 	allocated_id            []bool                      //10个触摸点分配情况
+	touch_attrs             []touch_attr                //每个触点的压力与接触面积 移动时沿用
 	config                  *simplejson.Json            //映射配置文件
 	joystickInfo            map[string]*simplejson.Json //所有摇杆配置文件 dev_name 为key
 	screen_x                int32                       //屏幕宽度
@@ -64,6 +65,14 @@ type TouchHandler struct {
 	wheel_shift_enable         bool  //启用shift轮盘
 	wheel_shift_switch_enable  bool  //shift轮盘切换 or 长按
 	wheel_shift_range          int32
+	gamepad                    *v_gamepad          //映射关闭时输出到虚拟手柄 未启用则为nil
+	passthrough                *passthrough_mapper //映射关闭时键鼠按键的重映射
+	tablet_id                  int32               //数位板笔尖的触摸ID
+	tablet_x                   int32               //数位板笔尖的当前位置 已归一化
+	tablet_y                   int32
+	config_path                string          //当前使用的配置文件路径
+	led                        *led_indicators //键盘指示灯显示映射状态
+	rotate_keys                map[string]bool //切换屏幕方向的快捷键
 }
 
 const (
@@ -76,11 +85,54 @@ const (
 	TouchActionResetResolution int8 = 3
 )
 
+const touch_slot_count = 12 //可分配的触点数 虚拟触屏的ABS_MT_SLOT与此一致
+
+// 触点的压力与接触面积 取值1-255 0表示未指定 由各触屏方案按设备范围缩放 不支持的方案忽略
+// 工具类型与ABS_MT_TOOL_TYPE相同 0为手指
+type touch_attr struct {
+	pressure int32
+	size     int32
+	tool     int32
+}
+
+var touch_tool_names = map[string]int32{
+	"FINGER": mtToolFinger,
+	"PEN":    mtToolPen,
+	"PALM":   mtToolPalm,
+}
+
+// KEY_MAPS中动作的PRESSURE与SIZE 与POS相同使用0-1的比例 TOOL为FINGER、PEN或PALM
+func parse_touch_attr(action *simplejson.Json) touch_attr {
+	to_attr := func(value float64) int32 {
+		if value <= 0 {
+			return 0
+		}
+		if value >= 1 {
+			return 255
+		}
+		if attr := int32(value*255 + 0.5); attr > 0 {
+			return attr
+		}
+		return 1
+	}
+	tool, ok := touch_tool_names[action.Get("TOOL").MustString("FINGER")]
+	if !ok {
+		logger.Warnf("未知的TOOL %s 使用FINGER", action.Get("TOOL").MustString())
+	}
+	return touch_attr{
+		pressure: to_attr(action.Get("PRESSURE").MustFloat64()),
+		size:     to_attr(action.Get("SIZE").MustFloat64()),
+		tool:     tool,
+	}
+}
+
 const (
 	UInput_mouse_move  int8 = 0
 	UInput_mouse_btn   int8 = 1
 	UInput_mouse_wheel int8 = 2
 	UInput_key_event   int8 = 3
+	UInput_gamepad_btn int8 = 4
+	UInput_gamepad_abs int8 = 5
 )
 
 const (
@@ -126,6 +178,7 @@ func InitTouchHandler(
 	u_input chan *u_input_control_pack,
 	map_switch_signal chan bool,
 	measure_sensitivity_mode bool,
+	gamepad_control_ch chan *u_input_control_pack,
 ) *TouchHandler {
 	rand.Seed(time.Now().UnixNano())
 
@@ -302,6 +355,11 @@ func InitTouchHandler(
 		}
 	}
 
+	var gamepad *v_gamepad = nil
+	if gamepad_control_ch != nil {
+		gamepad = init_v_gamepad(gamepad_control_ch, config_json)
+	}
+
 	return &TouchHandler{
 		events:             events,
 		touch_control_func: touch_control_func,
@@ -309,7 +367,8 @@ func InitTouchHandler(
 		map_on:             false, //false
 		view_id:            -1,
 		wheel_id:           -1,
-		allocated_id:       make([]bool, 12),
+		allocated_id:       make([]bool, touch_slot_count),
+		touch_attrs:        make([]touch_attr, touch_slot_count),
 		// ^^^ 是可以创建超过12个的 只是不显示白点罢了
 		config:         config_json,
 		joystickInfo:   joystickInfo,
@@ -356,6 +415,12 @@ func InitTouchHandler(
 		wheel_shift_enable:         config_json.Get("WHEEL").Get("SHIFT_RANGE_ENABLE").MustBool(),
 		wheel_shift_switch_enable:  config_json.Get("WHEEL").Get("SHIFT_RANGE_SWITCH_ENABLE").MustBool(),
 		wheel_shift_range:          int32(config_json.Get("WHEEL").Get("SHIFT_RANGE").MustFloat64() * float64(screenSizeX)),
+		gamepad:                    gamepad,
+		passthrough:                init_passthrough_mapper(config_json),
+		led:                        init_led_indicators(config_json),
+		rotate_keys:                parse_rotate_keys(config_json),
+		tablet_id:                  -1,
+		config_path:                mapperFilePath,
 	}
 }
 
@@ -375,7 +440,11 @@ func (self *TouchHandler) reloadConfigure(mapperFilePath string) {
 	screenSizeY := config_json.Get("SCREEN").Get("SIZE").GetIndex(1).MustInt()
 	global_screen_x = int32(screenSizeX)
 	global_screen_y = int32(screenSizeY)
+	self.config_path = mapperFilePath
 	self.config = config_json
+	if global_device_rules_from_config {
+		set_device_rules(parse_device_rules(config_json.Get("DEVICES")))
+	}
 	self.screen_x = int32(screenSizeX)
 	self.screen_y = int32(screenSizeY)
 	self.rel_screen_x = int32(screenSizeX)
@@ -410,6 +479,34 @@ func (self *TouchHandler) reloadConfigure(mapperFilePath string) {
 
 	self.wheel_shift_enable = config_json.Get("WHEEL").Get("SHIFT_RANGE_ENABLE").MustBool()
 	self.wheel_shift_range = int32(config_json.Get("WHEEL").Get("SHIFT_RANGE").MustFloat64() * float64(screenSizeX))
+	if self.gamepad != nil {
+		self.gamepad.load_config(config_json)
+	}
+	self.passthrough.load_config(config_json)
+	self.led.load_config(config_json)
+	self.rotate_keys = parse_rotate_keys(config_json)
+	self.push_screen_size()
+}
+
+func parse_rotate_keys(config_json *simplejson.Json) map[string]bool {
+	keys := make(map[string]bool)
+	for _, key := range config_json.Get("SCREEN").Get("ROTATE_KEYS").MustStringArray() {
+		if key != "" {
+			keys[key] = true
+		}
+	}
+	return keys
+}
+
+// 将配置文件中的屏幕尺寸按当前方向换算为设备自然方向的尺寸 发送给触屏后端
+func (self *TouchHandler) push_screen_size() {
+	size_x, size_y := self.screen_x, self.screen_y
+	if orientation := global_orientation.current(); orientation == 1 || orientation == 3 {
+		size_x, size_y = size_y, size_x
+	}
+	self.touch_control_lock.Lock()
+	defer self.touch_control_lock.Unlock()
+	self.send_touch_control_pack(TouchActionResetResolution, 0, size_x, size_y, touch_attr{})
 }
 
 func (self *TouchHandler) get_scaled_pos(x int32, y int32) (int32, int32) {
@@ -417,16 +514,21 @@ func (self *TouchHandler) get_scaled_pos(x int32, y int32) (int32, int32) {
 }
 
 func (self *TouchHandler) touch_require(x int32, y int32, scale bool) int32 {
+	return self.touch_require_attr(x, y, scale, touch_attr{})
+}
+
+func (self *TouchHandler) touch_require_attr(x int32, y int32, scale bool, attr touch_attr) int32 {
 	self.touch_control_lock.Lock()
 	defer self.touch_control_lock.Unlock()
 	for i, v := range self.allocated_id {
 		if !v {
 			self.allocated_id[i] = true
+			self.touch_attrs[i] = attr
 			if scale {
 				scaled_x, scaled_y := self.get_scaled_pos(x, y)
-				self.send_touch_control_pack(TouchActionRequire, int32(i), scaled_x, scaled_y)
+				self.send_touch_control_pack(TouchActionRequire, int32(i), scaled_x, scaled_y, attr)
 			} else {
-				self.send_touch_control_pack(TouchActionRequire, int32(i), x, y)
+				self.send_touch_control_pack(TouchActionRequire, int32(i), x, y, attr)
 			}
 			logger.Debugf("touch require [%v] => (%v,%v)", i, x, y)
 			return int32(i)
@@ -441,21 +543,30 @@ func (self *TouchHandler) touch_release(id int32) int32 {
 	logger.Debugf("touch release [%v]", id)
 	if id != -1 {
 		self.allocated_id[int(id)] = false
-		self.send_touch_control_pack(TouchActionRelease, id, -1, -1)
+		self.touch_attrs[int(id)] = touch_attr{}
+		self.send_touch_control_pack(TouchActionRelease, id, -1, -1, touch_attr{})
 	}
 	return -1
 }
 
 func (self *TouchHandler) touch_move(id int32, x int32, y int32, scale bool) {
+	self.touch_move_attr(id, x, y, scale, nil)
+}
+
+// attr为nil时沿用按下时的压力与接触面积
+func (self *TouchHandler) touch_move_attr(id int32, x int32, y int32, scale bool, attr *touch_attr) {
 	self.touch_control_lock.Lock()
 	defer self.touch_control_lock.Unlock()
 	logger.Debugf("touch move to (%v,%v) [%v]", x, y, id)
 	if id != -1 {
+		if attr != nil {
+			self.touch_attrs[id] = *attr
+		}
 		if scale {
 			scaled_x, scaled_y := self.get_scaled_pos(x, y)
-			self.send_touch_control_pack(TouchActionMove, id, scaled_x, scaled_y)
+			self.send_touch_control_pack(TouchActionMove, id, scaled_x, scaled_y, self.touch_attrs[id])
 		} else {
-			self.send_touch_control_pack(TouchActionMove, id, x, y)
+			self.send_touch_control_pack(TouchActionMove, id, x, y, self.touch_attrs[id])
 		}
 
 	}
@@ -469,7 +580,7 @@ func (self *TouchHandler) u_input_control(action int8, arg1 int32, arg2 int32) {
 	}
 }
 
-func (self *TouchHandler) send_touch_control_pack(action int8, id int32, x int32, y int32) {
+func (self *TouchHandler) send_touch_control_pack(action int8, id int32, x int32, y int32, attr touch_attr) {
 	self.touch_control_func(touch_control_pack{
 		action:   action,
 		id:       id,
@@ -477,6 +588,9 @@ func (self *TouchHandler) send_touch_control_pack(action int8, id int32, x int32
 		y:        y,
 		screen_x: self.screen_x,
 		screen_y: self.screen_y,
+		pressure: attr.pressure,
+		size:     attr.size,
+		tool:     attr.tool,
 	})
 }
 
@@ -490,7 +604,7 @@ func (self *TouchHandler) loop_handel_rs_move() {
 			if rs_x != 0.5 || rs_y != 0.5 {
 				if self.map_on {
 					self.handel_view_move(int32((rs_x-0.5)*self.rs_speed_x), int32((rs_y-0.5)*self.rs_speed_y))
-				} else {
+				} else if self.gamepad == nil { //启用虚拟手柄时右摇杆已直接输出
 					self.u_input_control(UInput_mouse_move, int32((rs_x-0.5)*24), int32((rs_y-0.5)*24))
 				}
 			}
@@ -651,7 +765,7 @@ func (self *TouchHandler) handel_rel_event(x int32, y int32, HWhell int32, Wheel
 	if x != 0 || y != 0 {
 		if self.map_on {
 			self.handel_view_move(x, y)
-		} else {
+		} else if self.gamepad == nil || !self.gamepad.mouse_move(x, y) {
 			self.u_input_control(UInput_mouse_move, x, y)
 		}
 	}
@@ -688,12 +802,13 @@ func (self *TouchHandler) execute_key_action(start time.Time, key_name string, u
 		}
 	}
 	defer logger.Debugf("key[%s]%s\t%v\t%v", key_name, UDF[up_down], action, time.Since(start))
+	attr := parse_touch_attr(action)
 	switch action_type {
 	case "PRESS": //按键的按下与释放直接映射为触屏的按下与释放
 		if up_down == DOWN {
 			x := int32(action.Get("POS").GetIndex(0).MustFloat64()*float64(self.rel_screen_x)) + rand_offset()
 			y := int32(action.Get("POS").GetIndex(1).MustFloat64()*float64(self.rel_screen_y)) + rand_offset()
-			self.key_action_state_save.Store(key_name, self.touch_require(x, y, true))
+			self.key_action_state_save.Store(key_name, self.touch_require_attr(x, y, true, attr))
 		} else if up_down == UP {
 			tid := state.(int32)
 			self.touch_release(tid)
@@ -704,7 +819,7 @@ func (self *TouchHandler) execute_key_action(start time.Time, key_name string, u
 			go (func() {
 				x := int32(action.Get("POS").GetIndex(0).MustFloat64()*float64(self.rel_screen_x)) + rand_offset()
 				y := int32(action.Get("POS").GetIndex(1).MustFloat64()*float64(self.rel_screen_y)) + rand_offset()
-				tid := self.touch_require(x, y, true)
+				tid := self.touch_require_attr(x, y, true, attr)
 				time.Sleep(time.Duration(8) * time.Millisecond) //8ms 120HZ下一次
 				self.touch_release(tid)
 			})()
@@ -719,7 +834,7 @@ func (self *TouchHandler) execute_key_action(start time.Time, key_name string, u
 			self.key_action_state_save.Store(key_name, true)
 			go (func() {
 				for {
-					tid := self.touch_require(x+rand_offset(), y+rand_offset(), true)
+					tid := self.touch_require_attr(x+rand_offset(), y+rand_offset(), true, attr)
 					time.Sleep(time.Duration(down_time) * time.Millisecond)
 					self.touch_release(tid)
 					time.Sleep(time.Duration(interval_time) * time.Millisecond)
@@ -743,7 +858,7 @@ func (self *TouchHandler) execute_key_action(start time.Time, key_name string, u
 				for i := range action.Get("POS_S").MustArray() {
 					x := int32(action.Get("POS_S").GetIndex(i).GetIndex(0).MustFloat64()*float64(self.rel_screen_x)) + rand_offset()
 					y := int32(action.Get("POS_S").GetIndex(i).GetIndex(1).MustFloat64()*float64(self.rel_screen_y)) + rand_offset()
-					tid := self.touch_require(x, y, true)
+					tid := self.touch_require_attr(x, y, true, attr)
 					tid_save = append(tid_save, tid)
 					time.Sleep(time.Duration(8) * time.Millisecond) // 间隔8ms 是否需要延迟有待验证
 				}
@@ -769,7 +884,7 @@ func (self *TouchHandler) execute_key_action(start time.Time, key_name string, u
 				interval_time := action.Get("INTERVAL").GetIndex(0).MustInt()
 				init_x := int32(action.Get("POS_S").GetIndex(0).GetIndex(0).MustFloat64() * float64(self.rel_screen_x))
 				init_y := int32(action.Get("POS_S").GetIndex(0).GetIndex(1).MustFloat64() * float64(self.rel_screen_y))
-				tid := self.touch_require(init_x, init_y, true)
+				tid := self.touch_require_attr(init_x, init_y, true, attr)
 				time.Sleep(time.Duration(interval_time) * time.Millisecond)
 				for index := 1; index < pos_len-1; index++ {
 					x := int32(action.Get("POS_S").GetIndex(index).GetIndex(0).MustFloat64()*float64(self.rel_screen_x)) + rand_offset()
@@ -798,6 +913,12 @@ func (self *TouchHandler) switch_map_mode() {
 		logger.Infof("已释放key:%s", key.(string))
 		return true
 	})
+	if !self.map_on {
+		self.passthrough.release_all(self.passthrough_key_output) //进入映射模式前 释放重映射后仍按下的按键
+		if self.gamepad != nil {
+			self.gamepad.reset() //进入映射模式前 虚拟手柄回中
+		}
+	}
 	self.map_on = !self.map_on            //切换
 	self.map_switch_signal <- self.map_on //发送信号到v_mouse切换显示
 	if self.map_on {
@@ -807,6 +928,52 @@ func (self *TouchHandler) switch_map_mode() {
 	}
 }
 
+func (self *TouchHandler) loop_handel_led() {
+	ticker := time.NewTicker(led_tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-global_close_signal:
+			return
+		case <-ticker.C:
+			self.led.update(self.map_on, self.passthrough.active_layer_names())
+		}
+	}
+}
+
+// 启动时以及屏幕方向改变时重新发送屏幕尺寸
+func (self *TouchHandler) loop_handel_orientation() {
+	orientation_ch := global_orientation.subscribe()
+	defer global_orientation.unsubscribe(orientation_ch)
+	self.push_screen_size()
+	for {
+		select {
+		case <-global_close_signal:
+			return
+		case <-orientation_ch:
+			self.push_screen_size()
+		}
+	}
+}
+
+// 回复远程发送端的映射状态
+func (self *TouchHandler) remote_status() *remote_status {
+	self.touch_control_lock.Lock()
+	touches := make([]int32, 0)
+	for i, v := range self.allocated_id {
+		if v {
+			touches = append(touches, int32(i))
+		}
+	}
+	self.touch_control_lock.Unlock()
+	return &remote_status{
+		map_on:      self.map_on,
+		orientation: global_orientation.current(),
+		touches:     touches,
+		profile:     filepath.Base(self.config_path),
+	}
+}
+
 func (self *TouchHandler) handel_key_up_down(key_name string, up_down int32, dev_name string) {
 	if key_name == "" {
 		return
@@ -823,6 +990,13 @@ func (self *TouchHandler) handel_key_up_down(key_name string, up_down int32, dev
 		}
 	}
 
+	if self.rotate_keys[key_name] {
+		if up_down == UP {
+			rotate_device_orientation(1, "快捷键")
+		}
+		return
+	}
+
 	if self.KEYBOARD_SWITCH_KEY_NAME_S[key_name] {
 		if up_down == UP {
 			self.switch_map_mode()
@@ -884,6 +1058,9 @@ func (self *TouchHandler) handel_key_up_down(key_name string, up_down int32, dev
 		}
 	} else {
 		if jsconfig, exist := self.joystickInfo[dev_name]; exist {
+			if self.gamepad != nil && self.gamepad.key(key_name, up_down) {
+				return //启用虚拟手柄时 手柄按键直接输出
+			}
 			//如果是手柄 则检查是否设置了键盘映射
 			if joystick_btn_map_key_name, ok := jsconfig.Get("MAP_KEYBOARD").CheckGet(key_name); ok {
 				//有则映射到普通按键
@@ -892,15 +1069,22 @@ func (self *TouchHandler) handel_key_up_down(key_name string, up_down int32, dev
 				logger.Debugf("joyStick[%s]\tkey[%s]\t无键盘映射", dev_name, key_name)
 			}
 		} else {
-			if code, exist := friendly_name_2_keycode[key_name]; exist {
-				//是合法按键 则输出
-				self.u_input_control(UInput_key_event, int32(code), int32(up_down))
-			}
+			self.passthrough.handle(key_name, up_down, self.passthrough_key_output)
 		}
 	}
 
 }
 
+func (self *TouchHandler) passthrough_key_output(key_name string, up_down int32) { //映射关闭时 重映射后的按键输出
+	if self.gamepad != nil && self.gamepad.mapped_key(key_name, up_down) {
+		return
+	}
+	if code, exist := friendly_name_2_keycode[key_name]; exist {
+		//是合法按键 则输出
+		self.u_input_control(UInput_key_event, int32(code), int32(up_down))
+	}
+}
+
 func (self *TouchHandler) handel_key_events(events []*evdev.Event, dev_type dev_type, dev_name string) {
 	if jsconfig, ok := self.joystickInfo[dev_name]; ok && dev_type == type_joystick {
 		for _, event := range events {
@@ -942,6 +1126,10 @@ func (self *TouchHandler) handel_abs_events(events []*evdev.Event, dev_type dev_
 			abs_mini := int32(abs_info.Get("range").GetIndex(0).MustInt())
 			abs_max := int32(abs_info.Get("range").GetIndex(1).MustInt())
 			formatted_value := float64(event.Value-abs_mini) / float64(abs_max-abs_mini)
+			if !self.map_on && self.gamepad != nil && self.gamepad.axis(name, formatted_value) {
+				self.abs_last.Store(name, formatted_value)
+				continue //摇杆与扳机直接输出到虚拟手柄
+			}
 			_last_value, _ := self.abs_last.Load(name)
 			last_value := _last_value.(float64)
 			if name == "HAT0X" || name == "HAT0Y" {
@@ -1000,6 +1188,41 @@ func (self *TouchHandler) handel_abs_events(events []*evdev.Event, dev_type dev_
 	}
 }
 
+// 数位板的笔尖直接对应一个触摸点 与映射开关无关 其余按键按普通按键处理
+func (self *TouchHandler) handel_tablet_events(events []*evdev.Event, dev_name string) {
+	moved := false
+	for _, event := range events { //先更新坐标 同一帧内按下时使用新位置
+		if event.Type == evdev.EventAbsolute {
+			if event.Code == uint16(evdev.AbsoluteX) {
+				self.tablet_x = event.Value
+			} else if event.Code == uint16(evdev.AbsoluteY) {
+				self.tablet_y = event.Value
+			}
+			moved = true
+		}
+	}
+	for _, event := range events {
+		if event.Type != evdev.EventKey {
+			continue
+		}
+		switch evdev.KeyType(event.Code) {
+		case evdev.BtnTouch:
+			if event.Value == DOWN && self.tablet_id == -1 {
+				self.tablet_id = self.touch_require(self.tablet_x, self.tablet_y, false)
+				moved = false
+			} else if event.Value == UP && self.tablet_id != -1 {
+				self.tablet_id = self.touch_release(self.tablet_id)
+			}
+		case evdev.BtnToolPen, evdev.BtnTooLRubber: //笔靠近或离开 不处理
+		default:
+			self.handel_key_up_down(GetKeyName(event.Code), event.Value, dev_name)
+		}
+	}
+	if moved && self.tablet_id != -1 {
+		self.touch_move(self.tablet_id, self.tablet_x, self.tablet_y, false)
+	}
+}
+
 func (self *TouchHandler) mix_touch(touch_events chan *event_pack) {
 	id_2_vid := make([]int32, 10) //硬件ID到虚拟ID的映射
 	var last_id int32 = 0
@@ -1011,9 +1234,10 @@ func (self *TouchHandler) mix_touch(touch_events chan *event_pack) {
 	for i := 0; i < 10; i++ {
 		id_statuses[i] = false
 	}
+	attr_s := make([]touch_attr, 10) //压力与接触面积 touch_dev_reader已归一化到1-255 工具类型原样转发
 
 	translate_xy := func(x, y int32) (int32, int32) { //根据设备方向 将eventX的坐标系转换为标准坐标系
-		switch global_device_orientation { //
+		switch global_orientation.current() { //
 		case 0: //normal
 			return x, y
 		case 1: //left side down
@@ -1034,6 +1258,8 @@ func (self *TouchHandler) mix_touch(touch_events chan *event_pack) {
 		copy(copy_pos_s, pos_s)
 		copy_id_statuses := make([]bool, 10)
 		copy(copy_id_statuses, id_statuses)
+		copy_attr_s := make([]touch_attr, 10)
+		copy(copy_attr_s, attr_s)
 		select {
 		case <-global_close_signal:
 			return
@@ -1044,6 +1270,12 @@ func (self *TouchHandler) mix_touch(touch_events chan *event_pack) {
 					pos_s[last_id] = []int32{event.Value, pos_s[last_id][1]}
 				case ABS_MT_POSITION_Y:
 					pos_s[last_id] = []int32{pos_s[last_id][0], event.Value}
+				case ABS_MT_PRESSURE:
+					attr_s[last_id].pressure = event.Value
+				case ABS_MT_TOUCH_MAJOR:
+					attr_s[last_id].size = event.Value
+				case ABS_MT_TOOL_TYPE:
+					attr_s[last_id].tool = event.Value
 				case ABS_MT_TRACKING_ID:
 					if event.Value == -1 {
 						id_statuses[last_id] = false
@@ -1058,16 +1290,17 @@ func (self *TouchHandler) mix_touch(touch_events chan *event_pack) {
 				if copy_id_statuses[i] != id_statuses[i] {
 					if id_statuses[i] { //false -> true 申请
 						x, y := translate_xy(pos_s[i][0], pos_s[i][1])
-						id_2_vid[i] = self.touch_require(x, y, false)
+						id_2_vid[i] = self.touch_require_attr(x, y, false, attr_s[i])
 						logger.Debugf("mixTouch\trequire\t[%d] translate_xy(%d,%d) => (%d,%d)", i, pos_s[i][0], pos_s[i][1], x, y)
 					} else {
 						self.touch_release(id_2_vid[i])
 						logger.Debugf("mixTouch\trelease\t[%d] ", i)
 					}
 				} else {
-					if pos_s[i][0] != copy_pos_s[i][0] || pos_s[i][1] != copy_pos_s[i][1] {
+					if pos_s[i][0] != copy_pos_s[i][0] || pos_s[i][1] != copy_pos_s[i][1] || attr_s[i] != copy_attr_s[i] {
 						x, y := translate_xy(pos_s[i][0], pos_s[i][1])
-						self.touch_move(id_2_vid[i], x, y, false)
+						attr := attr_s[i]
+						self.touch_move_attr(id_2_vid[i], x, y, false, &attr)
 						logger.Debugf("mixTouch\tmove\t[%d] translate_xy(%d,%d) => (%d,%d)", i, pos_s[i][0], pos_s[i][1], x, y)
 					}
 				}
@@ -1089,6 +1322,10 @@ func (self *TouchHandler) handel_event() {
 		case <-global_close_signal:
 			return
 		case event_pack := <-self.events:
+			if event_pack.dev_type == type_tablet {
+				self.handel_tablet_events(event_pack.events, event_pack.dev_name)
+				continue
+			}
 			for _, event := range event_pack.events {
 				switch event.Type {
 				case evdev.EventKey:
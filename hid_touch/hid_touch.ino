@@ -3,42 +3,61 @@
  * -----------------------------------------------------------------
  * - This version initializes the HID device as a pointer (nullptr)
  * and creates the instance dynamically within the initDevice() function.
- * - Supports dynamic resolution changes via Serial command.
- * - HID descriptor declares a single touch contact report.
- * - Serial protocol for touch reports (binary):
+ * - HID descriptor declares REPORT_CONTACTS contacts per report and
+ * MAX_CONTACTS in total. Frames with more contacts than one report can
+ * hold are sent in hybrid mode: the first report carries the total
+ * contact count, the following ones carry 0.
+ * - Serial protocol v1 for single contact reports (binary):
  * - Header: 0xF4
- * - Report: 11 bytes matching the HID descriptor structure.
- * - Serial protocol for resolution change (binary):
+ * - Report: <tip> <id> <x u32> <y u32> <count>
+ * - Serial protocol v2 for multi contact frames (binary):
+ * - Header: 0xF5
+ * - Count: 1 byte
+ * - Contacts: count * <tip> <id> <x u32> <y u32>
+ * - Serial protocol for commands (binary):
  * - Header: 0xF4
  * - Command byte: 0x03
- * - New Max X: 4 bytes, little-endian (uint32_t)
- * - New Max Y: 4 bytes, little-endian (uint32_t)
+ * - Sub command: 0x00 resolution change, 0xFE version query
+ * - X: 4 bytes, little-endian (uint32_t)
+ * - Y: 4 bytes, little-endian (uint32_t)
+ * - Version query reply (text): "GTHID <version> <max contacts>\n"
+ * - Serial protocol v3 framed packets (binary):
+ * - 0xF6 <len> <type> <seq> <data...> <crc16 le>
+ * - len counts type + seq + data, crc16 (CCITT, init 0xFFFF) covers len to data
+ * - Type 0x01: v2 frame content (count + contacts), type 0x02: command (sub, x, y)
+ * - Every valid packet is answered with an ack (type 0x80, same seq),
+ * - corrupted or truncated packets with a nak (type 0x81). The parser then
+ * - rescans the dropped bytes for the next 0xF6 header.
+ * - Serial protocol v4 adds framed type 0x03: count + count * <tip> <id> <x u32> <y u32>
+ * - <pressure> <width>. Pressure 0 means unspecified and is reported as 255,
+ * - contacts from older packet types are reported with full pressure and width 0.
  */
 #include "USB.h"
 #include "USBHID.h"
 #include <string.h>
 // #include <Preferences.h> // 用于访问非易失性存储
-// Using macros instead of "magic numbers" improves readability and maintainability.
-// These values are byte offsets calculated from the report_descriptor below.
-#define REPORT_DESC_MAX_X_OFFSET 41
-#define REPORT_DESC_MAX_Y_OFFSET 56
+
+#define FIRMWARE_VERSION 4
+#define MAX_CONTACTS 10
+#define REPORT_CONTACTS 5
+#define CONTACT_SIZE 10
+#define CONTACT_EX_SIZE 12
+#define REPORT_CONTACT_SIZE CONTACT_EX_SIZE
+#define REPORT_SIZE (REPORT_CONTACTS * REPORT_CONTACT_SIZE + 1)
 
 // Preferences preferences;
 USBHID HID;
 
 // HID Report Descriptor
-// Defines a touchscreen device with information for one touch point (status, ID, X/Y coordinates)
-// and the total number of contacts.
-static uint8_t report_descriptor[] = {
-    0x05, 0x0D, // Usage Page (Digitizer)
-    0x09, 0x04, // Usage (Touch Screen)
-    0xA1, 0x01, // Collection (Application)
-    // Finger 1
+// Defines a touchscreen device with REPORT_CONTACTS touch points (status, ID, X/Y coordinates, pressure, width)
+// and the total number of contacts. Built in buildDescriptor().
+static const uint8_t finger_descriptor[] = {
+    0x05, 0x0D, //   Usage Page (Digitizer)
     0x09, 0x22, //   Usage (Finger)
     0xA1, 0x02, //   Collection (Logical)
     0x09, 0x42, //     Usage (Tip Switch)
     0x15, 0x00, //     Logical Minimum (0)
-    0x25, 0x10, //     Logical Maximum (1)
+    0x25, 0x01, //     Logical Maximum (1)
     0x75, 0x01, //     Report Size (1)
     0x95, 0x01, //     Report Count (1)
     0x81, 0x02, //     Input (Data,Var,Abs)
@@ -50,29 +69,67 @@ static uint8_t report_descriptor[] = {
     0x81, 0x02, //     Input (Data,Var,Abs)
     0x05, 0x01, //     Usage Page (Generic Desktop)
     // X
-    0x09, 0x30,                             // Usage (X)
-    0x15, 0x00,                             // Logical Minimum (0)
-    0x27, /*41 ->*/ 0xfe, 0xff, 0xff, 0x7f, // Logical Maximum (1440 << 8)
-    0x75, 0x20,                             // Report Size (32)
-    0x95, 0x01,                             // Report Count (1)
-    0x81, 0x02,                             // Input (Data,Var,Abs)
+    0x09, 0x30,                   // Usage (X)
+    0x15, 0x00,                   // Logical Minimum (0)
+    0x27, 0xfe, 0xff, 0xff, 0x7f, // Logical Maximum (0x7ffffffe)
+    0x75, 0x20,                   // Report Size (32)
+    0x95, 0x01,                   // Report Count (1)
+    0x81, 0x02,                   // Input (Data,Var,Abs)
     // Y
-    0x09, 0x31,                             // Usage (Y)
-    0x15, 0x00,                             // Logical Minimum (0)
-    0x27, /*56 ->*/ 0xfe, 0xff, 0xff, 0x7f, // Logical Maximum (3200 << 8)
-    0x75, 0x20,                             // Report Size (32)
-    0x95, 0x01,
-    0x81, 0x02,
-    0xC0, //   End Collection
-    // Contact Count
+    0x09, 0x31,                   // Usage (Y)
+    0x15, 0x00,                   // Logical Minimum (0)
+    0x27, 0xfe, 0xff, 0xff, 0x7f, // Logical Maximum (0x7ffffffe)
+    0x75, 0x20,                   // Report Size (32)
+    0x95, 0x01,                   // Report Count (1)
+    0x81, 0x02,                   // Input (Data,Var,Abs)
+    0x05, 0x0D,                   // Usage Page (Digitizer)
+    // Pressure
+    0x09, 0x30,                   // Usage (Tip Pressure)
+    0x15, 0x00,                   // Logical Minimum (0)
+    0x26, 0xff, 0x00,             // Logical Maximum (255)
+    0x75, 0x08,                   // Report Size (8)
+    0x95, 0x01,                   // Report Count (1)
+    0x81, 0x02,                   // Input (Data,Var,Abs)
+    // Width
+    0x09, 0x48,                   // Usage (Width)
+    0x15, 0x00,                   // Logical Minimum (0)
+    0x26, 0xff, 0x00,             // Logical Maximum (255)
+    0x75, 0x08,                   // Report Size (8)
+    0x95, 0x01,                   // Report Count (1)
+    0x81, 0x02,                   // Input (Data,Var,Abs)
+    0xC0,                         //   End Collection
+};
+static const uint8_t descriptor_head[] = {
     0x05, 0x0D, // Usage Page (Digitizer)
-    0x09, 0x54, // Usage (Contact Count)
-    0x25, 0x02, // Logical Maximum (2)
-    0x75, 0x08, // Report Size (8)
-    0x95, 0x01, // Report Count (1)
-    0x81, 0x02, // Input (Data,Var,Abs)
-    0xC0        // End Collection (Application)
+    0x09, 0x04, // Usage (Touch Screen)
+    0xA1, 0x01, // Collection (Application)
+};
+static const uint8_t descriptor_tail[] = {
+    // Contact Count
+    0x05, 0x0D,         // Usage Page (Digitizer)
+    0x09, 0x54,         // Usage (Contact Count)
+    0x15, 0x00,         // Logical Minimum (0)
+    0x25, MAX_CONTACTS, // Logical Maximum (MAX_CONTACTS)
+    0x75, 0x08,         // Report Size (8)
+    0x95, 0x01,         // Report Count (1)
+    0x81, 0x02,         // Input (Data,Var,Abs)
+    0xC0                // End Collection (Application)
 };
+static uint8_t report_descriptor[sizeof(descriptor_head) + sizeof(finger_descriptor) * REPORT_CONTACTS + sizeof(descriptor_tail)];
+
+void buildDescriptor()
+{
+    uint16_t offset = 0;
+    memcpy(report_descriptor + offset, descriptor_head, sizeof(descriptor_head));
+    offset += sizeof(descriptor_head);
+    for (int i = 0; i < REPORT_CONTACTS; i++)
+    {
+        memcpy(report_descriptor + offset, finger_descriptor, sizeof(finger_descriptor));
+        offset += sizeof(finger_descriptor);
+    }
+    memcpy(report_descriptor + offset, descriptor_tail, sizeof(descriptor_tail));
+}
+
 class CustomHIDDevice : public USBHIDDevice
 {
 public:
@@ -106,7 +163,17 @@ public:
 CustomHIDDevice *Device = nullptr;
 
 #define MAGIC_HEADER 0xF4
+#define MAGIC_FRAME 0xF5
+#define MAGIC_FRAMED 0xF6
+#define TYPE_CONTACTS 0x01
+#define TYPE_COMMAND 0x02
+#define TYPE_CONTACTS_EX 0x03
+#define TYPE_ACK 0x80
+#define TYPE_NAK 0x81
+#define FRAMED_MAX_LEN (2 + 1 + MAX_CONTACTS * CONTACT_EX_SIZE)
+#define FRAMED_TIMEOUT_MS 20
 #define CMD_OTHER 0x03
+#define CMD_HELLO 0xFE
 #define SERIAL_BUFFER_SIZE 11
 
 void initDevice()
@@ -142,30 +209,210 @@ void setup()
     Serial.setRxBufferSize(2048); // Increase serial receive buffer size
     Serial.begin(2000000);
     Serial.println("\n\nINFO: Device initialization");
+    buildDescriptor();
     initDevice(); // Now, initialize the device with the new descriptor
 }
 
 static uint8_t serial_buffer[SERIAL_BUFFER_SIZE];
-void loop()
+static uint8_t frame_buffer[MAX_CONTACTS * CONTACT_SIZE];
+static uint8_t report[REPORT_SIZE];
+
+void readBytes(uint8_t *buffer, size_t len)
+{
+    while (Serial.available() < len)
+    {
+    }
+    Serial.readBytes(buffer, len);
+}
+
+// Contacts are sent REPORT_CONTACTS at a time, unused slots stay zeroed (tip=0).
+// size is CONTACT_SIZE for v1-v3 contacts and CONTACT_EX_SIZE for v4 contacts.
+void sendContacts(const uint8_t *contacts, uint8_t count, uint8_t size)
 {
-   
-    if (Serial.available() > 0 && Serial.read() == MAGIC_HEADER)
+    uint8_t sent = 0;
+    do
     {
-        while (Serial.available() < SERIAL_BUFFER_SIZE)
+        uint8_t n = count - sent > REPORT_CONTACTS ? REPORT_CONTACTS : count - sent;
+        memset(report, 0, REPORT_SIZE);
+        for (uint8_t i = 0; i < n; i++)
         {
+            const uint8_t *contact = contacts + (sent + i) * size;
+            uint8_t *item = report + i * REPORT_CONTACT_SIZE;
+            memcpy(item, contact, CONTACT_SIZE);
+            item[10] = size == CONTACT_EX_SIZE ? contact[10] : 0;
+            item[11] = size == CONTACT_EX_SIZE ? contact[11] : 0;
+            if (item[0] && item[10] == 0)
+            {
+                item[10] = 255; // unspecified pressure
+            }
         }
-        Serial.readBytes(serial_buffer, SERIAL_BUFFER_SIZE);
-        // Serial.printf("BYTES : %d %d %d %d %d %d %d %d %d %d %d\n", serial_buffer[0], serial_buffer[1], serial_buffer[2], serial_buffer[3], serial_buffer[4], serial_buffer[5], serial_buffer[6], serial_buffer[7], serial_buffer[8], serial_buffer[9], serial_buffer[10]);
-        if (serial_buffer[0] == CMD_OTHER)
+        report[REPORT_SIZE - 1] = sent == 0 ? count : 0;
+        if (Device)
         {
-           //pass
+            Device->send(report, REPORT_SIZE);
         }
-        else
+        sent += n;
+    } while (sent < count);
+}
+
+uint16_t crc16(const uint8_t *data, size_t len)
+{
+    uint16_t crc = 0xFFFF;
+    for (size_t i = 0; i < len; i++)
+    {
+        crc ^= (uint16_t)data[i] << 8;
+        for (int j = 0; j < 8; j++)
         {
-            if (Device)
+            crc = (crc & 0x8000) ? (crc << 1) ^ 0x1021 : crc << 1;
+        }
+    }
+    return crc;
+}
+
+void sendFramed(uint8_t type, uint8_t seq)
+{
+    uint8_t packet[6] = {MAGIC_FRAMED, 2, type, seq, 0, 0};
+    uint16_t crc = crc16(packet + 1, 3);
+    packet[4] = crc & 0xFF;
+    packet[5] = crc >> 8;
+    Serial.write(packet, sizeof(packet));
+}
+
+// framed[0] is len, framed_pos < 0 means hunting for a header
+static uint8_t framed[FRAMED_MAX_LEN + 3];
+static int framed_pos = -1;
+static unsigned long framed_start = 0;
+
+void handleFramed()
+{
+    uint8_t len = framed[0];
+    uint8_t type = framed[1];
+    uint8_t seq = framed[2];
+    uint8_t *data = framed + 3;
+    uint8_t data_len = len - 2;
+    if (type == TYPE_CONTACTS || type == TYPE_CONTACTS_EX)
+    {
+        uint8_t size = type == TYPE_CONTACTS ? CONTACT_SIZE : CONTACT_EX_SIZE;
+        if (data_len < 1 || data[0] > MAX_CONTACTS || data_len != 1 + data[0] * size)
+        {
+            sendFramed(TYPE_NAK, seq);
+            return;
+        }
+        sendContacts(data + 1, data[0], size);
+    }
+    // TYPE_COMMAND: resolution changes need no action, coordinates are normalized by the host
+    sendFramed(TYPE_ACK, seq);
+}
+
+// Bytes dropped by a resync are rescanned from this ring buffer before new serial input.
+// Every resync drops at least the header byte, so the rescan always terminates.
+static uint8_t rescan[sizeof(framed)];
+static int rescan_head = 0;
+static int rescan_count = 0;
+
+// Drop the current packet and queue its bytes (after the header) for rescanning.
+void resyncFramed()
+{
+    for (int i = framed_pos - 1; i >= 0; i--)
+    {
+        rescan_head = (rescan_head + sizeof(rescan) - 1) % sizeof(rescan);
+        rescan[rescan_head] = framed[i];
+        rescan_count++;
+    }
+    framed_pos = -1;
+    sendFramed(TYPE_NAK, 0);
+}
+
+void stepFramed(uint8_t b)
+{
+    if (framed_pos < 0)
+    {
+        if (b == MAGIC_FRAMED)
+        {
+            framed_pos = 0;
+            framed_start = millis();
+        }
+        return;
+    }
+    framed[framed_pos++] = b;
+    uint8_t len = framed[0];
+    if (len < 2 || len > FRAMED_MAX_LEN)
+    {
+        resyncFramed();
+        return;
+    }
+    if (framed_pos < len + 3)
+    {
+        return;
+    }
+    uint16_t crc = framed[len + 1] | (framed[len + 2] << 8);
+    if (crc != crc16(framed, len + 1))
+    {
+        resyncFramed();
+        return;
+    }
+    framed_pos = -1;
+    handleFramed();
+}
+
+void drainRescan()
+{
+    while (rescan_count > 0)
+    {
+        uint8_t b = rescan[rescan_head];
+        rescan_head = (rescan_head + 1) % sizeof(rescan);
+        rescan_count--;
+        stepFramed(b);
+    }
+}
+
+void feedFramed(uint8_t b)
+{
+    stepFramed(b);
+    drainRescan();
+}
+
+void loop()
+{
+    if (framed_pos >= 0 && millis() - framed_start > FRAMED_TIMEOUT_MS)
+    {
+        resyncFramed(); // truncated packet
+        drainRescan();
+    }
+    if (Serial.available() <= 0)
+    {
+        return;
+    }
+    uint8_t header = Serial.read();
+    if (framed_pos >= 0 || header == MAGIC_FRAMED)
+    {
+        feedFramed(header);
+    }
+    else if (header == MAGIC_HEADER)
+    {
+        readBytes(serial_buffer, SERIAL_BUFFER_SIZE);
+        if (serial_buffer[0] == CMD_OTHER)
+        {
+            if (serial_buffer[1] == CMD_HELLO)
             {
-                Device->send(serial_buffer, SERIAL_BUFFER_SIZE);
+                Serial.printf("GTHID %d %d\n", FIRMWARE_VERSION, MAX_CONTACTS);
             }
         }
+        else
+        {
+            // v1 single contact report
+            sendContacts(serial_buffer, 1, CONTACT_SIZE);
+        }
+    }
+    else if (header == MAGIC_FRAME)
+    {
+        uint8_t count;
+        readBytes(&count, 1);
+        if (count > MAX_CONTACTS)
+        {
+            return; // resync on next header
+        }
+        readBytes(frame_buffer, count * CONTACT_SIZE);
+        sendContacts(frame_buffer, count, CONTACT_SIZE);
     }
 }
@@ -68,10 +68,15 @@ func handel_touch_using_input_manager(displayID int) touch_control_func {
 	}()
 	x := make([]byte, 4)
 	y := make([]byte, 4)
+	//inputManager.apk按固定10字节读取 仓库中没有其源码无法修改协议 因此该方案不发送压力、接触面积与工具类型
+	logger.Info("inputmanager方案不支持PRESSURE、SIZE与TOOL 将按手指与默认压力发送")
 	return func(control_data touch_control_pack) {
+		if control_data.action == TouchActionResetResolution {
+			return //inputManager直接使用屏幕坐标 不需要分辨率
+		}
 		action := byte(control_data.action)
 		id := byte(control_data.id & 0xff)
-		switch global_device_orientation {
+		switch global_orientation.current() {
 		case 0, 2:
 			binary.LittleEndian.PutUint32(x, uint32(int64(control_data.x)*int64(control_data.screen_y)/0x7ffffffe))
 			binary.LittleEndian.PutUint32(y, uint32(int64(control_data.y)*int64(control_data.screen_x)/0x7ffffffe))
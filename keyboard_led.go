@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/bitly/go-simplejson"
+	"github.com/kenshaw/evdev"
+)
+
+// 键盘指示灯 由读取键盘的dev_reader写入设备 不再控制或设备释放时恢复原来的状态
+// 设备被独占时只有独占的fd能够写入 因此不单独打开设备
+// 配置文件中的LED设置映射模式与按键重映射层启用时点亮的指示灯
+// BLINK为亮灭交替的毫秒数 例如[100,100,100,700]为快速闪烁两次 可用于区分不同的配置文件与层 为空时常亮
+
+var led_names map[string]uint16 = map[string]uint16{
+	"num":    uint16(evdev.LEDNumLock),
+	"caps":   uint16(evdev.LEDCapsLock),
+	"scroll": uint16(evdev.LEDScrollLock),
+}
+
+func parse_led_name(name string) (uint16, error) {
+	if code, ok := led_names[name]; ok {
+		return code, nil
+	}
+	return 0, fmt.Errorf("未知指示灯 %s 可用 num caps scroll", name)
+}
+
+type keyboard_led_control struct {
+	lock        sync.Mutex
+	leds        map[uint16]bool //程序设置的指示灯状态 不在其中的指示灯保持键盘原来的状态
+	subscribers map[chan bool]bool
+}
+
+var global_keyboard_led = &keyboard_led_control{leds: make(map[uint16]bool), subscribers: make(map[chan bool]bool)}
+
+// 返回的channel在指示灯状态变化时收到通知 已有设置时立即通知
+func (self *keyboard_led_control) subscribe() chan bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	ch := make(chan bool, 1)
+	self.subscribers[ch] = true
+	if len(self.leds) > 0 {
+		ch <- true
+	}
+	return ch
+}
+
+func (self *keyboard_led_control) unsubscribe(ch chan bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.subscribers, ch)
+}
+
+func (self *keyboard_led_control) set(code uint16, on bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if value, ok := self.leds[code]; ok && value == on {
+		return
+	}
+	self.leds[code] = on
+	for ch := range self.subscribers {
+		select {
+		case ch <- true:
+		default: //已有未处理的通知 处理时会读取最新状态
+		}
+	}
+}
+
+// 不再控制该指示灯 由各键盘恢复控制前的状态
+func (self *keyboard_led_control) release(code uint16) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if _, ok := self.leds[code]; !ok {
+		return
+	}
+	delete(self.leds, code)
+	for ch := range self.subscribers {
+		select {
+		case ch <- true:
+		default:
+		}
+	}
+}
+
+func (self *keyboard_led_control) state() map[uint16]bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	result := make(map[uint16]bool, len(self.leds))
+	for code, on := range self.leds {
+		result[code] = on
+	}
+	return result
+}
+
+// 读取设备当前的指示灯状态 退出时用于恢复
+func get_keyboard_leds(fd *os.File) map[uint16]bool {
+	var bits [2]byte //LED_MAX为0x0f
+	result := make(map[uint16]bool)
+	if err := ioctl(fd.Fd(), EVIOCGLED(len(bits)), uintptr(unsafe.Pointer(&bits[0]))); err != nil {
+		return result
+	}
+	for i := 0; i < len(bits)*8; i++ {
+		result[uint16(i)] = bits[i/8]&(1<<(i%8)) != 0
+	}
+	return result
+}
+
+func write_keyboard_leds(fd *os.File, leds map[uint16]bool) error {
+	sizeofEvent := int(unsafe.Sizeof(evdev.Event{}))
+	buf := make([]byte, 0, sizeofEvent*(len(leds)+1))
+	for code, on := range leds {
+		event := evdev.Event{Type: evdev.EventLED, Code: code}
+		if on {
+			event.Value = 1
+		}
+		buf = append(buf, (*(*[1<<27 - 1]byte)(unsafe.Pointer(&event)))[:sizeofEvent]...)
+	}
+	syn := evdev.Event{Type: evdev.EventSync, Code: uint16(evdev.SyncReport)}
+	buf = append(buf, (*(*[1<<27 - 1]byte)(unsafe.Pointer(&syn)))[:sizeofEvent]...)
+	_, err := fd.Write(buf)
+	return err
+}
+
+// 单个键盘的指示灯写入 开始控制某个指示灯前记录其状态 释放后恢复
+type keyboard_led_writer struct {
+	fd    *os.File
+	saved map[uint16]bool
+}
+
+func new_keyboard_led_writer(fd *os.File) *keyboard_led_writer {
+	return &keyboard_led_writer{fd: fd, saved: make(map[uint16]bool)}
+}
+
+func (self *keyboard_led_writer) apply(state map[uint16]bool) error {
+	var current map[uint16]bool
+	leds := make(map[uint16]bool, len(state)+len(self.saved))
+	for code, on := range state {
+		if _, ok := self.saved[code]; !ok {
+			if current == nil {
+				current = get_keyboard_leds(self.fd)
+			}
+			self.saved[code] = current[code]
+		}
+		leds[code] = on
+	}
+	for code, on := range self.saved {
+		if _, ok := state[code]; !ok {
+			leds[code] = on
+			delete(self.saved, code)
+		}
+	}
+	if len(leds) == 0 {
+		return nil
+	}
+	return write_keyboard_leds(self.fd, leds)
+}
+
+func (self *keyboard_led_writer) restore() error {
+	return self.apply(map[uint16]bool{})
+}
+
+const led_tick = time.Duration(20) * time.Millisecond
+
+type led_indicator struct {
+	code  uint16
+	blink []time.Duration
+}
+
+// 配置格式 {"LED":"scroll","BLINK":[100,100]} 未设置LED时返回nil
+func parse_led_indicator(config *simplejson.Json) *led_indicator {
+	name := config.Get("LED").MustString("")
+	if name == "" {
+		return nil
+	}
+	code, err := parse_led_name(name)
+	if err != nil {
+		logger.Warnf("LED %v", err)
+		return nil
+	}
+	indicator := &led_indicator{code: code, blink: make([]time.Duration, 0)}
+	for i := range config.Get("BLINK").MustArray() {
+		ms := config.Get("BLINK").GetIndex(i).MustInt()
+		if ms <= 0 {
+			logger.Warnf("LED 闪烁时长%d无效 将常亮", ms)
+			indicator.blink = indicator.blink[:0]
+			break
+		}
+		indicator.blink = append(indicator.blink, time.Duration(ms)*time.Millisecond)
+	}
+	if len(indicator.blink)%2 != 0 {
+		indicator.blink = append(indicator.blink, indicator.blink[len(indicator.blink)-1]) //补齐最后的熄灭时长
+	}
+	return indicator
+}
+
+// 启用后经过elapsed时是否点亮
+func (self *led_indicator) lit(elapsed time.Duration) bool {
+	if len(self.blink) == 0 {
+		return true
+	}
+	var total time.Duration
+	for _, d := range self.blink {
+		total += d
+	}
+	elapsed %= total
+	for i, d := range self.blink {
+		if elapsed < d {
+			return i%2 == 0
+		}
+		elapsed -= d
+	}
+	return false
+}
+
+type led_indicators struct {
+	lock   sync.Mutex
+	map_on *led_indicator            //映射模式
+	layers map[string]*led_indicator //按键重映射层 映射关闭时生效
+	since  map[*led_indicator]time.Time
+	driven map[uint16]bool //正在控制的指示灯 不再使用时恢复原来的状态
+}
+
+func init_led_indicators(config *simplejson.Json) *led_indicators {
+	indicators := &led_indicators{
+		since:  make(map[*led_indicator]time.Time),
+		driven: make(map[uint16]bool),
+	}
+	indicators.load_config(config)
+	return indicators
+}
+
+func (self *led_indicators) load_config(config *simplejson.Json) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	led_config := config.Get("LED")
+	self.map_on = parse_led_indicator(led_config.Get("MAP"))
+	self.layers = make(map[string]*led_indicator)
+	for name := range led_config.Get("LAYERS").MustMap() {
+		if indicator := parse_led_indicator(led_config.Get("LAYERS").Get(name)); indicator != nil {
+			self.layers[name] = indicator
+		}
+	}
+	if self.map_on != nil || len(self.layers) > 0 {
+		logger.Infof("已载入键盘指示灯设置 : 映射模式%v %d个层", self.map_on != nil, len(self.layers))
+	}
+}
+
+// 根据映射状态与启用的层更新指示灯
+func (self *led_indicators) update(map_on bool, layers []string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	active := make([]*led_indicator, 0)
+	if map_on {
+		if self.map_on != nil {
+			active = append(active, self.map_on)
+		}
+	} else {
+		for _, name := range layers {
+			if indicator, ok := self.layers[name]; ok {
+				active = append(active, indicator)
+			}
+		}
+	}
+	since := make(map[*led_indicator]time.Time, len(active))
+	desired := make(map[uint16]bool)
+	now := time.Now()
+	for _, indicator := range active {
+		start, ok := self.since[indicator]
+		if !ok {
+			start = now
+		}
+		since[indicator] = start
+		desired[indicator.code] = desired[indicator.code] || indicator.lit(now.Sub(start))
+	}
+	self.since = since
+	for code := range self.driven {
+		if _, ok := desired[code]; !ok {
+			delete(self.driven, code)
+			global_keyboard_led.release(code)
+		}
+	}
+	for code, on := range desired {
+		self.driven[code] = true
+		global_keyboard_led.set(code, on)
+	}
+}
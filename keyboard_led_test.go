@@ -0,0 +1,91 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/bitly/go-simplejson"
+	"github.com/kenshaw/evdev"
+)
+
+const test_led_keyboard_name = "go-touch-mapper-test-led-keyboard"
+
+// 创建带指示灯的uinput键盘 返回uinput的fd与对应的事件设备
+func create_test_led_keyboard(t *testing.T) (*os.File, *os.File) {
+	u_input, err := os.OpenFile("/dev/uinput", syscall.O_WRONLY|syscall.O_NONBLOCK, 0660)
+	if err != nil {
+		t.Skipf("无法打开/dev/uinput: %v", err)
+	}
+	ioctl(u_input.Fd(), UISETEVBIT(), evSyn)
+	ioctl(u_input.Fd(), UISETEVBIT(), evKey)
+	ioctl(u_input.Fd(), UISETEVBIT(), evLed)
+	ioctl(u_input.Fd(), UISETKEYBIT(), uintptr(evdev.KeyA))
+	for _, code := range led_names {
+		ioctl(u_input.Fd(), UISETLEDBIT(), uintptr(code))
+	}
+	u_input.Write(uInputDevToBytes(UinputUserDev{Name: toUInputName([]byte(test_led_keyboard_name))}))
+	if err := createDevice(u_input); err != nil {
+		u_input.Close()
+		t.Skipf("无法创建uinput设备: %v", err)
+	}
+	for retry := 0; retry < 50; retry++ {
+		paths, _ := filepath.Glob("/dev/input/event*")
+		for _, path := range paths {
+			d, err := evdev.OpenFile(path)
+			if err != nil {
+				continue
+			}
+			name := d.Name()
+			d.Close()
+			if name != test_led_keyboard_name {
+				continue
+			}
+			fd, err := os.OpenFile(path, os.O_RDWR, 0)
+			if err != nil {
+				break
+			}
+			return u_input, fd
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	ioctl(u_input.Fd(), UIDEVDESTROY(), 0)
+	u_input.Close()
+	t.Skip("未找到创建的uinput键盘")
+	return nil, nil
+}
+
+func TestKeyboardLedRestorePreviousState(t *testing.T) {
+	u_input, fd := create_test_led_keyboard(t)
+	defer u_input.Close()
+	defer ioctl(u_input.Fd(), UIDEVDESTROY(), 0)
+	defer fd.Close()
+
+	config, _ := simplejson.NewJson([]byte(`{"LED":{"MAP":{"LED":"caps"}}}`))
+	caps := uint16(evdev.LEDCapsLock)
+	for _, original := range []bool{true, false} {
+		if err := write_keyboard_leds(fd, map[uint16]bool{caps: original}); err != nil {
+			t.Fatal(err)
+		}
+		indicators := init_led_indicators(config)
+		writer := new_keyboard_led_writer(fd)
+
+		indicators.update(true, nil)
+		if err := writer.apply(global_keyboard_led.state()); err != nil {
+			t.Fatal(err)
+		}
+		if !get_keyboard_leds(fd)[caps] {
+			t.Errorf("原状态%v 映射模式时大写锁定指示灯应点亮", original)
+		}
+
+		indicators.update(false, nil)
+		if err := writer.apply(global_keyboard_led.state()); err != nil {
+			t.Fatal(err)
+		}
+		if get_keyboard_leds(fd)[caps] != original {
+			t.Errorf("退出映射模式后大写锁定指示灯应恢复为%v", original)
+		}
+	}
+}
@@ -4,19 +4,23 @@ import (
 	"bufio"
 	"context"
 	"embed"
-	"encoding/binary"
 	"fmt"
 	"io/ioutil"
 	"net"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+	"unsafe"
 
 	"github.com/akamensky/argparse"
 	"github.com/kenshaw/evdev"
@@ -25,6 +29,7 @@ import (
 
 var go_build_version string = ""
 var uinput_keyboard_mouse_dev_name = ""
+var uinput_gamepad_dev_name = ""
 
 type event_pack struct {
 	//表示一个动作 由一系列event组成
@@ -41,6 +46,9 @@ type touch_control_pack struct {
 	y        int32
 	screen_x int32
 	screen_y int32
+	pressure int32 //压力 1-255 0表示未指定
+	size     int32 //接触面积 1-255 0表示未指定
+	tool     int32 //工具类型 与ABS_MT_TOOL_TYPE相同 0为手指
 }
 
 type u_input_control_pack struct {
@@ -51,8 +59,101 @@ type u_input_control_pack struct {
 
 type touch_control_func func(data touch_control_pack)
 
-func dev_reader(event_reader chan *event_pack, index int) {
-	fd, err := os.OpenFile(fmt.Sprintf("/dev/input/event%d", index), os.O_RDONLY, 0)
+// 运行中切换设备独占 发送端切换到本机时释放独占
+type device_grab_control struct {
+	lock        sync.Mutex
+	grab        bool
+	subscribers map[chan bool]bool
+}
+
+// 返回的channel在独占状态变化时收到新状态 以及当前状态
+func (self *device_grab_control) subscribe() (chan bool, bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	ch := make(chan bool, 1)
+	self.subscribers[ch] = true
+	return ch, self.grab
+}
+
+func (self *device_grab_control) unsubscribe(ch chan bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.subscribers, ch)
+}
+
+func (self *device_grab_control) set(grab bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.grab = grab
+	for ch := range self.subscribers {
+		select {
+		case <-ch: //丢弃未处理的旧状态
+		default:
+		}
+		ch <- grab
+	}
+}
+
+// 读取设备时调用 按当前状态独占设备 返回状态变化的channel 不独占的设备返回nil
+func grab_device(d *evdev.Evdev, grab bool) (chan bool, func()) {
+	if !grab {
+		return nil, func() {}
+	}
+	grab_ch, current := global_device_grab.subscribe()
+	if current {
+		d.Lock()
+	}
+	return grab_ch, func() {
+		global_device_grab.unsubscribe(grab_ch)
+		d.Unlock()
+	}
+}
+
+func set_device_grab(d *evdev.Evdev, grab bool) {
+	if grab {
+		d.Lock()
+	} else {
+		d.Unlock()
+	}
+}
+
+// 设备仍按下的按键 规则改变而停止读取时松开 避免按键卡住
+type held_keys map[uint16]bool
+
+func (self held_keys) track(events []*evdev.Event) {
+	for _, event := range events {
+		if event.Type != evdev.EventKey {
+			continue
+		}
+		if event.Value == UP {
+			delete(self, event.Code)
+		} else {
+			self[event.Code] = true
+		}
+	}
+}
+
+func (self held_keys) release(event_reader chan *event_pack, dev_name string, dev_type dev_type) {
+	if len(self) == 0 {
+		return
+	}
+	events := make([]*evdev.Event, 0, len(self))
+	for code := range self {
+		events = append(events, &evdev.Event{Type: evdev.EventKey, Code: code, Value: UP})
+		delete(self, code)
+	}
+	event_reader <- &event_pack{
+		dev_name: dev_name,
+		dev_type: dev_type,
+		events:   events,
+	}
+}
+
+func dev_reader(event_reader chan *event_pack, index int, settings *device_settings, stop chan bool) {
+	fd, err := os.OpenFile(fmt.Sprintf("/dev/input/event%d", index), os.O_RDWR, 0) //需要写入键盘指示灯
+	if err != nil {
+		fd, err = os.OpenFile(fmt.Sprintf("/dev/input/event%d", index), os.O_RDONLY, 0)
+	}
 	if err != nil {
 		logger.Errorf("读取设备失败 : %v", err)
 		return
@@ -63,13 +164,34 @@ func dev_reader(event_reader chan *event_pack, index int) {
 	events := make([]*evdev.Event, 0)
 	dev_name := d.Name()
 	logger.Infof("开始读取设备 : %s", dev_name)
-	d.Lock()
-	defer d.Unlock()
+	grab_ch, release := grab_device(d, settings.grab)
+	defer release()
+	var led_ch chan bool //不是键盘或没有指示灯时为nil
+	led_writer := new_keyboard_led_writer(fd)
+	if settings.dev_type == type_keyboard && len(d.LEDTypes()) > 0 {
+		led_ch = global_keyboard_led.subscribe()
+		defer func() { //恢复修改过的指示灯
+			global_keyboard_led.unsubscribe(led_ch)
+			led_writer.restore()
+		}()
+	}
+	var rel_rest_x, rel_rest_y float64 //倍率缩放后的小数部分累计
+	held := make(held_keys)
 	for {
 		select {
 		case <-global_close_signal:
 			logger.Infof("释放设备 : %s", dev_name)
 			return
+		case <-stop:
+			logger.Infof("设备规则已改变 释放设备 : %s", dev_name)
+			held.release(event_reader, dev_name, settings.dev_type)
+			return
+		case grab := <-grab_ch:
+			set_device_grab(d, grab)
+		case <-led_ch:
+			if err := led_writer.apply(global_keyboard_led.state()); err != nil {
+				logger.Debugf("设置键盘指示灯失败 %s : %v", dev_name, err)
+			}
 		case event := <-event_ch:
 			if event == nil {
 				logger.Warnf("移除设备 : %s", dev_name)
@@ -77,18 +199,45 @@ func dev_reader(event_reader chan *event_pack, index int) {
 			} else if event.Type == evdev.SyncReport {
 				pack := &event_pack{
 					dev_name: dev_name,
-					dev_type: check_dev_type(d),
+					dev_type: settings.dev_type,
 					events:   events,
 				}
+				held.track(events)
 				event_reader <- pack
 				events = make([]*evdev.Event, 0)
 			} else {
+				if settings.mouse_speed != 1 && event.Type == evdev.EventRelative {
+					if event.Code == uint16(evdev.RelativeX) {
+						rel_rest_x += float64(event.Event.Value) * settings.mouse_speed
+						event.Event.Value = int32(rel_rest_x)
+						rel_rest_x -= float64(event.Event.Value)
+					} else if event.Code == uint16(evdev.RelativeY) {
+						rel_rest_y += float64(event.Event.Value) * settings.mouse_speed
+						event.Event.Value = int32(rel_rest_y)
+						rel_rest_y -= float64(event.Event.Value)
+					}
+				}
 				events = append(events, &event.Event)
 			}
 		}
 	}
 }
 
+// 压力与接触面积归一化到1-255 设备未声明范围时为0(未指定)
+func normalize_touch_attr(value int32, axis evdev.Axis) int32 {
+	if axis.Max <= axis.Min {
+		return 0
+	}
+	attr := int32(int64(value-axis.Min) * 255 / int64(axis.Max-axis.Min))
+	if attr < 1 {
+		return 1
+	}
+	if attr > 255 {
+		return 255
+	}
+	return attr
+}
+
 func touch_dev_reader(event_reader chan *event_pack, index int) {
 	fd, err := os.OpenFile(fmt.Sprintf("/dev/input/event%d", index), os.O_RDONLY, 0)
 	if err != nil {
@@ -102,15 +251,19 @@ func touch_dev_reader(event_reader chan *event_pack, index int) {
 	dev_name := d.Name()
 	abs_max_x := d.AbsoluteTypes()[evdev.AbsoluteMTPositionX].Max
 	abs_max_y := d.AbsoluteTypes()[evdev.AbsoluteMTPositionY].Max
+	abs_pressure := d.AbsoluteTypes()[evdev.AbsoluteMTPressure]
+	abs_major := d.AbsoluteTypes()[evdev.AbsoluteMTTouchMajor]
 
 	logger.Infof("开始读取设备 : %s", dev_name)
-	d.Lock()
-	defer d.Unlock()
+	grab_ch, release := grab_device(d, true)
+	defer release()
 	for {
 		select {
 		case <-global_close_signal:
 			logger.Infof("释放设备 : %s", dev_name)
 			return
+		case grab := <-grab_ch:
+			set_device_grab(d, grab)
 		case event := <-event_ch:
 			if event == nil {
 				logger.Warnf("移除设备 : %s", dev_name)
@@ -118,7 +271,7 @@ func touch_dev_reader(event_reader chan *event_pack, index int) {
 			} else if event.Type == evdev.SyncReport {
 				pack := &event_pack{
 					dev_name: dev_name,
-					dev_type: check_dev_type(d),
+					dev_type: type_touch,
 					events:   events,
 				}
 				event_reader <- pack
@@ -130,13 +283,19 @@ func touch_dev_reader(event_reader chan *event_pack, index int) {
 				if event.Event.Code == absMtPositionY {
 					event.Event.Value = int32(int64(event.Event.Value) * 0x7ffffffe / int64(abs_max_y))
 				}
+				if event.Event.Code == absMtPressure {
+					event.Event.Value = normalize_touch_attr(event.Event.Value, abs_pressure)
+				}
+				if event.Event.Code == absMtTouchMajor {
+					event.Event.Value = normalize_touch_attr(event.Event.Value, abs_major)
+				}
 				events = append(events, &event.Event)
 			}
 		}
 	}
 }
 
-func udp_event_injector(ch chan *event_pack, port int) {
+func udp_event_injector(receiver *remote_receiver, port int, pair_query string) {
 	listen, err := net.ListenUDP("udp", &net.UDPAddr{
 		IP:   net.IPv4(0, 0, 0, 0),
 		Port: port,
@@ -147,15 +306,19 @@ func udp_event_injector(ch chan *event_pack, port int) {
 	}
 	defer listen.Close()
 
-	recv_ch := make(chan []byte)
+	type udp_packet struct {
+		data []byte
+		addr *net.UDPAddr
+	}
+	recv_ch := make(chan udp_packet)
 	go func() {
 		for {
 			var buf [1024]byte
-			n, _, err := listen.ReadFromUDP(buf[:])
+			n, addr, err := listen.ReadFromUDP(buf[:])
 			if err != nil {
 				break
 			}
-			recv_ch <- buf[:n]
+			recv_ch <- udp_packet{data: buf[:n], addr: addr}
 		}
 	}()
 	logger.Infof("已准备从以下地址接收远程事件: ")
@@ -181,46 +344,39 @@ func udp_event_injector(ch chan *event_pack, port int) {
 				continue // 跳过非 IPv4 地址
 			}
 			if !ipv4.IsLoopback() {
-				logger.Infof("UDP://%s:%v", ipv4, port)
+				if pair_query != "" {
+					logger.Infof("udp://%s:%v?%s", ipv4, port, pair_query) //可直接作为发送端-s参数 或生成二维码
+				} else {
+					logger.Infof("UDP://%s:%v", ipv4, port)
+				}
 			}
 		}
 	}
+	go receiver.loop_check_timeout()
 	for {
 		select {
 		case <-global_close_signal:
 			return
-		case pack := <-recv_ch: //数据包格式：<event_count:1byte><event1:8byte><event2:8byte>...<eventN:8byte><dev_type:1byte><dev_name:N byte>
-			//每个event格式：<type:2byte><code:2byte><value:4byte>
-			//共8byte
-			// logger.Debugf("%v", pack)
-			event_count := int(pack[0])
-			events := make([]*evdev.Event, 0)
-			for i := 0; i < event_count; i++ {
-				event := &evdev.Event{
-					Type:  evdev.EventType(uint16(binary.LittleEndian.Uint16(pack[8*i+1 : 8*i+3]))),
-					Code:  uint16(binary.LittleEndian.Uint16(pack[8*i+3 : 8*i+5])),
-					Value: int32(binary.LittleEndian.Uint32(pack[8*i+5 : 8*i+9])),
-				}
-				// logger.Debugf("%v", event)
-				events = append(events, event)
-			}
-			e_pack := &event_pack{
-				dev_name: string(pack[event_count*8+2:]),
-				dev_type: dev_type(pack[event_count*8+1]),
-				events:   events,
-			}
-			ch <- e_pack
-			// logger.Debugf("接收到事件 : %v", e_pack)
+		case packet := <-recv_ch:
+			addr := packet.addr
+			receiver.handle(packet.data, func(frame []byte) error {
+				_, err := listen.WriteToUDP(frame, addr)
+				return err
+			})
 		}
 	}
 }
 
 var global_close_signal = make(chan bool)  //仅会在程序退出时关闭  不用于其他用途
 var global_is_wordking_remote bool = false // 是否正在远程控制 并且无法获取触屏状态
-var global_device_orientation int32 = 0
+var global_device_orientation int32 = 0    //在global_orientation.lock下原子写入 通过global_orientation.current()读取
 var global_screen_x int32 = 1000
 var global_screen_y int32 = 1000
 
+var global_device_grab = &device_grab_control{grab: true, subscribers: make(map[chan bool]bool)}
+
+var global_orientation = &device_orientation_control{subscribers: make(map[chan int32]bool)}
+
 func get_device_orientation() int32 {
 	output, err := exec.Command("sh", "-c", "dumpsys input").Output()
 	if err != nil {
@@ -241,24 +397,86 @@ func get_device_orientation() int32 {
 	}
 }
 
+// 只在dumpsys的结果变化时修改方向 快捷键与控制后台手动设置的方向保持到设备实际旋转为止
 func listen_device_orientation() {
+	last := int32(-1)
 	for {
 		select {
 		case <-global_close_signal:
 			return
 		default:
-			var now_orientation int32 = get_device_orientation()
-			if global_device_orientation != now_orientation {
-				global_device_orientation = now_orientation
-				logger.Debugf("设备方向改变\t[%d]", now_orientation)
+			if orientation := get_device_orientation(); orientation != last {
+				last = orientation
+				set_device_orientation(orientation, "dumpsys")
 			}
 			time.Sleep(time.Duration(1) * time.Second)
 		}
 	}
 }
 
+// 屏幕方向的所有来源(dumpsys、vPointer、--rotation、快捷键、控制后台)都通过set_device_orientation修改
+// 更新rotateAbsoluteXY使用的方向并通知订阅者
+type device_orientation_control struct {
+	lock        sync.Mutex
+	subscribers map[chan int32]bool
+}
+
+func (self *device_orientation_control) subscribe() chan int32 {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	ch := make(chan int32, 1)
+	self.subscribers[ch] = true
+	return ch
+}
+
+// 方向由多个协程修改 读取时都使用此方法
+func (self *device_orientation_control) current() int32 {
+	return atomic.LoadInt32(&global_device_orientation)
+}
+
+func (self *device_orientation_control) unsubscribe(ch chan int32) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.subscribers, ch)
+}
+
+func set_device_orientation(orientation int32, source string) bool {
+	if orientation < 0 || orientation > 3 {
+		logger.Warnf("无效的屏幕方向 %d 来源:%s", orientation, source)
+		return false
+	}
+	global_orientation.lock.Lock()
+	defer global_orientation.lock.Unlock()
+	global_orientation.set_locked(orientation, source)
+	return true
+}
+
+// 在当前方向上旋转delta个90度 读取与修改在同一次加锁中完成
+func rotate_device_orientation(delta int32, source string) int32 {
+	global_orientation.lock.Lock()
+	defer global_orientation.lock.Unlock()
+	orientation := ((global_orientation.current()+delta)%4 + 4) % 4
+	global_orientation.set_locked(orientation, source)
+	return orientation
+}
+
+func (self *device_orientation_control) set_locked(orientation int32, source string) {
+	if self.current() == orientation {
+		return
+	}
+	atomic.StoreInt32(&global_device_orientation, orientation)
+	logger.Debugf("设备方向改变\t[%d]\t来源:%s", orientation, source)
+	for ch := range self.subscribers {
+		select {
+		case <-ch: //丢弃未处理的旧方向
+		default:
+		}
+		ch <- orientation
+	}
+}
+
 func rotateAbsoluteXY(x, y int32) (int32, int32) { //根据方向旋转坐标
-	switch global_device_orientation {
+	switch global_orientation.current() {
 	case 0:
 		return x, y
 	case 1:
@@ -280,9 +498,25 @@ const (
 	type_joystick = dev_type(2)
 	type_touch    = dev_type(3)
 	type_unknown  = dev_type(4)
+	type_touchpad = dev_type(5) //读取时转换为鼠标事件
+	type_tablet   = dev_type(6) //数位板 绝对坐标直接映射到屏幕
 )
 
-func check_dev_type(dev *evdev.Evdev) dev_type {
+func get_input_props(fd *os.File) map[int]bool { //evdev库未实现Properties 使用EVIOCGPROP读取
+	var bits [inputPropMax]byte //与EVIOCGPROP中的长度一致
+	result := make(map[int]bool)
+	if err := ioctl(fd.Fd(), EVIOCGPROP(), uintptr(unsafe.Pointer(&bits[0]))); err != nil {
+		return result
+	}
+	for i := 0; i < inputPropCnt; i++ {
+		if bits[i/8]&(1<<(i%8)) != 0 {
+			result[i] = true
+		}
+	}
+	return result
+}
+
+func check_dev_type(dev *evdev.Evdev, props map[int]bool) dev_type {
 	abs := dev.AbsoluteTypes()
 	key := dev.KeyTypes()
 	rel := dev.RelativeTypes()
@@ -290,9 +524,23 @@ func check_dev_type(dev *evdev.Evdev) dev_type {
 	_, MTPositionY := abs[evdev.AbsoluteMTPositionY]
 	_, MTSlot := abs[evdev.AbsoluteMTSlot]
 	_, MTTrackingID := abs[evdev.AbsoluteMTTrackingID]
+	_, AbsX := abs[evdev.AbsoluteX]
+	_, AbsY := abs[evdev.AbsoluteY]
+	_, ToolPen := key[evdev.BtnToolPen]
+	_, ToolFinger := key[evdev.BtnToolFinger]
+	_, Touch := key[evdev.BtnTouch]
+	if ToolPen && AbsX && AbsY && !MTSlot && !props[inputPropDirect] {
+		return type_tablet //数位板 有笔且不是屏幕
+	}
 	if MTPositionX && MTPositionY && MTSlot && MTTrackingID {
+		if props[inputPropPointer] && !props[inputPropDirect] {
+			return type_touchpad
+		}
 		return type_touch //触屏检测这几个abs类型即可
 	}
+	if AbsX && AbsY && ToolFinger && Touch && !props[inputPropDirect] {
+		return type_touchpad //单点触控板
+	}
 	_, RelX := rel[evdev.RelativeX]
 	_, RelY := rel[evdev.RelativeY]
 	_, Wheel := rel[evdev.RelativeWheel]
@@ -341,15 +589,14 @@ func get_possible_device_indexes(skipList map[int]bool) map[int]dev_type {
 		if exist && reading {
 			continue
 		} else {
-			fd, err := os.OpenFile(fmt.Sprintf("/dev/input/%s", file.Name()), os.O_RDONLY, 0)
+			info, err := read_device_info(index)
 			if err != nil {
 				logger.Errorf("读取设备/dev/input/%s失败 : %v ", file.Name(), err)
+				continue
 			}
-			d := evdev.Open(fd)
-			defer d.Close()
-			devType := check_dev_type(d)
-			if devType != type_unknown {
-				result[index] = devType
+			settings := get_device_rules().apply(info, nil)
+			if settings.include {
+				result[index] = settings.dev_type
 			}
 		}
 	}
@@ -476,43 +723,160 @@ func OpenSerialWritePipe(portName string, baudRate int) (serial.Port, error) {
 	return port, nil
 }
 
+func probe_device(index int) (*device_info, error) { //设备刚插入时权限可能尚未设置 多次尝试打开
+	var err error
+	for i := 0; i < 10; i++ {
+		var info *device_info
+		info, err = read_device_info(index)
+		if err == nil {
+			return info, nil
+		}
+		time.Sleep(time.Duration(100) * time.Millisecond)
+	}
+	return nil, err
+}
+
+type device_reader struct {
+	info     *device_info     //读取设备信息前为nil
+	settings *device_settings //按规则得到的设置 规则改变时与新设置比较
+	stop     chan bool
+	restart  bool //因规则改变而停止 退出后立即重新读取
+}
+
 func auto_detect_and_read(event_chan chan *event_pack, patern string) {
-	//自动检测设备并读取 循环检测 自动管理设备插入移除
-	devices := make(map[int]bool)
+	//自动检测设备并读取 监听设备插入移除
+	re := regexp.MustCompile(patern)
+	devTypeFriendlyName := map[dev_type]string{
+		type_mouse:    "鼠标",
+		type_keyboard: "键盘",
+		type_joystick: "手柄",
+		type_touch:    "触屏",
+		type_unknown:  "未知",
+		type_touchpad: "触控板",
+		type_tablet:   "数位板",
+	}
+	var readers_lock sync.Mutex
+	readers := make(map[int]*device_reader) //正在读取的设备
+	retries := make(map[int]int)            //连续读取失败的次数 设备移除后清除
+	//按退避间隔重新发送设备 limit为0时不限次数 需持有readers_lock
+	retry := func(index int, limit int) {
+		retries[index]++
+		if limit > 0 && retries[index] > limit {
+			logger.Warnf("/dev/input/event%d 连续%d次读取失败 不再重试", index, limit)
+			return
+		}
+		delay := device_retry_delay
+		for i := 1; i < retries[index] && delay < device_retry_max_delay; i++ {
+			delay *= 2
+		}
+		if delay > device_retry_max_delay {
+			delay = device_retry_max_delay
+		}
+		go func() {
+			select {
+			case <-global_close_signal:
+			case <-time.After(delay):
+				get_device_watcher().reoffer(index)
+			}
+		}()
+	}
+	device_events := get_device_watcher().subscribe()
 	for {
 		select {
 		case <-global_close_signal:
 			return
-		default:
-			auto_detect_result := get_possible_device_indexes(devices)
-			devTypeFriendlyName := map[dev_type]string{
-				type_mouse:    "鼠标",
-				type_keyboard: "键盘",
-				type_joystick: "手柄",
-				type_touch:    "触屏",
-				type_unknown:  "未知",
-			}
-			for index, devType := range auto_detect_result {
-				devName := get_dev_name_by_index(index)
-				if devName == uinput_keyboard_mouse_dev_name {
-					continue //跳过生成的虚拟设备
-				}
-				re := regexp.MustCompile(patern)
-				if !re.MatchString(devName) {
-					// logger.Debugf("设备名称 %s 不匹配 %s", devName, patern)
+		case <-global_device_rules_changed:
+			//设置改变的设备停止读取后重新读取 其余设备重新发送 之前被规则排除的设备按新规则匹配
+			rules := get_device_rules()
+			readers_lock.Lock()
+			for index, reader := range readers {
+				if reader.info == nil || reader.restart {
 					continue
 				}
-				if devType == type_mouse || devType == type_keyboard || devType == type_joystick {
-					logger.Infof("检测到设备 %s(/dev/input/event%d) : %s", devName, index, devTypeFriendlyName[devType])
-					localIndex := index
-					go func() {
-						devices[localIndex] = true
-						dev_reader(event_chan, localIndex)
-						devices[localIndex] = false
-					}()
+				if settings := rules.apply(reader.info, re); *settings != *reader.settings {
+					logger.Infof("设备规则已改变 重新读取 %s(/dev/input/event%d)", reader.info.name, index)
+					reader.restart = true
+					close(reader.stop)
 				}
 			}
-			time.Sleep(time.Duration(400) * time.Millisecond)
+			readers_lock.Unlock()
+			go get_device_watcher().reoffer_all()
+		case device_event := <-device_events:
+			if device_event.kind == DeviceRemoved {
+				logger.Debugf("设备文件已移除 %s", device_event.path)
+				readers_lock.Lock()
+				delete(retries, device_event.index)
+				readers_lock.Unlock()
+				continue
+			}
+			readers_lock.Lock()
+			if readers[device_event.index] != nil {
+				readers_lock.Unlock()
+				continue
+			}
+			reader := &device_reader{stop: make(chan bool)}
+			readers[device_event.index] = reader
+			readers_lock.Unlock()
+			go func(index int) {
+				var started time.Time //读取协程开始的时间 未开始读取时为零
+				defer func() {
+					readers_lock.Lock()
+					defer readers_lock.Unlock()
+					delete(readers, index)
+					if reader.restart {
+						go get_device_watcher().reoffer(index)
+						return
+					}
+					if started.IsZero() {
+						return
+					}
+					select {
+					case <-global_close_signal:
+						return
+					default:
+					}
+					if _, err := os.Stat(fmt.Sprintf("/dev/input/event%d", index)); err != nil {
+						return //设备已移除
+					}
+					if time.Since(started) > device_retry_max_delay { //读取了一段时间后退出 重新计算退避
+						retries[index] = 0
+					}
+					logger.Warnf("/dev/input/event%d 读取已停止 稍后重新读取", index)
+					retry(index, 0)
+				}()
+				info, err := probe_device(index)
+				if err != nil {
+					logger.Errorf("读取设备/dev/input/event%d失败 : %v ", index, err)
+					readers_lock.Lock()
+					retry(index, device_probe_retry)
+					readers_lock.Unlock()
+					return
+				}
+				if info.name == uinput_keyboard_mouse_dev_name || info.name == uinput_gamepad_dev_name {
+					return //跳过生成的虚拟设备
+				}
+				readers_lock.Lock() //与规则改变的处理互斥 保证使用的是最新的规则
+				settings := get_device_rules().apply(info, re)
+				reader.info, reader.settings = info, settings
+				readers_lock.Unlock()
+				if !settings.include {
+					return
+				}
+				devType := settings.dev_type
+				if devType == type_mouse || devType == type_keyboard || devType == type_joystick || devType == type_touchpad || devType == type_tablet {
+					started = time.Now()
+				}
+				if devType == type_mouse || devType == type_keyboard || devType == type_joystick {
+					logger.Infof("检测到设备 %s(/dev/input/event%d) : %s", info.name, index, devTypeFriendlyName[devType])
+					dev_reader(event_chan, index, settings, reader.stop)
+				} else if devType == type_touchpad {
+					logger.Infof("检测到设备 %s(/dev/input/event%d) : %s", info.name, index, devTypeFriendlyName[devType])
+					touchpad_dev_reader(event_chan, index, settings, reader.stop)
+				} else if devType == type_tablet {
+					logger.Infof("检测到设备 %s(/dev/input/event%d) : %s", info.name, index, devTypeFriendlyName[devType])
+					tablet_dev_reader(event_chan, index, settings, reader.stop)
+				}
+			}(device_event.index)
 		}
 	}
 }
@@ -559,6 +923,175 @@ func parseSenderAddress(s string, defaultPort int) (string, int, error) {
 	return "", 0, fmt.Errorf("invalid address format: expected 'IP' or 'IP:PORT', got %s", s)
 }
 
+type remote_target struct {
+	scheme  string //udp tcp ws
+	path    string //ws路径
+	ip      string
+	port    int
+	psk     string
+	encrypt bool
+}
+
+// 支持 IP[:PORT] 或 scheme://IP[:PORT]?psk=密钥&encrypt=1 scheme可用udp tcp ws
+// ws默认使用控制后台端口(远程事件端口+1)
+func parse_remote_target(s string, defaultPort int) (*remote_target, error) {
+	if !strings.Contains(s, "://") {
+		ip, port, err := parseSenderAddress(s, defaultPort)
+		if err != nil {
+			return nil, err
+		}
+		return &remote_target{scheme: "udp", ip: ip, port: port}, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	path := ""
+	switch u.Scheme {
+	case "udp", "tcp":
+	case "ws":
+		defaultPort += 1
+		path = u.Path
+		if path == "" {
+			path = remote_ws_path
+		}
+	default:
+		return nil, fmt.Errorf("unsupported scheme %s", u.Scheme)
+	}
+	ip, port, err := parseSenderAddress(u.Host, defaultPort)
+	if err != nil {
+		return nil, err
+	}
+	encrypt := u.Query().Get("encrypt")
+	return &remote_target{
+		scheme:  u.Scheme,
+		path:    path,
+		ip:      ip,
+		port:    port,
+		psk:     u.Query().Get("psk"),
+		encrypt: encrypt == "1" || encrypt == "true",
+	}, nil
+}
+
+// 接收端的密钥 new则随机生成 返回密钥 以及用于打印配对地址的参数
+func setup_receiver_psk(psk string, encrypt bool) (string, *remote_cipher, string) {
+	if psk == "new" {
+		psk = generate_remote_psk()
+		logger.Infof("已生成配对密钥 : %s", psk)
+	}
+	if psk == "" {
+		if encrypt {
+			logger.Error("--encrypt 需要同时使用 --psk 指定密钥")
+			os.Exit(1)
+		}
+		return "", nil, ""
+	}
+	cipher, err := new_remote_cipher(psk, encrypt)
+	if err != nil {
+		logger.Errorf("密钥无效 : %v", err)
+		os.Exit(1)
+	}
+	return psk, cipher, build_remote_query(psk, encrypt)
+}
+
+func build_remote_query(psk string, encrypt bool) string {
+	query := url.Values{}
+	query.Set("psk", psk)
+	if encrypt {
+		query.Set("encrypt", "1")
+	}
+	return query.Encode()
+}
+
+// --touch-device指定设备路径(可以是/dev/input/by-path等链接)或名称正则 未指定时使用编号最小的触屏
+// 名称匹配多个设备时优先选择识别为触屏的设备
+func find_touch_index(selector string) (int, bool) {
+	if selector == "" {
+		indexes := make([]int, 0)
+		for index, devType := range get_possible_device_indexes(make(map[int]bool)) {
+			if devType == type_touch {
+				indexes = append(indexes, index)
+			}
+		}
+		if len(indexes) == 0 {
+			return 0, false
+		}
+		sort.Ints(indexes)
+		return indexes[0], true
+	}
+	if strings.HasPrefix(selector, "/") {
+		path, err := filepath.EvalSymlinks(selector)
+		if err != nil {
+			logger.Errorf("无法解析触屏路径%s : %v", selector, err)
+			return 0, false
+		}
+		index, err := strconv.Atoi(strings.TrimPrefix(path, "/dev/input/event"))
+		if err != nil || !strings.HasPrefix(path, "/dev/input/event") {
+			logger.Errorf("%s 不是/dev/input/eventX设备", selector)
+			return 0, false
+		}
+		return index, true
+	}
+	re, err := regexp.Compile(selector)
+	if err != nil {
+		logger.Errorf("无效的触屏名称正则 %s : %v", selector, err)
+		return 0, false
+	}
+	files, _ := ioutil.ReadDir("/dev/input")
+	found, found_touch := -1, -1
+	for _, file := range files {
+		if !strings.HasPrefix(file.Name(), "event") {
+			continue
+		}
+		index, err := strconv.Atoi(file.Name()[5:])
+		if err != nil {
+			continue
+		}
+		info, err := read_device_info(index)
+		if err != nil || !re.MatchString(info.name) {
+			continue
+		}
+		if info.dev_type == type_touch && (found_touch == -1 || index < found_touch) {
+			found_touch = index
+		}
+		if found == -1 || index < found {
+			found = index
+		}
+	}
+	if found_touch != -1 {
+		return found_touch, true
+	}
+	if found != -1 {
+		logger.Warnf("%s(/dev/input/event%d) 未被识别为触屏", get_dev_name_by_index(found), found)
+		return found, true
+	}
+	logger.Errorf("没有名称匹配%s的设备", selector)
+	return 0, false
+}
+
+func get_direct_touch_index(selector string) int {
+	index, ok := find_touch_index(selector)
+	if !ok {
+		logger.Error("没有找到可以直接写入的真实触屏 可使用--touch-device指定")
+		os.Exit(3)
+	}
+	logger.Infof("将会直接写入触屏 %s(/dev/input/event%d)", get_dev_name_by_index(index), index)
+	return index
+}
+
+// --clone-touch时返回要复制的真实触屏 否则返回-1
+func get_clone_touch_index(clone bool, selector string) int {
+	if !clone {
+		return -1
+	}
+	index, ok := find_touch_index(selector)
+	if !ok {
+		logger.Warn("没有找到真实触屏 无法复制")
+		return -1
+	}
+	return index
+}
+
 func fileExists(filename string) bool {
 	_, err := os.Stat(filename)
 	return !os.IsNotExist(err)
@@ -588,16 +1121,22 @@ func main() {
 		Help:     "用于筛选设备名称的正则",
 	})
 
+	var devicesPath *string = parser.String("", "devices", &argparse.Options{
+		Required: false,
+		Default:  "",
+		Help:     "设备规则文件路径,按名称、phys、uniq、vendor/product或路径匹配设备并设置类型、是否独占与鼠标倍率,未指定时使用配置文件中的DEVICES",
+	})
+
 	var as_remote_control *string = parser.String("s", "sender", &argparse.Options{
 		Required: false,
 		Default:  "",
-		Help:     "发送本地事件到远程，输入 IP:PORT 例如 192.168.3.7:61069 或者仅输入IP使用默认端口61069",
+		Help:     "发送本地事件到远程，输入 IP:PORT 例如 192.168.3.7:61069 或者仅输入IP使用默认端口61069，也可使用 udp:// tcp:// ws:// 地址选择传输方式，IP为auto时自动搜索局域网内的接收端，输入list列出接收端，多个目标以逗号分隔并使用--switch-keys切换，目标local表示控制本机",
 	})
 
 	var control_mode *string = parser.String("m", "mode", &argparse.Options{
 		Required: false,
 		Default:  "uinput",
-		Help:     "触摸方案，可用控制模式:    \tuinput:\t\t使用uinput创建虚拟触屏  \tinputmanager:\t通过UDS控制安卓inputManager \thid:\t\t通过串口控制单片机模拟usb触屏  \totg:\t\t本机配置LinuxUSBgadget模拟usb触屏,设备文件为/dev/hidg0 \tdirect:\t\t直接写入设备真实触屏,需要root权限或者低版本安卓",
+		Help:     "触摸方案，可用控制模式:    \tuinput:\t\t使用uinput创建虚拟触屏  \tinputmanager:\t通过UDS控制安卓inputManager \thid:\t\t通过串口控制单片机模拟usb触屏  \totg:\t\t本机配置LinuxUSBgadget模拟usb触屏与键鼠,设备文件为/dev/hidg0-2 \tdirect:\t\t直接写入设备真实触屏,需要root权限或者低版本安卓 \tnet:\t\t将触屏控制发送到运行--touch-receiver的设备,需使用--net-target指定地址 \tscrcpy:\t\t通过scrcpy-server的控制协议注入触屏,可使用--scrcpy-target连接已运行的scrcpy-server \trecord:\t\t将触屏控制记录到文件,例如record:/sdcard/touch.log \t多个方案以+连接同时输出,例如uinput+record:/sdcard/touch.log,方案后可用:指定参数,也可使用outputs:文件路径从文件读取",
 	})
 
 	var mixTouchDisabled *bool = parser.Flag("t", "disable-mix", &argparse.Options{
@@ -612,6 +1151,24 @@ func main() {
 		Default:  false,
 	})
 
+	var usingVirtualGamepad *bool = parser.Flag("g", "gamepad", &argparse.Options{
+		Required: false,
+		Default:  false,
+		Help:     "创建uinput虚拟手柄,映射关闭时手柄与配置文件GAMEPAD中设置的键鼠输入将输出到虚拟手柄,仅在uinput、inputmanager与direct模式生效",
+	})
+
+	var cloneTouchScreen *bool = parser.Flag("", "clone-touch", &argparse.Options{
+		Required: false,
+		Default:  false,
+		Help:     "复制真实触屏的名称、坐标范围、分辨率与属性创建虚拟触屏,仅在uinput模式生效",
+	})
+
+	var touchDevice *string = parser.String("", "touch-device", &argparse.Options{
+		Required: false,
+		Default:  "",
+		Help:     "指定真实触屏,可以是设备路径或名称正则,用于direct模式与--clone-touch,未指定时使用第一个识别为触屏的设备",
+	})
+
 	var usingInputManagerDisplayID *int = parser.Int("", "display-id", &argparse.Options{
 		Required: false,
 		Default:  0,
@@ -621,7 +1178,7 @@ func main() {
 	var usingHIDTouchTtyPath *string = parser.String("", "tty-path", &argparse.Options{
 		Required: false,
 		Default:  "",
-		Help:     "串口设备路径,hid模式下必须指定",
+		Help:     "串口设备路径,hid模式下必须指定,auto为自动查找刷入hid_touch固件的ESP32-S3(只查询乐鑫VID的串口),auto-all向所有USB串口发送查询",
 	})
 
 	var usingDeviceRotation *int = parser.Int("", "rotation", &argparse.Options{
@@ -633,7 +1190,79 @@ func main() {
 	var using_remote_control *bool = parser.Flag("r", "remote-control", &argparse.Options{
 		Required: false,
 		Default:  false,
-		Help:     "是否从UDP接收远程事件",
+		Help:     "是否接收远程事件,同时监听UDP与TCP端口以及控制后台的WebSocket",
+	})
+
+	var remote_led_mirror *string = parser.String("", "led-mirror", &argparse.Options{
+		Required: false,
+		Default:  "",
+		Help:     "发送端使用键盘指示灯显示当前目标是否处于映射模式,可用num caps scroll",
+	})
+
+	var remote_accept_v1 *bool = parser.Flag("", "accept-v1", &argparse.Options{
+		Required: false,
+		Default:  false,
+		Help:     "接收远程事件时同时接受没有包头与序号的v1协议数据包(旧版remote_control.py)",
+	})
+
+	var remote_psk *string = parser.String("", "psk", &argparse.Options{
+		Required: false,
+		Default:  "",
+		Help:     "远程事件预共享密钥,发送端与接收端需一致,设置后接收端拒绝未认证的数据包,接收端输入new则随机生成并打印配对地址",
+	})
+
+	var remote_encrypt *bool = parser.Flag("", "encrypt", &argparse.Options{
+		Required: false,
+		Default:  false,
+		Help:     "使用预共享密钥加密远程事件(AES-GCM),未设置时仅认证(HMAC)",
+	})
+
+	var ws_origin *string = parser.String("", "ws-origin", &argparse.Options{
+		Required: false,
+		Default:  "",
+		Help:     "除同源页面外允许连接WebSocket的网页来源,多个以逗号分隔,例如http://192.168.1.2:3000,默认拒绝所有跨站连接",
+	})
+
+	var net_touch_target *string = parser.String("", "net-target", &argparse.Options{
+		Required: false,
+		Default:  "",
+		Help:     "net模式下触屏接收端地址,格式与-s相同,未指定传输方式时使用tcp,默认端口61069",
+	})
+
+	var scrcpy_target *string = parser.String("", "scrcpy-target", &argparse.Options{
+		Required: false,
+		Default:  "",
+		Help:     "scrcpy模式下已运行的scrcpy-server控制地址,可用IP[:PORT](默认端口27183)或@名称/localabstract:名称,未指定时在本机启动scrcpy-server",
+	})
+
+	var scrcpy_server *string = parser.String("", "scrcpy-server", &argparse.Options{
+		Required: false,
+		Default:  scrcpy_default_server,
+		Help:     "scrcpy模式下在本机启动的scrcpy-server文件路径",
+	})
+
+	var scrcpy_version *string = parser.String("", "scrcpy-version", &argparse.Options{
+		Required: false,
+		Default:  "2.4",
+		Help:     "scrcpy-server的版本,需与文件一致,低于2.4时使用旧的触屏消息格式",
+	})
+
+	var using_touch_receiver *bool = parser.Flag("", "touch-receiver", &argparse.Options{
+		Required: false,
+		Default:  false,
+		Help:     "只接收其他设备net模式发送的触屏控制,使用-m指定的uinput、inputmanager或direct执行,不加载配置文件",
+	})
+
+	var remote_switch_keys *string = parser.String("", "switch-keys", &argparse.Options{
+		Required: false,
+		Default:  "KEY_LEFTCTRL+KEY_LEFTALT+KEY_TAB",
+		Help:     "发送端指定多个目标时切换目标的组合键,以+连接按键名称",
+	})
+
+	var remote_send_rate *int = parser.Int("", "send-rate", &argparse.Options{
+		Required: false,
+		Default:  0,
+		Help:     "发送端每秒最多发送的鼠标移动包数量,期间的相对移动会合并发送,按键不合并,0为不限制,高回报率鼠标建议设置为1000",
 	})
 
 	var port *int = parser.Int("p", "port", &argparse.Options{
@@ -682,6 +1311,7 @@ func main() {
 		go_build_version = "DEV"
 	}
 	uinput_keyboard_mouse_dev_name = fmt.Sprintf("EVO80_Keyboard_%s", go_build_version)
+	uinput_gamepad_dev_name = fmt.Sprintf("X360_Gamepad_%s", go_build_version)
 	logger.Infof("当前构建版本: %v", go_build_version)
 
 	if *debug_mode {
@@ -689,6 +1319,22 @@ func main() {
 		logger.Debug("debug on")
 	}
 
+	for _, origin := range strings.Split(*ws_origin, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			websocket_allowed_origins[origin] = true
+		}
+	}
+
+	if *devicesPath != "" {
+		rules, err := load_device_rules_file(*devicesPath)
+		if err != nil {
+			logger.Errorf("读取设备规则文件失败: %v", err)
+			os.Exit(1)
+		}
+		set_device_rules(rules)
+		global_device_rules_from_config = false
+	}
+
 	if *create_js_info {
 		//=================================================================================================================================
 		// 创建手柄配置文件部分
@@ -699,6 +1345,8 @@ func main() {
 			type_joystick: "手柄",
 			type_touch:    "触屏",
 			type_unknown:  "未知",
+			type_touchpad: "触控板",
+			type_tablet:   "数位板",
 		}
 		for index, devType := range auto_detect_result {
 			devName := get_dev_name_by_index(index)
@@ -724,84 +1372,150 @@ func main() {
 	} else if *as_remote_control != "" {
 		//=================================================================================================================================
 		// 远程事件发送器部分
-		ip, port, err := parseSenderAddress(*as_remote_control, 61069)
-		if err != nil {
-			logger.Errorf("解析发送地址失败: %v", err)
+		if *as_remote_control == "list" {
+			receivers, err := discover_remote_receivers(remote_discovery_timeout)
+			if err != nil {
+				logger.Errorf("搜索接收端失败: %v", err)
+			} else if len(receivers) == 0 {
+				logger.Warn("未发现接收端")
+			}
+			print_remote_receivers(receivers)
 			return
 		}
-		logger.Infof("启动远程事件发送器 目标地址 %s:%d", ip, port)
-		events_ch := make(chan *event_pack) //主要设备事件管道
-		go auto_detect_and_read(events_ch, *patern)
-		conn, err := net.DialUDP("udp", nil, &net.UDPAddr{
-			IP:   net.ParseIP(ip),
-			Port: port,
-		})
+		if *devicesPath == "" && *configPath != "" { //发送端只使用配置文件中的DEVICES
+			rules, err := load_device_rules_file(*configPath)
+			if err != nil {
+				logger.Errorf("读取配置文件中的设备规则失败: %v", err)
+				return
+			}
+			set_device_rules(rules)
+		}
+		switch_keys, err := parse_switch_keys(*remote_switch_keys)
 		if err != nil {
-			fmt.Println("Dial UDP failed, err:", err)
+			logger.Errorf("解析切换组合键失败: %v", err)
 			return
 		}
-		defer conn.Close()
-
-		pack_count := 0
-		pack_size := 0
-		go (func() {
-			ticker := time.NewTicker(time.Second * 1)
-			for {
-				select {
-				case <-global_close_signal:
-					return
-				case <-ticker.C:
-					logger.Debugf("发送频率: %d Pack/s 发送数据量: %d B/s\r", pack_count, pack_size)
-					pack_count = 0
-					pack_size = 0
-				}
+		clients := make([]*remote_client, 0)
+		for _, address := range strings.Split(*as_remote_control, ",") {
+			client, err := new_remote_client(strings.TrimSpace(address), *remote_psk, *remote_encrypt)
+			if err != nil {
+				logger.Errorf("解析发送地址失败: %v", err)
+				return
 			}
-		})()
-
-		data := make([]byte, 4096)
-		for {
-			select {
-			case <-global_close_signal:
+			clients = append(clients, client)
+		}
+		names := make([]string, 0, len(clients))
+		for _, client := range clients {
+			names = append(names, client.name)
+		}
+		logger.Infof("启动远程事件发送器 目标地址 %s", strings.Join(names, " , "))
+		if len(clients) > 1 {
+			logger.Infof("按下 %s 切换目标", *remote_switch_keys)
+		}
+		if *remote_send_rate < 0 {
+			logger.Error("--send-rate不能小于0")
+			return
+		}
+		mirror_led := -1
+		if *remote_led_mirror != "" {
+			code, err := parse_led_name(*remote_led_mirror)
+			if err != nil {
+				logger.Errorf("%v", err)
 				return
-			case pack := <-events_ch:
-				event_count := len(pack.events)
-				data[0] = byte(event_count)
-				for i, event := range pack.events {
-					offset := 1 + i*8
-					binary.LittleEndian.PutUint16(data[offset:offset+2], uint16(event.Type))
-					binary.LittleEndian.PutUint16(data[offset+2:offset+4], event.Code)
-					binary.LittleEndian.PutUint32(data[offset+4:offset+8], uint32(event.Value))
-				}
-				name_offset := 1 + event_count*8
-				data[name_offset] = byte(pack.dev_type)
-				if pack.dev_type == type_keyboard || pack.dev_type == type_mouse {
-					pack.dev_name = "rkm"
-				}
-				copy(data[name_offset+1:], []byte(pack.dev_name))
-				data_length := name_offset + 1 + len(pack.dev_name)
-				_, err = conn.Write(data[:data_length])
-				pack_count++
-				pack_size += data_length
-				if err != nil {
-					fmt.Println("Send data failed, err:", err)
-					return
-				}
 			}
+			mirror_led = int(code)
 		}
+		events_ch := make(chan *event_pack) //主要设备事件管道
+		go auto_detect_and_read(events_ch, *patern)
+		run_remote_sender(clients, switch_keys, *remote_send_rate, mirror_led, events_ch)
+		//=================================================================================================================================
+	} else if *using_touch_receiver {
+		//=================================================================================================================================
+		// 触屏接收端部分 执行其他设备net模式发送的触屏控制
+		var touch_control_func touch_control_func
+		switch *control_mode {
+		case "uinput":
+			touch_control_func = handel_touch_using_uinput_touch(get_clone_touch_index(*cloneTouchScreen, *touchDevice))
+		case "inputmanager":
+			touch_control_func = handel_touch_using_input_manager(*usingInputManagerDisplayID)
+		case "direct":
+			touch_control_func = handel_touch_using_direct_touch(get_direct_touch_index(*touchDevice))
+		case "scrcpy":
+			client, err := new_scrcpy_client(*scrcpy_target, *scrcpy_server, *scrcpy_version)
+			if err != nil {
+				logger.Errorf("scrcpy参数错误: %v", err)
+				os.Exit(1)
+			}
+			touch_control_func = handel_touch_using_scrcpy(client)
+		default:
+			logger.Errorf("触屏接收端不支持%s模式,可用模式:uinput,inputmanager,direct,scrcpy", *control_mode)
+			os.Exit(1)
+		}
+		go listen_device_orientation()
+		_, cipher, pair_query := setup_receiver_psk(*remote_psk, *remote_encrypt)
+		receiver := new_remote_receiver(nil, false, cipher)
+		receiver.touch = touch_control_func
+		logger.Infof("启动触屏接收端 触屏方案 %s", *control_mode)
+		go udp_event_injector(receiver, *port, pair_query)
+		go tcp_event_injector(receiver, *port)
+		go remote_discovery_responder(*port, cipher != nil, *remote_encrypt)
+		go serve_remote_websocket(receiver, *port+1)
+		exitChan := make(chan os.Signal, 1)
+		signal.Notify(exitChan, os.Interrupt, syscall.SIGTERM)
+		<-exitChan
+		close(global_close_signal)
+		logger.Info("已停止")
+		time.Sleep(time.Millisecond * 40)
 		//=================================================================================================================================
 	} else {
+		touch_outputs, err := parse_touch_outputs(*control_mode)
+		if err != nil {
+			logger.Errorf("解析触屏输出失败: %v", err)
+			os.Exit(1)
+		}
+		primary_output := touch_outputs[0]
+		*control_mode = primary_output.mode
+		if primary_output.arg != "" { //主输出的参数覆盖对应的命令行参数
+			switch primary_output.mode {
+			case "uinput":
+				*cloneTouchScreen = *cloneTouchScreen || primary_output.arg == "clone"
+			case "inputmanager":
+				if _, err := fmt.Sscanf(primary_output.arg, "%d", usingInputManagerDisplayID); err != nil {
+					logger.Errorf("无效的显示器ID %s", primary_output.arg)
+					os.Exit(1)
+				}
+			case "hid":
+				*usingHIDTouchTtyPath = primary_output.arg
+			case "direct":
+				*touchDevice = primary_output.arg
+			case "net":
+				*net_touch_target = primary_output.arg
+			case "scrcpy":
+				*scrcpy_target = primary_output.arg
+			}
+		}
 		switch *control_mode {
 		case "uinput":
 		case "inputmanager":
+		case touch_record_mode:
+		case "scrcpy":
 		case "hid":
 			if *usingHIDTouchTtyPath == "" {
-				logger.Error("使用hid模式需要使用--tty-path参数指定串口设备路径")
+				logger.Error("使用hid模式需要使用--tty-path参数指定串口设备路径 或使用--tty-path auto自动查找")
 				os.Exit(1)
 			}
 		case "otg":
 		case "direct":
+		case "net":
+			if *net_touch_target == "" {
+				logger.Error("使用net模式需要使用--net-target参数指定触屏接收端地址")
+				os.Exit(1)
+			}
+			if !strings.Contains(*net_touch_target, "://") {
+				*net_touch_target = "tcp://" + *net_touch_target //触点丢失松开影响较大 默认使用tcp
+			}
 		default:
-			logger.Errorf("未知模式%s,可用模式:uinput,inputmanager,hid,otg,direct", *control_mode)
+			logger.Errorf("未知模式%s,可用模式:uinput,inputmanager,hid,otg,direct,net,scrcpy,record", *control_mode)
 			os.Exit(1)
 		}
 
@@ -817,6 +1531,11 @@ func main() {
 			os.WriteFile(*configPath, bytes, 0644)
 		}
 		logger.Infof("使用配置文件: %v", *configPath)
+		if *devicesPath == "" {
+			if rules, err := load_device_rules_file(*configPath); err == nil {
+				set_device_rules(rules)
+			}
+		}
 		//=================================================================================================================================
 		main_events_ch := make(chan *event_pack)                       //主要设备事件管道
 		mix_touch_event_ch := make(chan *event_pack)                   //触屏设备事件管道
@@ -852,7 +1571,7 @@ func main() {
 			} else {
 				go handel_u_input_mouse_keyboard(fileted_u_input_control_ch)
 			}
-			touch_control_func = handel_touch_using_uinput_touch()
+			touch_control_func = handel_touch_using_uinput_touch(get_clone_touch_index(*cloneTouchScreen, *touchDevice))
 		case "inputmanager":
 			logger.Info("触屏控制将使用inputManager在本机处理")
 			if *uinputMouseKeyboardDisabled {
@@ -876,13 +1595,17 @@ func main() {
 				return
 			}
 			logger.Info("触屏控制将使用串口控制外接的HID设备发送至主机")
+			set_device_orientation(int32(*usingDeviceRotation), "--rotation")
+			if *usingHIDTouchTtyPath == hid_auto_path || *usingHIDTouchTtyPath == hid_auto_all_path {
+				path, err := find_hid_tty_path(*usingHIDTouchTtyPath == hid_auto_all_path)
+				if err != nil {
+					logger.Errorf("自动查找串口失败: %v", err)
+					os.Exit(1)
+				}
+				*usingHIDTouchTtyPath = path
+			}
 			logger.Infof("串口路径：%s", *usingHIDTouchTtyPath)
 			logger.Infof("触屏方向：%d", *usingDeviceRotation)
-			port, err := OpenSerialWritePipe(*usingHIDTouchTtyPath, 2000000)
-			if err != nil {
-				logger.Errorf("无法打开串口: %v", err)
-				os.Exit(1)
-			}
 			go (func() {
 				for {
 					select {
@@ -892,22 +1615,14 @@ func main() {
 					}
 				}
 			})()
-			touch_control_func = handel_touch_using_hid_manager(port)
+			touch_control_func = handel_touch_using_hid_manager(*usingHIDTouchTtyPath)
 		case "otg":
 			global_is_wordking_remote = true
 			logger.Info("触屏控制将使用本机模拟为HID设备发送至主机")
 			logger.Infof("触屏方向：%d", *usingDeviceRotation)
-			global_device_orientation = int32(*usingDeviceRotation)
+			set_device_orientation(int32(*usingDeviceRotation), "--rotation")
 			touch_control_func = handel_touch_using_otg_manager()
-			go (func() {
-				for {
-					select {
-					case <-global_close_signal:
-						return
-					case <-fileted_u_input_control_ch:
-					}
-				}
-			})()
+			go handel_otg_mouse_keyboard(fileted_u_input_control_ch)
 		case "direct":
 			if *uinputMouseKeyboardDisabled {
 				go (func() {
@@ -923,19 +1638,95 @@ func main() {
 				go handel_u_input_mouse_keyboard(fileted_u_input_control_ch)
 			}
 			logger.Info("触屏控制将使用直接写入真实设备文件")
-			var direct_touch_index int
-			for index, devType := range get_possible_device_indexes(make(map[int]bool)) {
-				if devType == type_touch {
-					logger.Infof("将会直接写入触屏 %s(/dev/input/event%d)", get_dev_name_by_index(index), index)
-					direct_touch_index = index
-					break
+			touch_control_func = handel_touch_using_direct_touch(get_direct_touch_index(*touchDevice))
+		case "net":
+			global_is_wordking_remote = true
+			client, err := new_remote_client(*net_touch_target, *remote_psk, *remote_encrypt)
+			if err != nil {
+				logger.Errorf("解析触屏接收端地址失败: %v", err)
+				os.Exit(1)
+			}
+			logger.Infof("触屏控制将发送到 %s", client.name)
+			go (func() {
+				for {
+					select {
+					case <-global_close_signal:
+						return
+					case <-fileted_u_input_control_ch:
+					}
+				}
+			})()
+			touch_control_func = handel_touch_using_net(client)
+		case "scrcpy":
+			client, err := new_scrcpy_client(*scrcpy_target, *scrcpy_server, *scrcpy_version)
+			if err != nil {
+				logger.Errorf("scrcpy参数错误: %v", err)
+				os.Exit(1)
+			}
+			if *scrcpy_target != "" { //可能是其他设备上的scrcpy-server 与hid otg相同使用--rotation
+				global_is_wordking_remote = true
+				logger.Infof("触屏方向：%d", *usingDeviceRotation)
+				set_device_orientation(int32(*usingDeviceRotation), "--rotation")
+			}
+			logger.Infof("触屏控制将通过scrcpy-server %s 执行", client.name)
+			go (func() {
+				for {
+					select {
+					case <-global_close_signal:
+						return
+					case <-fileted_u_input_control_ch:
+					}
 				}
+			})()
+			touch_control_func = handel_touch_using_scrcpy(client)
+		case touch_record_mode:
+			record_func, err := handel_touch_using_record(primary_output.arg)
+			if err != nil {
+				logger.Errorf("创建触屏记录失败: %v", err)
+				os.Exit(1)
 			}
-			touch_control_func = handel_touch_using_direct_touch(direct_touch_index)
+			go (func() {
+				for {
+					select {
+					case <-global_close_signal:
+						return
+					case <-fileted_u_input_control_ch:
+					}
+				}
+			})()
+			touch_control_func = record_func
 		default:
-			logger.Errorf("未知模式%s,可用模式:uinput,inputmanager,hid,otg,direct", *control_mode)
+			logger.Errorf("未知模式%s,可用模式:uinput,inputmanager,hid,otg,direct,net,scrcpy,record", *control_mode)
 			os.Exit(1)
 		}
+		if len(touch_outputs) > 1 || primary_output.transform != nil {
+			touch_control_func = handel_touch_using_fanout(touch_control_func, primary_output.transform, touch_outputs[1:], &touch_sink_options{
+				clone_touch:    *cloneTouchScreen,
+				touch_device:   *touchDevice,
+				display_id:     *usingInputManagerDisplayID,
+				tty_path:       *usingHIDTouchTtyPath,
+				net_target:     *net_touch_target,
+				psk:            *remote_psk,
+				encrypt:        *remote_encrypt,
+				scrcpy_target:  *scrcpy_target,
+				scrcpy_server:  *scrcpy_server,
+				scrcpy_version: *scrcpy_version,
+			})
+		}
+
+		var gamepad_control_ch chan *u_input_control_pack = nil //虚拟手柄的事件管道 未启用则为nil
+		if *usingVirtualGamepad {
+			if *control_mode == "uinput" || *control_mode == "inputmanager" || *control_mode == "direct" {
+				if fd := create_u_input_gamepad(); fd != nil {
+					gamepad_control_ch = make(chan *u_input_control_pack)
+					go handel_u_input_gamepad(gamepad_control_ch, fd)
+				} else {
+					logger.Error("创建虚拟手柄失败 不启用虚拟手柄")
+				}
+			} else {
+				logger.Warnf("%s模式下无法创建虚拟手柄", *control_mode)
+			}
+		}
 
 		map_switch_signal := make(chan bool) //通知虚拟鼠标当前为鼠标还是映射模式
 		touchHandler := InitTouchHandler(
@@ -945,7 +1736,11 @@ func main() {
 			u_input_control_ch,
 			map_switch_signal,
 			*measure_sensitivity_mode,
+			gamepad_control_ch,
 		)
+		if touchHandler.gamepad != nil {
+			go touchHandler.gamepad.loop_handel_mouse_stick()
+		}
 		if !global_is_wordking_remote { //只有本机运行的时候 才有必要开启触屏混合
 			go touchHandler.mix_touch(mix_touch_event_ch)
 			if !*using_v_mouse {
@@ -955,6 +1750,8 @@ func main() {
 		go touchHandler.auto_handel_view_release(*view_release_timeout)
 		go touchHandler.loop_handel_wasd_wheel()
 		go touchHandler.loop_handel_rs_move()
+		go touchHandler.loop_handel_led()
+		go touchHandler.loop_handel_orientation()
 		go touchHandler.handel_event()
 
 		if *using_v_mouse {
@@ -989,7 +1786,15 @@ func main() {
 
 		if *using_remote_control {
 			logger.Errorf("使用远程控制中。。。。")
-			go udp_event_injector(main_events_ch, *port)
+			remote_psk, cipher, pair_query := setup_receiver_psk(*remote_psk, *remote_encrypt)
+			receiver := new_remote_receiver(main_events_ch, *remote_accept_v1, cipher)
+			receiver.status = touchHandler.remote_status
+			go receiver.loop_push_status()
+			go udp_event_injector(receiver, *port, pair_query)
+			go tcp_event_injector(receiver, *port)
+			go remote_discovery_responder(*port, cipher != nil, *remote_encrypt)
+			register_remote_websocket(receiver)
+			register_browser_remote(main_events_ch, remote_psk)
 		}
 
 		if *measure_sensitivity_mode {
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// OTG模式的USB gadget 通过configfs创建包含触屏、鼠标、键盘三个HID功能的复合设备
+// 各功能的/dev/hidgN由configfs中dev属性的次设备号确定 不依赖创建顺序
+// 没有本程序的gadget但已存在/dev/hidg0时(例如已安装pi-gadget-hid)只将其用作触屏 不使用其他hidg设备
+// 退出时解除本程序gadget与UDC的绑定 下次启动时重新绑定
+
+const (
+	otg_gadget_path = "/sys/kernel/config/usb_gadget/go_touch_mapper"
+	otg_touch_dev   = "/dev/hidg0" //其他工具创建的gadget的触屏
+
+	otg_touch_report_length        = 14
+	otg_touch_legacy_report_length = 12 //不带压力与宽度 其他工具创建的gadget
+)
+
+// 单触点触屏 带Report ID 1 在hid_touch旧版固件的基础上增加压力(Tip Pressure)与接触宽度(Width)
+// 报告: <1> <tip> <id> <x u32> <y u32> <pressure> <width> <count>
+var otg_touch_report_desc = []byte{
+	0x05, 0x0D, 0x09, 0x04, 0xA1, 0x01, 0x85, 0x01,
+	0x09, 0x22, 0xA1, 0x02,
+	0x09, 0x42, 0x15, 0x00, 0x25, 0x01, 0x75, 0x01, 0x95, 0x01, 0x81, 0x02,
+	0x95, 0x07, 0x81, 0x03,
+	0x09, 0x51, 0x75, 0x08, 0x95, 0x01, 0x81, 0x02,
+	0x05, 0x01,
+	0x09, 0x30, 0x15, 0x00, 0x27, 0xfe, 0xff, 0xff, 0x7f, 0x75, 0x20, 0x95, 0x01, 0x81, 0x02,
+	0x09, 0x31, 0x15, 0x00, 0x27, 0xfe, 0xff, 0xff, 0x7f, 0x75, 0x20, 0x95, 0x01, 0x81, 0x02,
+	0x05, 0x0D,
+	0x09, 0x30, 0x15, 0x00, 0x26, 0xff, 0x00, 0x75, 0x08, 0x95, 0x01, 0x81, 0x02,
+	0x09, 0x48, 0x15, 0x00, 0x26, 0xff, 0x00, 0x75, 0x08, 0x95, 0x01, 0x81, 0x02,
+	0xC0,
+	0x05, 0x0D, 0x09, 0x54, 0x25, 0x0A, 0x75, 0x08, 0x95, 0x01, 0x81, 0x02,
+	0xC0,
+}
+
+// boot协议鼠标 <buttons> <x> <y> <wheel>
+var otg_mouse_report_desc = []byte{
+	0x05, 0x01, 0x09, 0x02, 0xA1, 0x01, 0x09, 0x01, 0xA1, 0x00,
+	0x05, 0x09, 0x19, 0x01, 0x29, 0x05, 0x15, 0x00, 0x25, 0x01, 0x95, 0x05, 0x75, 0x01, 0x81, 0x02,
+	0x95, 0x01, 0x75, 0x03, 0x81, 0x03,
+	0x05, 0x01, 0x09, 0x30, 0x09, 0x31, 0x09, 0x38, 0x15, 0x81, 0x25, 0x7F, 0x75, 0x08, 0x95, 0x03, 0x81, 0x06,
+	0xC0, 0xC0,
+}
+
+// boot协议键盘 <modifiers> <reserved> <key * 6> 输出报告为LED
+var otg_keyboard_report_desc = []byte{
+	0x05, 0x01, 0x09, 0x06, 0xA1, 0x01,
+	0x05, 0x07, 0x19, 0xE0, 0x29, 0xE7, 0x15, 0x00, 0x25, 0x01, 0x75, 0x01, 0x95, 0x08, 0x81, 0x02,
+	0x95, 0x01, 0x75, 0x08, 0x81, 0x03,
+	0x95, 0x05, 0x75, 0x01, 0x05, 0x08, 0x19, 0x01, 0x29, 0x05, 0x91, 0x02,
+	0x95, 0x01, 0x75, 0x03, 0x91, 0x03,
+	0x95, 0x06, 0x75, 0x08, 0x15, 0x00, 0x25, 0x65, 0x05, 0x07, 0x19, 0x00, 0x29, 0x65, 0x81, 0x00,
+	0xC0,
+}
+
+type otg_hid_function struct {
+	name          string
+	protocol      int
+	subclass      int
+	report_length int
+	report_desc   []byte
+}
+
+var otg_hid_functions = []otg_hid_function{
+	{name: "hid.touch", protocol: 0, subclass: 0, report_length: otg_touch_report_length, report_desc: otg_touch_report_desc},
+	{name: "hid.mouse", protocol: 2, subclass: 1, report_length: 4, report_desc: otg_mouse_report_desc},
+	{name: "hid.keyboard", protocol: 1, subclass: 1, report_length: 8, report_desc: otg_keyboard_report_desc},
+}
+
+func otg_write_attr(path string, value string) error {
+	if err := os.WriteFile(path, []byte(value), 0644); err != nil {
+		return fmt.Errorf("写入%s失败: %v", path, err)
+	}
+	return nil
+}
+
+func otg_write_attrs(dir string, attrs [][2]string) error {
+	for _, attr := range attrs {
+		if err := otg_write_attr(filepath.Join(dir, attr[0]), attr[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func otg_own_gadget() bool {
+	_, err := os.Stat(otg_gadget_path)
+	return err == nil
+}
+
+// 本程序gadget中功能对应的设备文件
+func otg_function_dev(name string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(otg_gadget_path, "functions", name, "dev"))
+	if err != nil {
+		return "", err
+	}
+	var major, minor int
+	if _, err := fmt.Sscanf(strings.TrimSpace(string(data)), "%d:%d", &major, &minor); err != nil {
+		return "", fmt.Errorf("无法解析%s的设备号 %q", name, data)
+	}
+	return fmt.Sprintf("/dev/hidg%d", minor), nil
+}
+
+func otg_gadget_bound() bool {
+	data, err := os.ReadFile(filepath.Join(otg_gadget_path, "UDC"))
+	return err == nil && strings.TrimSpace(string(data)) != ""
+}
+
+// 主机会看到设备断开 所有按键与触点随之释放
+func otg_unbind_gadget() {
+	if err := otg_write_attr(filepath.Join(otg_gadget_path, "UDC"), "\n"); err != nil {
+		logger.Warnf("解除USB gadget绑定失败: %v", err)
+		return
+	}
+	logger.Infof("已解除USB gadget绑定")
+}
+
+// 创建本程序的gadget并绑定到UDC 已存在时重新绑定 上次未正常退出仍处于绑定状态时直接使用
+func setup_otg_gadget() error {
+	if _, err := os.Stat("/sys/kernel/config/usb_gadget"); os.IsNotExist(err) {
+		exec.Command("modprobe", "libcomposite").Run()
+	}
+	if _, err := os.Stat("/sys/kernel/config/usb_gadget"); os.IsNotExist(err) {
+		if err := unix.Mount("none", "/sys/kernel/config", "configfs", 0, ""); err != nil {
+			return fmt.Errorf("configfs不可用 请确认内核已加载libcomposite并启用dwc2: %v", err)
+		}
+		if _, err := os.Stat("/sys/kernel/config/usb_gadget"); os.IsNotExist(err) {
+			return fmt.Errorf("没有usb_gadget 请先执行modprobe libcomposite")
+		}
+	}
+	if otg_gadget_bound() {
+		return nil
+	}
+	udcs, err := os.ReadDir("/sys/class/udc")
+	if err != nil || len(udcs) == 0 {
+		return fmt.Errorf("没有可用的UDC 请在config.txt中添加dtoverlay=dwc2")
+	}
+	strings_path := filepath.Join(otg_gadget_path, "strings/0x409")
+	config_path := filepath.Join(otg_gadget_path, "configs/c.1")
+	for _, dir := range []string{strings_path, filepath.Join(config_path, "strings/0x409")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	if err := otg_write_attrs(otg_gadget_path, [][2]string{
+		{"idVendor", "0x1d6b"},
+		{"idProduct", "0x0104"},
+		{"bcdDevice", "0x0100"},
+		{"bcdUSB", "0x0200"},
+	}); err != nil {
+		return err
+	}
+	if err := otg_write_attrs(strings_path, [][2]string{
+		{"serialnumber", "0123456789"},
+		{"manufacturer", "go-touch-mapper"},
+		{"product", "Touch Keyboard Mouse"},
+	}); err != nil {
+		return err
+	}
+	if err := otg_write_attr(filepath.Join(config_path, "strings/0x409/configuration"), "touch+mouse+keyboard"); err != nil {
+		return err
+	}
+	if err := otg_write_attr(filepath.Join(config_path, "MaxPower"), "250"); err != nil {
+		return err
+	}
+	for _, function := range otg_hid_functions {
+		dir := filepath.Join(otg_gadget_path, "functions", function.name)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		if err := otg_write_attrs(dir, [][2]string{
+			{"protocol", fmt.Sprint(function.protocol)},
+			{"subclass", fmt.Sprint(function.subclass)},
+			{"report_length", fmt.Sprint(function.report_length)},
+			{"report_desc", string(function.report_desc)},
+		}); err != nil {
+			return err
+		}
+		link := filepath.Join(config_path, function.name)
+		if _, err := os.Lstat(link); os.IsNotExist(err) {
+			if err := os.Symlink(dir, link); err != nil {
+				return err
+			}
+		}
+	}
+	udc := udcs[0].Name()
+	if err := otg_write_attr(filepath.Join(otg_gadget_path, "UDC"), udc); err != nil {
+		return err
+	}
+	logger.Infof("已创建USB gadget 绑定到 %s", udc)
+	touch_dev, err := otg_function_dev("hid.touch")
+	if err != nil {
+		return err
+	}
+	for i := 0; i < 20; i++ {
+		if _, err := os.Stat(touch_dev); err == nil {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("gadget已创建 但没有出现%s", touch_dev)
+}
+
+// 已存在的触屏功能报告长度 不是本程序创建的gadget时按旧版不带压力的报告发送
+func get_otg_touch_report_length() int {
+	data, err := os.ReadFile(filepath.Join(otg_gadget_path, "functions/hid.touch/report_length"))
+	if err != nil {
+		return otg_touch_legacy_report_length
+	}
+	if length, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil && length == otg_touch_report_length {
+		return length
+	}
+	return otg_touch_legacy_report_length
+}
+
+// 非阻塞打开 主机未读取报告时丢弃而不是阻塞映射
+func open_otg_hid(path string) (int, error) {
+	return unix.Open(path, unix.O_RDWR|unix.O_NONBLOCK, 0)
+}
+
+// 只打开本程序gadget中的功能 其他工具创建的hidg设备用途未知
+func open_otg_function(name string) (int, string, error) {
+	if !otg_own_gadget() {
+		return -1, name, fmt.Errorf("当前USB gadget不是本程序创建的")
+	}
+	path, err := otg_function_dev(name)
+	if err != nil {
+		return -1, name, err
+	}
+	fd, err := open_otg_hid(path)
+	return fd, path, err
+}
+
+func write_otg_hid(fd int, report []byte) {
+	if _, err := unix.Write(fd, report); err != nil {
+		logger.Debugf("OTG HID报告写入失败: %v", err)
+	}
+}
+
+// Linux键码到USB HID键盘用法
+var otg_keyboard_usage = map[uint16]byte{
+	1: 0x29, 2: 0x1E, 3: 0x1F, 4: 0x20, 5: 0x21, 6: 0x22, 7: 0x23, 8: 0x24, 9: 0x25, 10: 0x26, 11: 0x27,
+	12: 0x2D, 13: 0x2E, 14: 0x2A, 15: 0x2B,
+	16: 0x14, 17: 0x1A, 18: 0x08, 19: 0x15, 20: 0x17, 21: 0x1C, 22: 0x18, 23: 0x0C, 24: 0x12, 25: 0x13,
+	26: 0x2F, 27: 0x30, 28: 0x28,
+	30: 0x04, 31: 0x16, 32: 0x07, 33: 0x09, 34: 0x0A, 35: 0x0B, 36: 0x0D, 37: 0x0E, 38: 0x0F,
+	39: 0x33, 40: 0x34, 41: 0x35, 43: 0x31,
+	44: 0x1D, 45: 0x1B, 46: 0x06, 47: 0x19, 48: 0x05, 49: 0x11, 50: 0x10,
+	51: 0x36, 52: 0x37, 53: 0x38, 55: 0x55, 57: 0x2C, 58: 0x39,
+	59: 0x3A, 60: 0x3B, 61: 0x3C, 62: 0x3D, 63: 0x3E, 64: 0x3F, 65: 0x40, 66: 0x41, 67: 0x42, 68: 0x43,
+	69: 0x53, 70: 0x47,
+	71: 0x5F, 72: 0x60, 73: 0x61, 74: 0x56, 75: 0x5C, 76: 0x5D, 77: 0x5E, 78: 0x57,
+	79: 0x59, 80: 0x5A, 81: 0x5B, 82: 0x62, 83: 0x63,
+	86: 0x64, 87: 0x44, 88: 0x45, 96: 0x58, 98: 0x54, 99: 0x46,
+	102: 0x4A, 103: 0x52, 104: 0x4B, 105: 0x50, 106: 0x4F, 107: 0x4D, 108: 0x51, 109: 0x4E, 110: 0x49, 111: 0x4C,
+	119: 0x48, 127: 0x65,
+}
+
+// Linux键码到键盘报告的修饰键位
+var otg_keyboard_modifier = map[uint16]byte{
+	29: 0x01, 42: 0x02, 56: 0x04, 125: 0x08, 97: 0x10, 54: 0x20, 100: 0x40, 126: 0x80,
+}
+
+// BTN_LEFT BTN_RIGHT BTN_MIDDLE BTN_SIDE BTN_EXTRA
+var otg_mouse_button = map[uint16]byte{
+	0x110: 0x01, 0x111: 0x02, 0x112: 0x04, 0x113: 0x08, 0x114: 0x10,
+}
+
+func clamp_int8(v int32) int8 {
+	if v > 127 {
+		return 127
+	} else if v < -127 {
+		return -127
+	}
+	return int8(v)
+}
+
+// 映射关闭时的键鼠输出 转换为鼠标与键盘的HID报告
+func handel_otg_mouse_keyboard(u_input chan *u_input_control_pack) {
+	mouse_fd, mouse_dev, mouse_err := open_otg_function("hid.mouse")
+	if mouse_err != nil {
+		logger.Warnf("无法打开OTG鼠标 %s: %v", mouse_dev, mouse_err)
+	}
+	keyboard_fd, keyboard_dev, keyboard_err := open_otg_function("hid.keyboard")
+	if keyboard_err != nil {
+		logger.Warnf("无法打开OTG键盘 %s: %v", keyboard_dev, keyboard_err)
+	}
+	defer (func() {
+		if mouse_err == nil {
+			write_otg_hid(mouse_fd, make([]byte, 4))
+			unix.Close(mouse_fd)
+		}
+		if keyboard_err == nil {
+			write_otg_hid(keyboard_fd, make([]byte, 8))
+			unix.Close(keyboard_fd)
+		}
+	})()
+	var buttons, modifiers byte
+	keys := make([]byte, 0, 6)
+	send_mouse := func(x, y, wheel int32) {
+		if mouse_err != nil {
+			return
+		}
+		for { //超过int8范围的移动拆分为多个报告
+			dx, dy := clamp_int8(x), clamp_int8(y)
+			write_otg_hid(mouse_fd, []byte{buttons, byte(dx), byte(dy), byte(clamp_int8(wheel))})
+			x, y, wheel = x-int32(dx), y-int32(dy), 0
+			if x == 0 && y == 0 {
+				return
+			}
+		}
+	}
+	send_keyboard := func() {
+		if keyboard_err != nil {
+			return
+		}
+		report := make([]byte, 8)
+		report[0] = modifiers
+		copy(report[2:], keys)
+		write_otg_hid(keyboard_fd, report)
+	}
+	handel_key := func(code uint16, value int32) {
+		if bit, ok := otg_mouse_button[code]; ok {
+			if value == DOWN {
+				buttons |= bit
+			} else if value == UP {
+				buttons &^= bit
+			}
+			send_mouse(0, 0, 0)
+		} else if bit, ok := otg_keyboard_modifier[code]; ok {
+			if value == DOWN {
+				modifiers |= bit
+			} else if value == UP {
+				modifiers &^= bit
+			}
+			send_keyboard()
+		} else if usage, ok := otg_keyboard_usage[code]; ok {
+			index := -1
+			for i, key := range keys {
+				if key == usage {
+					index = i
+				}
+			}
+			if value == DOWN && index < 0 && len(keys) < 6 {
+				keys = append(keys, usage)
+			} else if value == UP && index >= 0 {
+				keys = append(keys[:index], keys[index+1:]...)
+			} else {
+				return
+			}
+			send_keyboard()
+		}
+	}
+	for {
+		select {
+		case <-global_close_signal:
+			return
+		case pack := <-u_input:
+			switch pack.action {
+			case UInput_mouse_move:
+				send_mouse(pack.arg1, pack.arg2, 0)
+			case UInput_mouse_wheel:
+				if pack.arg1 == REL_WHEEL {
+					send_mouse(0, 0, pack.arg2)
+				}
+			case UInput_mouse_btn, UInput_key_event:
+				handel_key(uint16(pack.arg1), pack.arg2)
+			}
+		}
+	}
+}
@@ -6,44 +6,54 @@ import (
 )
 
 func handel_touch_using_otg_manager() touch_control_func {
-	touch_fd, err := os.OpenFile("/dev/hidg0", os.O_RDWR, 0666)
+	touch_dev := otg_touch_dev
+	if _, err := os.Stat(otg_touch_dev); otg_own_gadget() || os.IsNotExist(err) {
+		if err := setup_otg_gadget(); err != nil {
+			logger.Errorf("创建USB gadget失败: %v", err)
+			os.Exit(4)
+		}
+		if touch_dev, err = otg_function_dev("hid.touch"); err != nil {
+			logger.Errorf("无法获取OTG触屏设备: %v", err)
+			os.Exit(4)
+		}
+		go (func() {
+			<-global_close_signal
+			otg_unbind_gadget()
+		})()
+	} else {
+		logger.Warnf("使用其他工具创建的%s作为触屏 不使用其键鼠功能", otg_touch_dev)
+	}
+	touch_fd, err := os.OpenFile(touch_dev, os.O_RDWR, 0666)
 	if err != nil {
 		logger.Errorf("无法打开OTG HID设备文件: %s", err.Error())
 		os.Exit(4)
 	}
-	// mouse_fd, err := os.OpenFile("/dev/hidg1", os.O_RDWR, 0666)
-	// if err != nil {
-	// 	logger.Errorf("无法打开OTG HID设备文件: %s", err.Error())
-	// 	os.Exit(4)
-	// }
-	// keyboard_fd, err := os.OpenFile("/dev/hidg2", os.O_RDWR, 0666)
-	// if err != nil {
-	// 	logger.Errorf("无法打开OTG HID设备文件: %s", err.Error())
-	// 	os.Exit(4)
-	// }
-	// defer touch_fd.Close()
-	// defer mouse_fd.Close()
-	// defer keyboard_fd.Close()
-
-	var buf [12]byte
+	buf := make([]byte, get_otg_touch_report_length())
 	buf[0] = 0x01
-	setReport := func(action uint8, id uint8, x, y uint32) {
+	setReport := func(action uint8, id uint8, x, y uint32, pressure, size int32) {
 		buf[1] = action
 		buf[2] = id
 		binary.LittleEndian.PutUint32(buf[3:7], x)
 		binary.LittleEndian.PutUint32(buf[7:11], y)
-		buf[11] = 0
+		if len(buf) == otg_touch_report_length {
+			if pressure == 0 && action == 0x01 {
+				pressure = 255 //未指定时按最大压力
+			}
+			buf[11] = uint8(pressure)
+			buf[12] = uint8(size)
+		}
+		buf[len(buf)-1] = 0
 	}
 
 	return func(control_data touch_control_pack) {
 		switch control_data.action {
 		case TouchActionRequire, TouchActionMove:
 			x, y := rotateAbsoluteXY(control_data.x, control_data.y)
-			setReport(0x01, uint8(control_data.id), uint32(x), uint32(y))
-			touch_fd.Write(buf[:])
+			setReport(0x01, uint8(control_data.id), uint32(x), uint32(y), control_data.pressure, control_data.size)
+			touch_fd.Write(buf)
 		case TouchActionRelease:
-			setReport(0x00, uint8(control_data.id), 0, 0)
-			touch_fd.Write(buf[:])
+			setReport(0x00, uint8(control_data.id), 0, 0, 0, 0)
+			touch_fd.Write(buf)
 		}
 	}
 }
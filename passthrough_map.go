@@ -0,0 +1,252 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/bitly/go-simplejson"
+)
+
+// 映射关闭时 键鼠按键的重映射层
+// KEYS中的映射始终生效 LAYERS在按住HOLD或者按下TOGGLE后生效并覆盖KEYS
+// 输出为空字符串则禁用该按键 多个按键使用+连接 按顺序按下 反向松开
+// CHORDS中的按键同时按下时 释放其他成员已输出的按键 并输出OUTPUT
+// 多个启用的层映射同一按键时 PRIORITY大的优先 相同时按层名排序
+type passthrough_layer struct {
+	name     string
+	hold     string
+	toggle   string
+	priority int
+	keys     map[string][]string
+}
+
+type passthrough_chord struct {
+	keys   []string
+	output []string
+}
+
+type passthrough_mapper struct {
+	lock          sync.Mutex
+	keys          map[string][]string
+	layers        map[string]*passthrough_layer
+	layer_order   []*passthrough_layer //按优先级排序 查找时按此顺序
+	chords        []*passthrough_chord
+	active_layers map[string]bool     //当前启用的层
+	pressed       map[string][]string //按下的按键 => 其已输出的按键 松开时按此释放
+}
+
+func parse_passthrough_output(output string) []string {
+	result := make([]string, 0)
+	for _, key := range strings.Split(output, "+") {
+		key = strings.TrimSpace(key)
+		if key != "" {
+			result = append(result, key)
+		}
+	}
+	return result
+}
+
+func parse_passthrough_keys(config *simplejson.Json) map[string][]string {
+	result := make(map[string][]string)
+	for key, output := range config.MustMap() {
+		output_str, ok := output.(string)
+		if !ok {
+			logger.Warnf("PASSTHROUGH_MAP %s => %v 格式错误", key, output)
+			continue
+		}
+		result[key] = parse_passthrough_output(output_str)
+	}
+	return result
+}
+
+func init_passthrough_mapper(config *simplejson.Json) *passthrough_mapper {
+	mapper := &passthrough_mapper{
+		pressed: make(map[string][]string),
+	}
+	mapper.load_config(config)
+	return mapper
+}
+
+func (self *passthrough_mapper) load_config(config *simplejson.Json) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	passthrough_config := config.Get("PASSTHROUGH_MAP")
+	self.keys = parse_passthrough_keys(passthrough_config.Get("KEYS"))
+	self.layers = make(map[string]*passthrough_layer)
+	self.active_layers = make(map[string]bool)
+	for name := range passthrough_config.Get("LAYERS").MustMap() {
+		layer_config := passthrough_config.Get("LAYERS").Get(name)
+		layer := &passthrough_layer{
+			name:     name,
+			hold:     layer_config.Get("HOLD").MustString(""),
+			toggle:   layer_config.Get("TOGGLE").MustString(""),
+			priority: layer_config.Get("PRIORITY").MustInt(0),
+			keys:     parse_passthrough_keys(layer_config.Get("KEYS")),
+		}
+		if layer.hold == "" && layer.toggle == "" {
+			logger.Warnf("PASSTHROUGH_MAP 层 %s 未设置HOLD或TOGGLE,已忽略", name)
+			continue
+		}
+		self.layers[name] = layer
+	}
+	self.layer_order = make([]*passthrough_layer, 0, len(self.layers))
+	for _, layer := range self.layers {
+		self.layer_order = append(self.layer_order, layer)
+	}
+	sort.Slice(self.layer_order, func(i, j int) bool {
+		if self.layer_order[i].priority != self.layer_order[j].priority {
+			return self.layer_order[i].priority > self.layer_order[j].priority
+		}
+		return self.layer_order[i].name < self.layer_order[j].name
+	})
+	self.chords = make([]*passthrough_chord, 0)
+	for i := range passthrough_config.Get("CHORDS").MustArray() {
+		chord_config := passthrough_config.Get("CHORDS").GetIndex(i)
+		chord := &passthrough_chord{
+			keys:   chord_config.Get("KEYS").MustStringArray(),
+			output: parse_passthrough_output(chord_config.Get("OUTPUT").MustString("")),
+		}
+		if len(chord.keys) < 2 {
+			logger.Warnf("PASSTHROUGH_MAP 组合键 %v 至少需要两个按键,已忽略", chord.keys)
+			continue
+		}
+		self.chords = append(self.chords, chord)
+	}
+	if len(self.keys) > 0 || len(self.layers) > 0 || len(self.chords) > 0 {
+		logger.Infof("已载入按键重映射 : %d个按键 %d个层 %d个组合键", len(self.keys), len(self.layers), len(self.chords))
+	}
+}
+
+func (self *passthrough_mapper) layer_key_control(key_name string, up_down int32) bool { //处理层的切换按键 是则返回true
+	handled := false
+	for name, layer := range self.layers {
+		if layer.hold == key_name {
+			if up_down == DOWN {
+				self.active_layers[name] = true
+			} else if up_down == UP {
+				delete(self.active_layers, name)
+			}
+			handled = true
+		}
+		if layer.toggle == key_name {
+			if up_down == DOWN {
+				if self.active_layers[name] {
+					delete(self.active_layers, name)
+				} else {
+					self.active_layers[name] = true
+				}
+			}
+			handled = true
+		}
+	}
+	return handled
+}
+
+func (self *passthrough_mapper) active_layer_names() []string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	result := make([]string, 0, len(self.active_layers))
+	for _, layer := range self.layer_order {
+		if self.active_layers[layer.name] {
+			result = append(result, layer.name)
+		}
+	}
+	return result
+}
+
+func (self *passthrough_mapper) lookup(key_name string) []string {
+	for _, layer := range self.layer_order {
+		if !self.active_layers[layer.name] {
+			continue
+		}
+		if output, ok := layer.keys[key_name]; ok {
+			return output
+		}
+	}
+	if output, ok := self.keys[key_name]; ok {
+		return output
+	}
+	return []string{key_name}
+}
+
+func (self *passthrough_mapper) check_chord(key_name string) *passthrough_chord { //key_name按下后是否构成组合键
+	for _, chord := range self.chords {
+		contains := false
+		complete := true
+		for _, key := range chord.keys {
+			if key == key_name {
+				contains = true
+				continue
+			}
+			if _, ok := self.pressed[key]; !ok {
+				complete = false
+				break
+			}
+		}
+		if contains && complete {
+			return chord
+		}
+	}
+	return nil
+}
+
+func emit_outputs(outputs []string, up_down int32, emit func(string, int32)) {
+	if up_down == UP {
+		for i := len(outputs) - 1; i >= 0; i-- {
+			emit(outputs[i], UP)
+		}
+	} else {
+		for _, output := range outputs {
+			emit(output, up_down)
+		}
+	}
+}
+
+// 处理一个按键事件 通过emit输出转换后的按键
+func (self *passthrough_mapper) handle(key_name string, up_down int32, emit func(string, int32)) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.layer_key_control(key_name, up_down) {
+		return
+	}
+	if up_down == DOWN {
+		if _, ok := self.pressed[key_name]; ok {
+			return
+		}
+		if chord := self.check_chord(key_name); chord != nil {
+			for _, key := range chord.keys {
+				if key != key_name {
+					emit_outputs(self.pressed[key], UP, emit)
+					self.pressed[key] = []string{}
+				}
+			}
+			self.pressed[key_name] = chord.output
+			emit_outputs(chord.output, DOWN, emit)
+			return
+		}
+		outputs := self.lookup(key_name)
+		self.pressed[key_name] = outputs
+		emit_outputs(outputs, DOWN, emit)
+	} else if up_down == UP {
+		outputs, ok := self.pressed[key_name]
+		if !ok {
+			outputs = self.lookup(key_name)
+		}
+		delete(self.pressed, key_name)
+		emit_outputs(outputs, UP, emit)
+	} else { //长按重复
+		if outputs, ok := self.pressed[key_name]; ok {
+			emit_outputs(outputs, up_down, emit)
+		}
+	}
+}
+
+func (self *passthrough_mapper) release_all(emit func(string, int32)) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for key_name, outputs := range self.pressed {
+		emit_outputs(outputs, UP, emit)
+		delete(self.pressed, key_name)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/bitly/go-simplejson"
+)
+
+func TestPassthroughLayerPriority(t *testing.T) {
+	config, err := simplejson.NewJson([]byte(`{"PASSTHROUGH_MAP":{
+		"KEYS":{"KEY_A":"KEY_Z"},
+		"LAYERS":{
+			"B":{"TOGGLE":"KEY_F2","KEYS":{"KEY_A":"KEY_2"}},
+			"A":{"TOGGLE":"KEY_F1","KEYS":{"KEY_A":"KEY_1"}},
+			"HIGH":{"TOGGLE":"KEY_F3","PRIORITY":1,"KEYS":{"KEY_A":"KEY_3"}}
+		}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapper := init_passthrough_mapper(config)
+	press := func(key string) []string {
+		outputs := []string{}
+		mapper.handle(key, DOWN, func(output string, up_down int32) {
+			if up_down == DOWN {
+				outputs = append(outputs, output)
+			}
+		})
+		mapper.handle(key, UP, func(string, int32) {})
+		return outputs
+	}
+	if output := press("KEY_A"); len(output) != 1 || output[0] != "KEY_Z" {
+		t.Fatalf("未启用层时应使用KEYS: %v", output)
+	}
+	press("KEY_F2")
+	press("KEY_F1")
+	for i := 0; i < 20; i++ { //优先级相同时按层名排序 结果不应随机
+		if output := press("KEY_A"); len(output) != 1 || output[0] != "KEY_1" {
+			t.Fatalf("优先级相同时应使用层A: %v", output)
+		}
+	}
+	press("KEY_F3")
+	if output := press("KEY_A"); len(output) != 1 || output[0] != "KEY_3" {
+		t.Fatalf("应使用PRIORITY更大的层: %v", output)
+	}
+	if names := mapper.active_layer_names(); len(names) != 3 || names[0] != "HIGH" || names[1] != "A" || names[2] != "B" {
+		t.Fatalf("启用的层顺序错误: %v", names)
+	}
+}
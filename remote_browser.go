@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/kenshaw/evdev"
+)
+
+// 浏览器远程控制 网页通过WebSocket发送JSON文本消息 直接送入主事件管道
+// {"type":"key","name":"KEY_A","value":1}           键盘按键与鼠标按键 名称与配置文件一致
+// {"type":"rel","x":1,"y":2,"wheel":0,"hwheel":0}    鼠标移动与滚轮
+// {"type":"js_btn","code":0,"value":1}               手柄按键 编号与rjs一致
+// {"type":"js_abs","code":0,"value":32767}           手柄摇杆与扳机 编号与范围与rjs一致
+// {"type":"beat"}                                   心跳 超过remote_timeout未收到任何消息则断开
+// 连接断开时松开所有按键并将摇杆回中
+// 必须设置--psk 连接后服务端先发送 {"type":"challenge","nonce":"..."}
+// 网页回复 {"type":"auth","mac":"..."} mac为以psk为密钥对 browser_challenge_prefix+nonce 的HMAC-SHA256(十六进制) 认证通过后才处理其他消息
+
+const remote_browser_path = "/remote/browser"
+const browser_challenge_prefix = "go-touch-mapper browser challenge"
+
+type browser_message struct {
+	Type   string `json:"type"`
+	Name   string `json:"name"`
+	Code   uint16 `json:"code"`
+	Value  int32  `json:"value"`
+	X      int32  `json:"x"`
+	Y      int32  `json:"y"`
+	Wheel  int32  `json:"wheel"`
+	HWheel int32  `json:"hwheel"`
+	Nonce  string `json:"nonce,omitempty"`
+	Mac    string `json:"mac,omitempty"`
+}
+
+var rjs_abs_rest map[uint16]int32 = map[uint16]int32{ //rjs各轴的中位
+	0: 0, 1: 0, 2: 0, 3: 0, 4: -1023, 5: -1023, 6: 0, 7: 0,
+}
+
+type browser_remote struct {
+	ch       chan *event_pack
+	keys     map[uint16]dev_type //已按下的键鼠按键
+	js_keys  map[uint16]bool     //已按下的手柄按键
+	js_moved map[uint16]bool     //不在中位的手柄轴
+}
+
+func (self *browser_remote) send(name string, device_type dev_type, events ...*evdev.Event) {
+	self.ch <- &event_pack{dev_name: name, dev_type: device_type, events: events}
+}
+
+func (self *browser_remote) handle(message *browser_message) {
+	switch message.Type {
+	case "key":
+		code, ok := friendly_name_2_keycode[message.Name]
+		if !ok || (message.Value != DOWN && message.Value != UP) {
+			return
+		}
+		device_type := type_keyboard
+		if code >= 0x110 {
+			device_type = type_mouse
+		}
+		if message.Value == DOWN {
+			if _, ok := self.keys[code]; ok {
+				return //浏览器长按会重复发送keydown
+			}
+			self.keys[code] = device_type
+		} else {
+			delete(self.keys, code)
+		}
+		self.send("rkm", device_type, &evdev.Event{Type: evdev.EventKey, Code: code, Value: message.Value})
+	case "rel":
+		events := make([]*evdev.Event, 0, 4)
+		for _, rel := range []struct {
+			code  evdev.RelativeType
+			value int32
+		}{{evdev.RelativeX, message.X}, {evdev.RelativeY, message.Y}, {evdev.RelativeWheel, message.Wheel}, {evdev.RelativeHWheel, message.HWheel}} {
+			if rel.value != 0 {
+				events = append(events, &evdev.Event{Type: evdev.EventRelative, Code: uint16(rel.code), Value: rel.value})
+			}
+		}
+		if len(events) > 0 {
+			self.send("rkm", type_mouse, events...)
+		}
+	case "js_btn":
+		if message.Code > 10 || (message.Value != DOWN && message.Value != UP) {
+			return
+		}
+		if message.Value == DOWN {
+			self.js_keys[message.Code] = true
+		} else {
+			delete(self.js_keys, message.Code)
+		}
+		self.send("rjs", type_joystick, &evdev.Event{Type: evdev.EventKey, Code: message.Code, Value: message.Value})
+	case "js_abs":
+		rest, ok := rjs_abs_rest[message.Code]
+		if !ok {
+			return
+		}
+		if message.Value == rest {
+			delete(self.js_moved, message.Code)
+		} else {
+			self.js_moved[message.Code] = true
+		}
+		self.send("rjs", type_joystick, &evdev.Event{Type: evdev.EventAbsolute, Code: message.Code, Value: message.Value})
+	}
+}
+
+func (self *browser_remote) release_all() {
+	for code, device_type := range self.keys {
+		self.send("rkm", device_type, &evdev.Event{Type: evdev.EventKey, Code: code, Value: UP})
+	}
+	for code := range self.js_keys {
+		self.send("rjs", type_joystick, &evdev.Event{Type: evdev.EventKey, Code: code, Value: UP})
+	}
+	for code := range self.js_moved {
+		self.send("rjs", type_joystick, &evdev.Event{Type: evdev.EventAbsolute, Code: code, Value: rjs_abs_rest[code]})
+	}
+}
+
+func browser_challenge_mac(psk string, nonce string) string {
+	mac := hmac.New(sha256.New, []byte(psk))
+	mac.Write([]byte(browser_challenge_prefix + nonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// 发送挑战并校验网页的回复 密钥不经过地址栏与明文传输
+func browser_authenticate(ws *websocket_conn, psk string) bool {
+	nonce := make([]byte, remote_challenge_size)
+	if _, err := rand.Read(nonce); err != nil {
+		return false
+	}
+	challenge, _ := json.Marshal(&browser_message{Type: "challenge", Nonce: hex.EncodeToString(nonce)})
+	ws.conn.SetDeadline(time.Now().Add(remote_timeout))
+	defer ws.conn.SetDeadline(time.Time{})
+	if err := ws.write_message(ws_op_text, challenge); err != nil {
+		return false
+	}
+	for {
+		opcode, data, err := ws.read_message()
+		if err != nil {
+			return false
+		}
+		if opcode != ws_op_text {
+			continue
+		}
+		message := &browser_message{}
+		if err := json.Unmarshal(data, message); err != nil || message.Type != "auth" {
+			continue //认证前的心跳等消息直接忽略
+		}
+		return hmac.Equal([]byte(message.Mac), []byte(browser_challenge_mac(psk, hex.EncodeToString(nonce))))
+	}
+}
+
+// 在控制后台注册浏览器远程控制 未设置psk时不注册
+func register_browser_remote(ch chan *event_pack, psk string) {
+	if psk == "" {
+		logger.Warnf("未设置--psk 不启用浏览器远程控制")
+		return
+	}
+	http.HandleFunc(remote_browser_path, func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket_upgrade(w, r)
+		if err != nil {
+			logger.Debugf("websocket upgrade error : %v", err)
+			return
+		}
+		defer ws.close()
+		if !browser_authenticate(ws, psk) {
+			logger.Warnf("浏览器远程控制认证失败 : %s", r.RemoteAddr)
+			return
+		}
+		logger.Infof("浏览器远程控制已连接 : %s", r.RemoteAddr)
+		remote := &browser_remote{
+			ch:       ch,
+			keys:     make(map[uint16]dev_type),
+			js_keys:  make(map[uint16]bool),
+			js_moved: make(map[uint16]bool),
+		}
+		defer remote.release_all()
+		for {
+			ws.conn.SetReadDeadline(time.Now().Add(remote_timeout))
+			opcode, data, err := ws.read_message()
+			if err != nil {
+				logger.Infof("浏览器远程控制已断开 : %s", r.RemoteAddr)
+				return
+			}
+			if opcode != ws_op_text {
+				continue
+			}
+			message := &browser_message{}
+			if err := json.Unmarshal(data, message); err != nil {
+				logger.Debugf("浏览器远程控制消息格式错误 : %v", err)
+				continue
+			}
+			remote.handle(message)
+		}
+	})
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/kenshaw/evdev"
+)
+
+// 多目标发送端 类似KVM切换
+// -s 可指定多个以逗号分隔的目标 所有目标保持连接与心跳 只有当前目标接收事件
+// 按下切换组合键后切换到下一个目标 之前目标中所有按下的按键会补发松开
+// 切换时仍按住的按键在松开前不会发送到新目标 避免组合键泄露
+// 目标local表示停止发送并释放设备的独占 本机可正常使用键鼠
+// 接收端会回复映射状态 发送端打印状态变化 并可用键盘指示灯显示当前目标是否处于映射模式
+
+const remote_local_target = "local"
+
+type remote_client struct {
+	name      string
+	target    *remote_target //为nil时为本机
+	sender    *remote_sender
+	conn      remote_conn
+	conn_ch   chan remote_conn
+	last_send time.Time
+	status    *remote_status //接收端最近回复的状态
+	reply_id  uint32         //回复状态的接收端session
+	reply_seq uint32
+}
+
+func (self *remote_client) local() bool {
+	return self.target == nil
+}
+
+func new_remote_client(s string, psk string, encrypt bool) (*remote_client, error) {
+	if s == remote_local_target {
+		return &remote_client{name: remote_local_target}, nil
+	}
+	target, err := parse_remote_target(s, 61069)
+	if err != nil {
+		return nil, err
+	}
+	if target.ip == "auto" {
+		info, err := select_remote_receiver()
+		if err != nil {
+			return nil, err
+		}
+		target.ip = info.IP
+		target.port = info.Port
+		if target.scheme == "ws" {
+			target.port = info.Port + 1
+		}
+		if info.Auth && target.psk == "" && psk == "" {
+			logger.Warnf("接收端 %s 需要密钥 请使用--psk指定", info.Name)
+		}
+		target.encrypt = target.encrypt || info.Encrypt
+	}
+	if target.psk == "" {
+		target.psk = psk
+	}
+	target.encrypt = target.encrypt || encrypt
+	if target.scheme == "ws" && target.psk == "" {
+		return nil, fmt.Errorf("ws传输需要使用--psk或在地址中附带psk")
+	}
+	name := fmt.Sprintf("%s://%s:%d", target.scheme, target.ip, target.port)
+	var cipher *remote_cipher
+	if target.psk != "" {
+		cipher, err = new_remote_cipher(target.psk, target.encrypt)
+		if err != nil {
+			return nil, fmt.Errorf("密钥无效 : %v", err)
+		}
+		if target.encrypt {
+			logger.Infof("%s 远程事件将加密发送", name)
+		} else {
+			logger.Infof("%s 远程事件将签名发送", name)
+		}
+	}
+	return &remote_client{
+		name:    name,
+		target:  target,
+		sender:  new_remote_sender(cipher),
+		conn_ch: make(chan remote_conn),
+	}, nil
+}
+
+// 未连接时返回false 连接中按键状态仍会记录 连接后由快照补发
+func (self *remote_client) send(data []byte) bool {
+	if self.conn == nil {
+		return false
+	}
+	err := self.conn.send(data)
+	self.last_send = time.Now()
+	if err != nil {
+		if self.conn.reliable() {
+			logger.Warnf("%s 连接断开 : %v 正在重连", self.name, err)
+			self.conn.close()
+			self.conn = nil
+			dial_remote_async(self.target, self.conn_ch)
+		} else {
+			logger.Debugf("%s 发送失败 : %v", self.name, err) //UDP在对端未启动时会收到拒绝 心跳会持续重试
+		}
+	}
+	return true
+}
+
+type remote_received struct {
+	client *remote_client
+	data   []byte
+}
+
+// 读取接收端的回复 连接关闭后退出
+func (self *remote_client) receive_loop(conn remote_conn, ch chan remote_received) {
+	for {
+		data, err := conn.receive()
+		if err != nil {
+			return
+		}
+		select {
+		case ch <- remote_received{client: self, data: data}:
+		case <-global_close_signal:
+			return
+		}
+	}
+}
+
+// 解析接收端回复的状态 无效或过期时返回nil
+func (self *remote_client) handle_reply(data []byte) *remote_status {
+	if self.sender.cipher != nil {
+		opened, err := self.sender.cipher.open(data)
+		if err != nil {
+			logger.Debugf("%s 拒绝回复 : %v", self.name, err)
+			return nil
+		}
+		data = opened
+	}
+	packet, err := parse_remote_packet(data, false)
+	if err != nil || packet.status == nil {
+		return nil
+	}
+	if packet.header.session == self.reply_id && int32(packet.header.seq-self.reply_seq) <= 0 {
+		return nil
+	}
+	self.reply_id = packet.header.session
+	self.reply_seq = packet.header.seq
+	return packet.status
+}
+
+// 解析 KEY_LEFTCTRL+KEY_LEFTALT+KEY_TAB 形式的组合键
+func parse_switch_keys(s string) ([]uint16, error) {
+	keys := make([]uint16, 0)
+	for _, name := range strings.Split(s, "+") {
+		code, ok := friendly_name_2_keycode[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("未知按键 %s", name)
+		}
+		keys = append(keys, code)
+	}
+	return keys, nil
+}
+
+// 合并发送频率内同一设备连续的相对移动事件 按键等其他事件不合并 且发送前先发出已合并的移动保持顺序
+type rel_coalescer struct {
+	packs  map[string]*event_pack
+	order  []string
+	merged int //已合并的事件包数量
+}
+
+func new_rel_coalescer() *rel_coalescer {
+	return &rel_coalescer{packs: make(map[string]*event_pack)}
+}
+
+func only_rel_events(pack *event_pack) bool {
+	for _, event := range pack.events {
+		if event.Type != evdev.EventRelative {
+			return false
+		}
+	}
+	return len(pack.events) > 0
+}
+
+func (self *rel_coalescer) add(pack *event_pack) {
+	self.merged++
+	pending, ok := self.packs[pack.dev_name]
+	if !ok {
+		pending = &event_pack{dev_name: pack.dev_name, dev_type: pack.dev_type, events: make([]*evdev.Event, 0, 4)}
+		self.packs[pack.dev_name] = pending
+		self.order = append(self.order, pack.dev_name)
+	}
+	for _, event := range pack.events {
+		found := false
+		for _, merged := range pending.events {
+			if merged.Code == event.Code {
+				merged.Value += event.Value
+				found = true
+				break
+			}
+		}
+		if !found {
+			pending.events = append(pending.events, &evdev.Event{Type: event.Type, Code: event.Code, Value: event.Value})
+		}
+	}
+}
+
+// 发送所有合并后的事件包 返回节省的包数量
+func (self *rel_coalescer) flush(send func(pack *event_pack)) int {
+	saved := self.merged - len(self.order)
+	for _, name := range self.order {
+		send(self.packs[name])
+		delete(self.packs, name)
+	}
+	self.order = self.order[:0]
+	self.merged = 0
+	return saved
+}
+
+type remote_connected struct {
+	client *remote_client
+	conn   remote_conn
+}
+
+// send_rate为每秒最多发送的移动事件包数量 为0时每个SYN_REPORT发送一次
+// mirror_led为显示映射状态的键盘指示灯 为-1时不使用
+func run_remote_sender(clients []*remote_client, switch_keys []uint16, send_rate int, mirror_led int, events_ch chan *event_pack) {
+	active := 0
+	pack_count := 0
+	pack_size := 0
+	pack_saved := 0
+	connected_ch := make(chan remote_connected)
+	received_ch := make(chan remote_received)
+	for _, client := range clients {
+		if client.local() {
+			continue
+		}
+		dial_remote_async(client.target, client.conn_ch)
+		go func(client *remote_client) {
+			for {
+				select {
+				case <-global_close_signal:
+					return
+				case conn := <-client.conn_ch:
+					connected_ch <- remote_connected{client: client, conn: conn}
+				}
+			}
+		}(client)
+	}
+
+	send := func(client *remote_client, data []byte) {
+		if client.send(data) {
+			pack_count++
+			pack_size += len(data)
+		}
+	}
+
+	send_pack := func(client *remote_client, pack *event_pack) {
+		if data := client.sender.events_frame(pack); data != nil {
+			send(client, data)
+		} else {
+			logger.Warnf("事件包过大 已丢弃 : %s %d个事件", pack.dev_name, len(pack.events))
+		}
+	}
+	coalescer := new_rel_coalescer()
+	flush := func() {
+		client := clients[active]
+		pack_saved += coalescer.flush(func(pack *event_pack) {
+			send_pack(client, pack)
+		})
+	}
+	var rate_tick <-chan time.Time //为nil时不合并
+	if send_rate > 0 {
+		rate_ticker := time.NewTicker(time.Second / time.Duration(send_rate))
+		defer rate_ticker.Stop()
+		rate_tick = rate_ticker.C
+	}
+
+	update_led := func() {
+		if mirror_led >= 0 {
+			if status := clients[active].status; status != nil && status.map_on {
+				global_keyboard_led.set(uint16(mirror_led), true)
+			} else {
+				global_keyboard_led.release(uint16(mirror_led))
+			}
+		}
+	}
+
+	pressed := make(map[uint16]bool)    //本地当前按下的按键 用于检测组合键
+	suppressed := make(map[uint16]bool) //切换时仍按住的按键 松开前不发送
+	switch_to := func(index int) {
+		previous := clients[active]
+		if !previous.local() {
+			flush()
+			previous.sender.release_all(func(data []byte) {
+				send(previous, data)
+			})
+		}
+		active = index
+		for code := range pressed {
+			suppressed[code] = true
+		}
+		if clients[active].local() != previous.local() {
+			global_device_grab.set(!clients[active].local())
+		}
+		update_led()
+		logger.Infof("当前目标 [%d/%d] %s", active+1, len(clients), clients[active].name)
+	}
+	chord_pressed := func(code uint16) bool { //仅在按下组合键中的按键时触发
+		in_chord := false
+		for _, key := range switch_keys {
+			if !pressed[key] {
+				return false
+			}
+			in_chord = in_chord || key == code
+		}
+		return in_chord
+	}
+
+	if clients[active].local() {
+		global_device_grab.set(false)
+	}
+	update_led()
+	logger.Infof("当前目标 [%d/%d] %s", active+1, len(clients), clients[active].name)
+	state_ticker := time.NewTicker(remote_state_period)
+	defer state_ticker.Stop()
+	beat_ticker := time.NewTicker(remote_beat_period)
+	defer beat_ticker.Stop()
+	stats_ticker := time.NewTicker(time.Second * 1) //统计与事件处理在同一循环中 避免读写竞争
+	defer stats_ticker.Stop()
+	for {
+		select {
+		case <-global_close_signal:
+			for _, client := range clients {
+				if client.conn != nil {
+					client.conn.close()
+				}
+			}
+			return
+		case connected := <-connected_ch:
+			connected.client.conn = connected.conn
+			logger.Infof("已连接 %s", connected.client.name)
+			go connected.client.receive_loop(connected.conn, received_ch)
+			for _, frame := range connected.client.sender.state_frames() {
+				send(connected.client, frame)
+			}
+		case received := <-received_ch:
+			client := received.client
+			status := client.handle_reply(received.data)
+			if status == nil {
+				continue
+			}
+			last := client.status
+			client.status = status
+			if last == nil || last.map_on != status.map_on || last.profile != status.profile || last.orientation != status.orientation {
+				map_state := "off"
+				if status.map_on {
+					map_state = "on"
+				}
+				logger.Infof("%s 映射[%s] 配置:%s 方向:%d", client.name, map_state, status.profile, status.orientation)
+			}
+			if client == clients[active] {
+				update_led()
+			}
+		case pack := <-events_ch:
+			events := make([]*evdev.Event, 0, len(pack.events))
+			switched := false
+			for _, event := range pack.events {
+				if event.Type == evdev.EventKey {
+					if event.Value == UP {
+						delete(pressed, event.Code)
+					} else if event.Value == DOWN {
+						pressed[event.Code] = true
+						if len(clients) > 1 && !switched && chord_pressed(event.Code) {
+							switch_to((active + 1) % len(clients))
+							switched = true
+							rest := events[:0] //同一包中之前的按键属于切换操作 不发送到新目标
+							for _, e := range events {
+								if e.Type != evdev.EventKey {
+									rest = append(rest, e)
+								}
+							}
+							events = rest
+						}
+					}
+					if suppressed[event.Code] {
+						if event.Value == UP {
+							delete(suppressed, event.Code)
+						}
+						continue
+					}
+				}
+				events = append(events, event)
+			}
+			client := clients[active]
+			if client.local() || len(events) == 0 {
+				continue
+			}
+			pack.events = events
+			if pack.dev_type == type_keyboard || pack.dev_type == type_mouse {
+				pack.dev_name = "rkm"
+			}
+			if rate_tick != nil && only_rel_events(pack) {
+				coalescer.add(pack)
+				continue
+			}
+			flush()
+			send_pack(client, pack)
+		case <-rate_tick:
+			if !clients[active].local() {
+				flush()
+			}
+		case <-state_ticker.C: //定时发送按键快照 接收端据此补发丢失的松开
+			for _, client := range clients {
+				if !client.local() {
+					for _, frame := range client.sender.state_frames() {
+						send(client, frame)
+					}
+				}
+			}
+		case <-beat_ticker.C:
+			for _, client := range clients {
+				if !client.local() && time.Since(client.last_send) >= remote_beat_period {
+					send(client, client.sender.beat_frame())
+				}
+			}
+		case <-stats_ticker.C:
+			touches := []int32{}
+			if status := clients[active].status; status != nil {
+				touches = status.touches
+			}
+			logger.Debugf("当前目标: %s 触点: %v 发送频率: %d Pack/s 合并节省: %d Pack/s 发送数据量: %d B/s\r", clients[active].name, touches, pack_count, pack_saved, pack_size)
+			pack_count = 0
+			pack_size = 0
+			pack_saved = 0
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 局域网内发现接收端
+// 发送端向remote_discovery_port广播 "GTDQ"+<nonce:4byte>
+// 接收端回复 "GTDR"+<nonce:4byte>+JSON(remote_receiver_info) 发送端使用回复的来源地址
+
+const (
+	remote_discovery_port    = 61068
+	remote_discovery_timeout = time.Duration(800) * time.Millisecond
+	remote_discovery_query   = "GTDQ"
+	remote_discovery_reply   = "GTDR"
+)
+
+type remote_receiver_info struct {
+	Name    string `json:"name"`
+	IP      string `json:"ip"`
+	Port    int    `json:"port"`    //远程事件端口 控制后台为port+1
+	Version string `json:"version"` //构建版本
+	Auth    bool   `json:"auth"`    //是否需要密钥
+	Encrypt bool   `json:"encrypt"` //是否需要加密
+}
+
+func get_receiver_name() string {
+	if output, err := exec.Command("getprop", "ro.product.model").Output(); err == nil {
+		if name := strings.TrimSpace(string(output)); name != "" {
+			return name
+		}
+	}
+	if name, err := os.Hostname(); err == nil {
+		return name
+	}
+	return "unknown"
+}
+
+// 接收端 回复发现请求
+func remote_discovery_responder(port int, auth bool, encrypt bool) {
+	listen, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero, Port: remote_discovery_port})
+	if err != nil {
+		logger.Warnf("无法监听发现端口%d : %v", remote_discovery_port, err)
+		return
+	}
+	go func() {
+		<-global_close_signal
+		listen.Close()
+	}()
+	info, _ := json.Marshal(&remote_receiver_info{
+		Name:    get_receiver_name(),
+		Port:    port,
+		Version: go_build_version,
+		Auth:    auth,
+		Encrypt: encrypt,
+	})
+	buf := make([]byte, 64)
+	for {
+		n, addr, err := listen.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if n != 8 || string(buf[:4]) != remote_discovery_query {
+			continue
+		}
+		reply := append([]byte(remote_discovery_reply), buf[4:8]...)
+		reply = append(reply, info...)
+		listen.WriteToUDP(reply, addr)
+		logger.Debugf("回复发现请求 : %s", addr)
+	}
+}
+
+func broadcast_addresses() []net.IP {
+	result := []net.IP{net.IPv4bcast}
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return result
+	}
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagBroadcast == 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.To4() == nil || ipNet.IP.IsLoopback() {
+				continue
+			}
+			ip := ipNet.IP.To4()
+			broadcast := make(net.IP, 4)
+			for i := range ip {
+				broadcast[i] = ip[i] | ^ipNet.Mask[len(ipNet.Mask)-4+i]
+			}
+			result = append(result, broadcast)
+		}
+	}
+	return result
+}
+
+// 广播发现请求 在timeout内收集回复
+func discover_remote_receivers(timeout time.Duration) ([]*remote_receiver_info, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	nonce := strconv.FormatInt(time.Now().UnixNano(), 36)
+	query := []byte(remote_discovery_query + nonce[len(nonce)-4:])
+	for _, ip := range broadcast_addresses() {
+		conn.WriteToUDP(query, &net.UDPAddr{IP: ip, Port: remote_discovery_port})
+	}
+	found := make(map[string]*remote_receiver_info)
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			break //超时
+		}
+		if n < 8 || string(buf[:4]) != remote_discovery_reply || string(buf[4:8]) != string(query[4:8]) {
+			continue
+		}
+		info := &remote_receiver_info{}
+		if err := json.Unmarshal(buf[8:n], info); err != nil {
+			continue
+		}
+		info.IP = addr.IP.String()
+		found[fmt.Sprintf("%s:%d", info.IP, info.Port)] = info
+	}
+	result := make([]*remote_receiver_info, 0, len(found))
+	for _, info := range found {
+		result = append(result, info)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].IP < result[j].IP
+	})
+	return result, nil
+}
+
+func print_remote_receivers(receivers []*remote_receiver_info) {
+	for i, info := range receivers {
+		security := ""
+		if info.Encrypt {
+			security = " 需要密钥与加密"
+		} else if info.Auth {
+			security = " 需要密钥"
+		}
+		logger.Infof("[%d] %s %s:%d 版本:%s%s", i, info.Name, info.IP, info.Port, info.Version, security)
+	}
+}
+
+// -s auto 只有一个接收端时直接使用 多个时从标准输入选择
+func select_remote_receiver() (*remote_receiver_info, error) {
+	logger.Info("正在搜索局域网内的接收端...")
+	receivers, err := discover_remote_receivers(remote_discovery_timeout)
+	if err != nil {
+		return nil, err
+	}
+	if len(receivers) == 0 {
+		return nil, fmt.Errorf("未发现接收端 请确认接收端已使用-r启动且在同一局域网")
+	}
+	print_remote_receivers(receivers)
+	if len(receivers) == 1 {
+		return receivers[0], nil
+	}
+	logger.Info("输入序号选择接收端:")
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		index, err := strconv.Atoi(strings.TrimSpace(scanner.Text()))
+		if err != nil || index < 0 || index >= len(receivers) {
+			logger.Errorf("输入错误 请输入0~%d", len(receivers)-1)
+			continue
+		}
+		return receivers[index], nil
+	}
+	return nil, fmt.Errorf("未选择接收端")
+}
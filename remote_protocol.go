@@ -0,0 +1,881 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/kenshaw/evdev"
+)
+
+// 远程事件协议v2
+// 包头：<magic:2byte "GT"><version:1byte><kind:1byte><session:4byte><seq:4byte>
+// 事件包：<event_count:1byte><event1:8byte>...<eventN:8byte><dev_type:1byte><name_len:1byte><dev_name>
+// 按键快照：<dev_count:1byte> 每个设备 <dev_type:1byte><name_len:1byte><dev_name><key_count:1byte><code:2byte>...
+// 部分按键快照：格式与按键快照相同 一个包放不下全部设备时分为多个发送 接收端只修正其中列出的设备
+// 心跳：无内容
+// 触屏控制：<action:1byte><id:4byte><x:4byte><y:4byte><screen_x:4byte><screen_y:4byte>[<pressure:1byte><size:1byte>[<tool:1byte>]]
+// 压力与接触面积仅在指定时附加 工具类型不是手指时再附加1字节 旧版接收端会丢弃带有附加字节的触屏控制
+// 触点快照：<count:1byte><id:4byte>...
+// 状态(接收端发回发送端)：<map_on:1byte><orientation:1byte><touch_count:1byte><id:1byte>...<profile_len:1byte><profile>
+// 所有数值均为小端 session为发送端启动时随机生成 seq每个包加一
+// v1格式：<event_count:1byte><event1:8byte>...<eventN:8byte><dev_type:1byte><dev_name>
+
+const (
+	remote_magic_0         = 'G'
+	remote_magic_1         = 'T'
+	remote_version         = 2
+	remote_header_size     = 12
+	remote_max_packet      = 1024
+	remote_seal_size       = 32 //签名或加密增加的最大长度
+	remote_kind_events     = uint8(0)
+	remote_kind_state      = uint8(1) //按键快照
+	remote_kind_beat       = uint8(2) //心跳
+	remote_kind_touch      = uint8(3) //触屏控制 -m net
+	remote_kind_touches    = uint8(4) //按下的触点快照
+	remote_kind_status     = uint8(5) //接收端发回的映射状态
+	remote_kind_state_part = uint8(6) //部分按键快照 未列出的设备不修正
+	remote_touch_size      = 21
+	remote_touch_attr      = 2 //可选的压力与接触面积
+	remote_touch_tool      = 1 //可选的工具类型
+	remote_state_period    = time.Duration(500) * time.Millisecond
+	remote_beat_period     = time.Duration(250) * time.Millisecond
+	remote_timeout         = time.Duration(2) * time.Second //超过此时间未收到任何包则释放该发送端按下的按键
+	remote_status_check    = time.Duration(50) * time.Millisecond
+	remote_status_beat     = time.Duration(1) * time.Second //状态未变化时的回复间隔
+)
+
+type remote_header struct {
+	version uint8
+	kind    uint8
+	session uint32
+	seq     uint32
+}
+
+type remote_held_device struct {
+	dev_type dev_type
+	keys     map[uint16]bool
+}
+
+type remote_packet struct {
+	header remote_header
+	pack   *event_pack                    //kind为事件时有效
+	state  map[string]*remote_held_device //kind为快照时有效
+	touch  *touch_control_pack            //kind为触屏控制时有效
+	ids    map[int32]bool                 //kind为触点快照时有效
+	status *remote_status                 //kind为状态时有效
+}
+
+type remote_status struct {
+	map_on      bool
+	orientation int32
+	touches     []int32 //使用中的触摸ID
+	profile     string  //当前配置文件名
+}
+
+func (self *remote_status) equal(other *remote_status) bool {
+	if other == nil || self.map_on != other.map_on || self.orientation != other.orientation || self.profile != other.profile || len(self.touches) != len(other.touches) {
+		return false
+	}
+	for i := range self.touches {
+		if self.touches[i] != other.touches[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func put_remote_header(buf []byte, header remote_header) {
+	buf[0] = remote_magic_0
+	buf[1] = remote_magic_1
+	buf[2] = header.version
+	buf[3] = header.kind
+	binary.LittleEndian.PutUint32(buf[4:8], header.session)
+	binary.LittleEndian.PutUint32(buf[8:12], header.seq)
+}
+
+func put_remote_events(buf []byte, pack *event_pack) int {
+	buf[0] = byte(len(pack.events))
+	for i, event := range pack.events {
+		offset := 1 + i*8
+		binary.LittleEndian.PutUint16(buf[offset:offset+2], uint16(event.Type))
+		binary.LittleEndian.PutUint16(buf[offset+2:offset+4], event.Code)
+		binary.LittleEndian.PutUint32(buf[offset+4:offset+8], uint32(event.Value))
+	}
+	offset := 1 + len(pack.events)*8
+	buf[offset] = byte(pack.dev_type)
+	buf[offset+1] = byte(len(pack.dev_name))
+	copy(buf[offset+2:], pack.dev_name)
+	return offset + 2 + len(pack.dev_name)
+}
+
+func parse_remote_events(data []byte, has_name_len bool) (*event_pack, error) {
+	if len(data) < 2 {
+		return nil, fmt.Errorf("包长度不足 %d", len(data))
+	}
+	event_count := int(data[0])
+	name_offset := 1 + event_count*8 + 1
+	if len(data) < name_offset {
+		return nil, fmt.Errorf("事件数量%d与包长度%d不符", event_count, len(data))
+	}
+	events := make([]*evdev.Event, 0, event_count)
+	for i := 0; i < event_count; i++ {
+		offset := 1 + i*8
+		events = append(events, &evdev.Event{
+			Type:  evdev.EventType(binary.LittleEndian.Uint16(data[offset : offset+2])),
+			Code:  binary.LittleEndian.Uint16(data[offset+2 : offset+4]),
+			Value: int32(binary.LittleEndian.Uint32(data[offset+4 : offset+8])),
+		})
+	}
+	name := data[name_offset:]
+	if has_name_len {
+		if len(name) < 1 || len(name) != int(name[0])+1 {
+			return nil, fmt.Errorf("设备名长度与包长度%d不符", len(data))
+		}
+		name = name[1:]
+	}
+	return &event_pack{
+		dev_name: string(name),
+		dev_type: dev_type(data[name_offset-1]),
+		events:   events,
+	}, nil
+}
+
+func parse_remote_state(data []byte) (map[string]*remote_held_device, error) {
+	if len(data) < 1 {
+		return nil, fmt.Errorf("快照长度不足")
+	}
+	result := make(map[string]*remote_held_device)
+	offset := 1
+	for i := 0; i < int(data[0]); i++ {
+		if len(data) < offset+2 {
+			return nil, fmt.Errorf("快照长度不足")
+		}
+		device := &remote_held_device{dev_type: dev_type(data[offset]), keys: make(map[uint16]bool)}
+		name_len := int(data[offset+1])
+		offset += 2
+		if len(data) < offset+name_len+1 {
+			return nil, fmt.Errorf("快照长度不足")
+		}
+		name := string(data[offset : offset+name_len])
+		offset += name_len
+		key_count := int(data[offset])
+		offset++
+		if len(data) < offset+key_count*2 {
+			return nil, fmt.Errorf("快照长度不足")
+		}
+		for j := 0; j < key_count; j++ {
+			device.keys[binary.LittleEndian.Uint16(data[offset:offset+2])] = true
+			offset += 2
+		}
+		result[name] = device
+	}
+	if offset != len(data) {
+		return nil, fmt.Errorf("快照长度%d与内容不符", len(data))
+	}
+	return result, nil
+}
+
+func put_remote_touch(buf []byte, pack touch_control_pack) int {
+	buf[0] = byte(pack.action)
+	binary.LittleEndian.PutUint32(buf[1:5], uint32(pack.id))
+	binary.LittleEndian.PutUint32(buf[5:9], uint32(pack.x))
+	binary.LittleEndian.PutUint32(buf[9:13], uint32(pack.y))
+	binary.LittleEndian.PutUint32(buf[13:17], uint32(pack.screen_x))
+	binary.LittleEndian.PutUint32(buf[17:21], uint32(pack.screen_y))
+	if pack.pressure == 0 && pack.size == 0 && pack.tool == 0 {
+		return remote_touch_size
+	}
+	buf[21] = uint8(pack.pressure)
+	buf[22] = uint8(pack.size)
+	if pack.tool == 0 {
+		return remote_touch_size + remote_touch_attr
+	}
+	buf[23] = uint8(pack.tool)
+	return remote_touch_size + remote_touch_attr + remote_touch_tool
+}
+
+func parse_remote_touch(data []byte) (*touch_control_pack, error) {
+	if len(data) != remote_touch_size && len(data) != remote_touch_size+remote_touch_attr && len(data) != remote_touch_size+remote_touch_attr+remote_touch_tool {
+		return nil, fmt.Errorf("触屏控制长度%d错误", len(data))
+	}
+	pack := &touch_control_pack{
+		action:   int8(data[0]),
+		id:       int32(binary.LittleEndian.Uint32(data[1:5])),
+		x:        int32(binary.LittleEndian.Uint32(data[5:9])),
+		y:        int32(binary.LittleEndian.Uint32(data[9:13])),
+		screen_x: int32(binary.LittleEndian.Uint32(data[13:17])),
+		screen_y: int32(binary.LittleEndian.Uint32(data[17:21])),
+	}
+	if len(data) > remote_touch_size {
+		pack.pressure = int32(data[21])
+		pack.size = int32(data[22])
+	}
+	if len(data) > remote_touch_size+remote_touch_attr {
+		pack.tool = int32(data[23])
+	}
+	return pack, nil
+}
+
+func parse_remote_touches(data []byte) (map[int32]bool, error) {
+	if len(data) < 1 || len(data) != 1+int(data[0])*4 {
+		return nil, fmt.Errorf("触点快照长度%d错误", len(data))
+	}
+	result := make(map[int32]bool)
+	for i := 0; i < int(data[0]); i++ {
+		result[int32(binary.LittleEndian.Uint32(data[1+i*4:5+i*4]))] = true
+	}
+	return result, nil
+}
+
+func put_remote_status(buf []byte, status *remote_status) int {
+	buf[0] = 0
+	if status.map_on {
+		buf[0] = 1
+	}
+	buf[1] = byte(status.orientation)
+	touches := status.touches
+	if len(touches) > 255 {
+		touches = touches[:255]
+	}
+	buf[2] = byte(len(touches))
+	offset := 3
+	for _, id := range touches {
+		buf[offset] = byte(id)
+		offset++
+	}
+	profile := status.profile
+	if len(profile) > 255 {
+		profile = profile[:255]
+	}
+	buf[offset] = byte(len(profile))
+	offset++
+	offset += copy(buf[offset:], profile)
+	return offset
+}
+
+func parse_remote_status(data []byte) (*remote_status, error) {
+	if len(data) < 4 || len(data) < 4+int(data[2]) {
+		return nil, fmt.Errorf("状态长度不足")
+	}
+	status := &remote_status{map_on: data[0] == 1, orientation: int32(data[1]), touches: make([]int32, 0, data[2])}
+	offset := 3
+	for i := 0; i < int(data[2]); i++ {
+		status.touches = append(status.touches, int32(data[offset]))
+		offset++
+	}
+	if len(data) != offset+1+int(data[offset]) {
+		return nil, fmt.Errorf("状态长度%d与内容不符", len(data))
+	}
+	status.profile = string(data[offset+1:])
+	return status, nil
+}
+
+// 解析一个远程数据包 accept_v1为false时拒绝没有包头的旧格式
+func parse_remote_packet(data []byte, accept_v1 bool) (*remote_packet, error) {
+	if len(data) >= remote_header_size && data[0] == remote_magic_0 && data[1] == remote_magic_1 {
+		if data[3]&remote_flag_mask != 0 {
+			return nil, fmt.Errorf("收到签名或加密的数据包 但未设置密钥")
+		}
+		header := remote_header{
+			version: data[2],
+			kind:    data[3],
+			session: binary.LittleEndian.Uint32(data[4:8]),
+			seq:     binary.LittleEndian.Uint32(data[8:12]),
+		}
+		if header.version != remote_version {
+			return nil, fmt.Errorf("不支持的协议版本 %d", header.version)
+		}
+		payload := data[remote_header_size:]
+		switch header.kind {
+		case remote_kind_events:
+			pack, err := parse_remote_events(payload, true)
+			if err != nil {
+				return nil, err
+			}
+			return &remote_packet{header: header, pack: pack}, nil
+		case remote_kind_state, remote_kind_state_part:
+			state, err := parse_remote_state(payload)
+			if err != nil {
+				return nil, err
+			}
+			return &remote_packet{header: header, state: state}, nil
+		case remote_kind_beat:
+			return &remote_packet{header: header}, nil
+		case remote_kind_touch:
+			touch, err := parse_remote_touch(payload)
+			if err != nil {
+				return nil, err
+			}
+			return &remote_packet{header: header, touch: touch}, nil
+		case remote_kind_touches:
+			ids, err := parse_remote_touches(payload)
+			if err != nil {
+				return nil, err
+			}
+			return &remote_packet{header: header, ids: ids}, nil
+		case remote_kind_status:
+			status, err := parse_remote_status(payload)
+			if err != nil {
+				return nil, err
+			}
+			return &remote_packet{header: header, status: status}, nil
+		default:
+			return nil, fmt.Errorf("未知的包类型 %d", header.kind)
+		}
+	}
+	if !accept_v1 {
+		return nil, fmt.Errorf("未启用v1协议")
+	}
+	pack, err := parse_remote_events(data, false)
+	if err != nil {
+		return nil, err
+	}
+	return &remote_packet{header: remote_header{version: 1, kind: remote_kind_events}, pack: pack}, nil
+}
+
+//---------------------------------发送端--------------------------------------//
+
+// 为发送的数据包编号 并记录已按下的按键用于生成快照
+type remote_sender struct {
+	lock    sync.Mutex
+	session uint32
+	seq     uint32
+	held    map[string]*remote_held_device
+	touches map[int32]bool //-m net 按下的触点
+	buf     []byte
+	cipher  *remote_cipher //为nil时不签名
+}
+
+func new_remote_sender(cipher *remote_cipher) *remote_sender {
+	return &remote_sender{
+		session: rand.New(rand.NewSource(time.Now().UnixNano())).Uint32(),
+		held:    make(map[string]*remote_held_device),
+		touches: make(map[int32]bool),
+		buf:     make([]byte, remote_max_packet-remote_seal_size),
+		cipher:  cipher,
+	}
+}
+
+func (self *remote_sender) output(length int) []byte {
+	if self.cipher != nil {
+		return self.cipher.seal(self.buf[:length])
+	}
+	return self.buf[:length]
+}
+
+func (self *remote_sender) next_header(kind uint8) []byte {
+	self.seq++
+	put_remote_header(self.buf, remote_header{version: remote_version, kind: kind, session: self.session, seq: self.seq})
+	return self.buf[remote_header_size:]
+}
+
+// 返回的切片在下一次调用前有效 超出包长度限制时返回nil
+func (self *remote_sender) events_frame(pack *event_pack) []byte {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if len(pack.dev_name) > 255 || remote_header_size+len(pack.events)*8+3+len(pack.dev_name) > len(self.buf) || len(pack.events) > 255 {
+		return nil
+	}
+	device, ok := self.held[pack.dev_name]
+	if !ok {
+		device = &remote_held_device{dev_type: pack.dev_type, keys: make(map[uint16]bool)}
+		self.held[pack.dev_name] = device
+	}
+	for _, event := range pack.events {
+		if event.Type == evdev.EventKey {
+			if event.Value == DOWN {
+				device.keys[event.Code] = true
+			} else if event.Value == UP {
+				delete(device.keys, event.Code)
+			}
+		}
+	}
+	length := put_remote_events(self.next_header(remote_kind_events), pack)
+	return self.output(remote_header_size + length)
+}
+
+func put_remote_state_device(payload []byte, name string, device *remote_held_device) int {
+	payload[0] = byte(device.dev_type)
+	payload[1] = byte(len(name))
+	copy(payload[2:], name)
+	offset := 2 + len(name)
+	payload[offset] = byte(len(device.keys))
+	offset++
+	for code := range device.keys {
+		binary.LittleEndian.PutUint16(payload[offset:offset+2], code)
+		offset += 2
+	}
+	return offset
+}
+
+// 全部设备放得下时返回一个完整的按键快照 未列出的设备视为全部松开
+// 否则分为多个部分快照 列出所有设备(包括没有按下按键的) 接收端只修正列出的设备
+// 返回的切片各自独立 可在下一次调用后继续使用
+func (self *remote_sender) state_frames() [][]byte {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	max_payload := len(self.buf) - remote_header_size
+	size, count := 1, 0
+	for name, device := range self.held {
+		if len(device.keys) > 0 {
+			size += 3 + len(name) + len(device.keys)*2
+			count++
+		}
+	}
+	if size <= max_payload && count <= 255 {
+		payload := self.next_header(remote_kind_state)
+		payload[0] = 0
+		offset := 1
+		for name, device := range self.held {
+			if len(device.keys) > 0 {
+				payload[0]++
+				offset += put_remote_state_device(payload[offset:], name, device)
+			}
+		}
+		return [][]byte{append([]byte{}, self.output(remote_header_size+offset)...)}
+	}
+	frames := make([][]byte, 0)
+	var payload []byte
+	offset := 0
+	flush := func() {
+		if payload != nil && payload[0] > 0 {
+			frames = append(frames, append([]byte{}, self.output(remote_header_size+offset)...))
+		}
+		payload = nil
+	}
+	for name, device := range self.held {
+		entry := 3 + len(name) + len(device.keys)*2
+		if 1+entry > max_payload || len(device.keys) > 255 {
+			logger.Warnf("远程按键快照 %s 按下的按键过多 无法发送", name)
+			continue
+		}
+		if payload == nil || offset+entry > len(payload) || payload[0] == 255 {
+			flush()
+			payload = self.next_header(remote_kind_state_part)
+			payload[0] = 0
+			offset = 1
+		}
+		payload[0]++
+		offset += put_remote_state_device(payload[offset:], name, device)
+	}
+	flush()
+	return frames
+}
+
+func (self *remote_sender) touch_frame(pack touch_control_pack) []byte {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	switch pack.action {
+	case TouchActionRequire, TouchActionMove:
+		self.touches[pack.id] = true
+	case TouchActionRelease:
+		delete(self.touches, pack.id)
+	}
+	length := put_remote_touch(self.next_header(remote_kind_touch), pack)
+	return self.output(remote_header_size + length)
+}
+
+// 触点快照 接收端据此释放丢失松开的触点
+func (self *remote_sender) touches_frame() []byte {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	payload := self.next_header(remote_kind_touches)
+	payload[0] = 0
+	offset := 1
+	for id := range self.touches {
+		if payload[0] == 255 {
+			break
+		}
+		payload[0]++
+		binary.LittleEndian.PutUint32(payload[offset:offset+4], uint32(id))
+		offset += 4
+	}
+	return self.output(remote_header_size + offset)
+}
+
+func (self *remote_sender) status_frame(status *remote_status) []byte {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	length := put_remote_status(self.next_header(remote_kind_status), status)
+	return self.output(remote_header_size + length)
+}
+
+// 为所有按下的按键生成松开事件包 切换目标时使用
+func (self *remote_sender) release_all(send func(data []byte)) {
+	self.lock.Lock()
+	packs := make([]*event_pack, 0)
+	for name, device := range self.held {
+		if len(device.keys) == 0 {
+			continue
+		}
+		events := make([]*evdev.Event, 0, len(device.keys))
+		for code := range device.keys {
+			events = append(events, &evdev.Event{Type: evdev.EventKey, Code: code, Value: UP})
+		}
+		packs = append(packs, &event_pack{dev_name: name, dev_type: device.dev_type, events: events})
+	}
+	self.lock.Unlock()
+	for _, pack := range packs {
+		if data := self.events_frame(pack); data != nil {
+			send(data)
+		}
+	}
+}
+
+func (self *remote_sender) beat_frame() []byte {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.next_header(remote_kind_beat)
+	return self.output(remote_header_size)
+}
+
+//---------------------------------接收端--------------------------------------//
+
+type remote_session struct {
+	last_seq  uint32
+	last_seen time.Time
+	held      map[string]*remote_held_device
+	touches   map[int32]bool //-m net 按下的触点
+	reply     remote_reply   //向发送端回复状态 为nil时不回复
+	informed  bool           //已回复过状态
+}
+
+type remote_reply func(frame []byte) error
+
+type remote_ended struct {
+	last_seq uint32
+	time     time.Time
+}
+
+// 处理数据包时产生的按键与触屏输出 在锁内收集 释放锁后再发送 避免阻塞的输出卡住超时检查与其他连接
+type remote_output struct {
+	pack  *event_pack
+	touch *touch_control_pack
+}
+
+type remote_outputs []remote_output
+
+func (self *remote_outputs) keys(name string, device_type dev_type, codes []uint16, up_down int32) {
+	if len(codes) == 0 {
+		return
+	}
+	events := make([]*evdev.Event, 0, len(codes))
+	for _, code := range codes {
+		events = append(events, &evdev.Event{Type: evdev.EventKey, Code: code, Value: up_down})
+	}
+	*self = append(*self, remote_output{pack: &event_pack{dev_name: name, dev_type: device_type, events: events}})
+}
+
+// 按session记录发送端按下的按键 快照与记录不符时补发按键 超时后全部松开
+type remote_receiver struct {
+	lock        sync.Mutex
+	output_lock sync.Mutex            //保持输出的顺序 不与lock同时持有
+	ch          chan *event_pack      //为nil时不接受事件
+	touch       touch_control_func    //为nil时不接受触屏控制
+	status      func() *remote_status //为nil时不回复状态
+	replier     *remote_sender        //编号与签名回复的状态
+	accept_v1   bool
+	cipher      *remote_cipher //不为nil时只接受签名或加密的包
+	sessions    map[uint32]*remote_session
+	ended       map[uint32]*remote_ended //已结束的session 用于拒绝重放 超出时间窗口后清除
+	rejected    int                      //被拒绝的包数量
+	auth_failed int                      //认证失败的包数量
+	lost        int                      //根据seq判断丢失的包数量
+}
+
+func new_remote_receiver(ch chan *event_pack, accept_v1 bool, cipher *remote_cipher) *remote_receiver {
+	if cipher != nil && accept_v1 {
+		logger.Warnf("已设置密钥 v1协议数据包无法认证 将被拒绝")
+	}
+	return &remote_receiver{
+		ch:        ch,
+		accept_v1: accept_v1,
+		cipher:    cipher,
+		sessions:  make(map[uint32]*remote_session),
+		ended:     make(map[uint32]*remote_ended),
+		replier:   new_remote_sender(cipher),
+	}
+}
+
+// 在释放lock后调用
+func (self *remote_receiver) flush(outputs remote_outputs) {
+	if len(outputs) == 0 {
+		return
+	}
+	self.output_lock.Lock()
+	defer self.output_lock.Unlock()
+	for _, output := range outputs {
+		if output.pack != nil {
+			self.ch <- output.pack
+		} else {
+			self.touch(*output.touch)
+		}
+	}
+}
+
+// 处理一个数据包 返回其session 用于连接断开时释放 reply用于向该发送端回复状态
+func (self *remote_receiver) handle(data []byte, reply remote_reply) (uint32, bool) {
+	if self.cipher != nil {
+		opened, err := self.cipher.open(data)
+		if err != nil {
+			self.lock.Lock()
+			self.auth_failed++
+			self.lock.Unlock()
+			logger.Debugf("拒绝远程数据包 : %v", err)
+			return 0, false
+		}
+		data = opened
+	}
+	packet, err := parse_remote_packet(data, self.accept_v1 && self.cipher == nil)
+	if err != nil {
+		self.lock.Lock()
+		self.rejected++
+		self.lock.Unlock()
+		logger.Debugf("丢弃远程数据包 : %v", err)
+		return 0, false
+	}
+	if !self.accept_kind(packet.header) {
+		self.lock.Lock()
+		self.rejected++
+		self.lock.Unlock()
+		logger.Debugf("丢弃远程数据包 : 未启用包类型%d", packet.header.kind)
+		return 0, false
+	}
+	if packet.header.version == 1 {
+		self.flush(remote_outputs{{pack: packet.pack}})
+		return 0, false
+	}
+	outputs := make(remote_outputs, 0, 1)
+	self.lock.Lock()
+	id, ok := self.handle_packet(packet, reply, &outputs)
+	self.lock.Unlock()
+	self.flush(outputs)
+	return id, ok
+}
+
+func (self *remote_receiver) handle_packet(packet *remote_packet, reply remote_reply, outputs *remote_outputs) (uint32, bool) {
+	session, ok := self.sessions[packet.header.session]
+	if !ok {
+		session = &remote_session{last_seq: packet.header.seq - 1, held: make(map[string]*remote_held_device), touches: make(map[int32]bool)}
+		if ended, ok := self.ended[packet.header.session]; ok { //超时后重新连接 不接受之前的seq
+			session.last_seq = ended.last_seq
+		}
+	}
+	if int32(packet.header.seq-session.last_seq) <= 0 { //重复或乱序的旧包
+		self.rejected++
+		return 0, false
+	}
+	if !ok {
+		logger.Infof("远程发送端已连接 session:%08x", packet.header.session)
+		self.sessions[packet.header.session] = session
+	}
+	self.lost += int(packet.header.seq - session.last_seq - 1)
+	session.last_seq = packet.header.seq
+	session.last_seen = time.Now()
+	session.reply = reply
+	switch packet.header.kind {
+	case remote_kind_events:
+		device, ok := session.held[packet.pack.dev_name]
+		if !ok {
+			device = &remote_held_device{dev_type: packet.pack.dev_type, keys: make(map[uint16]bool)}
+			session.held[packet.pack.dev_name] = device
+		}
+		for _, event := range packet.pack.events {
+			if event.Type == evdev.EventKey {
+				if event.Value == DOWN {
+					device.keys[event.Code] = true
+				} else if event.Value == UP {
+					delete(device.keys, event.Code)
+				}
+			}
+		}
+		*outputs = append(*outputs, remote_output{pack: packet.pack})
+	case remote_kind_state, remote_kind_state_part:
+		for name, device := range session.held {
+			if _, listed := packet.state[name]; !listed && packet.header.kind == remote_kind_state_part {
+				continue //部分快照中没有的设备不修正
+			}
+			missed_up := make([]uint16, 0)
+			for code := range device.keys {
+				if target, ok := packet.state[name]; !ok || !target.keys[code] {
+					missed_up = append(missed_up, code)
+					delete(device.keys, code)
+				}
+			}
+			if len(missed_up) > 0 {
+				logger.Debugf("远程按键状态修正 %s 补发松开 %v", name, missed_up)
+			}
+			outputs.keys(name, device.dev_type, missed_up, UP)
+		}
+		for name, target := range packet.state {
+			device, ok := session.held[name]
+			if !ok {
+				device = &remote_held_device{dev_type: target.dev_type, keys: make(map[uint16]bool)}
+				session.held[name] = device
+			}
+			missed_down := make([]uint16, 0)
+			for code := range target.keys {
+				if !device.keys[code] {
+					missed_down = append(missed_down, code)
+					device.keys[code] = true
+				}
+			}
+			if len(missed_down) > 0 {
+				logger.Debugf("远程按键状态修正 %s 补发按下 %v", name, missed_down)
+			}
+			outputs.keys(name, device.dev_type, missed_down, DOWN)
+		}
+	case remote_kind_touch:
+		touch := *packet.touch
+		switch touch.action {
+		case TouchActionRequire, TouchActionMove:
+			if !session.touches[touch.id] {
+				touch.action = TouchActionRequire //按下的包丢失时由移动补发
+			}
+			session.touches[touch.id] = true
+		case TouchActionRelease:
+			if !session.touches[touch.id] {
+				return packet.header.session, true
+			}
+			delete(session.touches, touch.id)
+		}
+		*outputs = append(*outputs, remote_output{touch: &touch})
+	case remote_kind_touches:
+		for id := range session.touches {
+			if !packet.ids[id] {
+				logger.Debugf("远程触点状态修正 补发释放 %d", id)
+				self.release_touch(session, id, outputs)
+			}
+		}
+	}
+	return packet.header.session, true
+}
+
+func (self *remote_receiver) accept_kind(header remote_header) bool {
+	switch header.kind {
+	case remote_kind_touch, remote_kind_touches:
+		return self.touch != nil
+	case remote_kind_beat:
+		return true
+	case remote_kind_status:
+		return false
+	default:
+		return self.ch != nil
+	}
+}
+
+func (self *remote_receiver) release_touch(session *remote_session, id int32, outputs *remote_outputs) {
+	delete(session.touches, id)
+	*outputs = append(*outputs, remote_output{touch: &touch_control_pack{action: TouchActionRelease, id: id}})
+}
+
+func (self *remote_receiver) release_session(id uint32, outputs *remote_outputs) {
+	session := self.sessions[id]
+	for name, device := range session.held {
+		codes := make([]uint16, 0, len(device.keys))
+		for code := range device.keys {
+			codes = append(codes, code)
+		}
+		outputs.keys(name, device.dev_type, codes, UP)
+	}
+	for id := range session.touches {
+		self.release_touch(session, id, outputs)
+	}
+	self.ended[id] = &remote_ended{last_seq: session.last_seq, time: time.Now()}
+	delete(self.sessions, id)
+}
+
+// 连接断开时立即释放其上的发送端
+func (self *remote_receiver) end_sessions(ids map[uint32]bool) {
+	outputs := make(remote_outputs, 0)
+	self.lock.Lock()
+	for id := range ids {
+		if _, ok := self.sessions[id]; ok {
+			logger.Warnf("远程发送端已断开 session:%08x 已释放所有按键", id)
+			self.release_session(id, &outputs)
+		}
+	}
+	self.lock.Unlock()
+	self.flush(outputs)
+}
+
+// 释放超时的发送端 并打印统计
+func (self *remote_receiver) check_timeout() {
+	outputs := make(remote_outputs, 0)
+	self.lock.Lock()
+	defer func() {
+		self.lock.Unlock()
+		self.flush(outputs)
+	}()
+	for id, session := range self.sessions {
+		if time.Since(session.last_seen) > remote_timeout {
+			logger.Warnf("远程发送端超时 session:%08x 已释放所有按键", id)
+			self.release_session(id, &outputs)
+		}
+	}
+	for id, ended := range self.ended { //超出时间窗口的包已无法通过认证 未设置密钥时无法防止重放
+		if time.Since(ended.time) > remote_replay_window+remote_timeout {
+			delete(self.ended, id)
+		}
+	}
+	if self.rejected > 0 || self.lost > 0 || self.auth_failed > 0 {
+		logger.Warnf("远程数据包 拒绝:%d 认证失败:%d 丢失:%d", self.rejected, self.auth_failed, self.lost)
+		self.rejected = 0
+		self.auth_failed = 0
+		self.lost = 0
+	}
+}
+
+// 定时向所有发送端回复状态 状态变化时立即回复
+func (self *remote_receiver) loop_push_status() {
+	ticker := time.NewTicker(remote_status_check)
+	defer ticker.Stop()
+	var last *remote_status
+	last_push := time.Now()
+	for {
+		select {
+		case <-global_close_signal:
+			return
+		case <-ticker.C:
+			status := self.status()
+			self.lock.Lock()
+			replies := make([]remote_reply, 0, len(self.sessions))
+			informed := true //新连接的发送端立即回复
+			for _, session := range self.sessions {
+				if session.reply != nil {
+					replies = append(replies, session.reply)
+					informed = informed && session.informed
+					session.informed = true
+				}
+			}
+			self.lock.Unlock()
+			if informed && status.equal(last) && time.Since(last_push) < remote_status_beat {
+				continue
+			}
+			last = status
+			last_push = time.Now()
+			frame := self.replier.status_frame(status)
+			for _, reply := range replies {
+				if err := reply(frame); err != nil {
+					logger.Debugf("回复状态失败 : %v", err)
+				}
+			}
+		}
+	}
+}
+
+func (self *remote_receiver) loop_check_timeout() {
+	ticker := time.NewTicker(remote_timeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-global_close_signal:
+			return
+		case <-ticker.C:
+			self.check_timeout()
+		}
+	}
+}
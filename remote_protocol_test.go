@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/kenshaw/evdev"
+)
+
+func TestRemoteStateSplit(t *testing.T) {
+	ch := make(chan *event_pack, 256)
+	receiver := new_remote_receiver(ch, false, nil)
+	sender := new_remote_sender(nil)
+	var reply remote_reply //不回复状态
+
+	//每个设备按下8个按键 名称较长 全部设备放不下一个包
+	names := make([]string, 0)
+	for i := 0; i < 8; i++ {
+		name := fmt.Sprintf("%s-%d", strings.Repeat("keyboard", 20), i)
+		names = append(names, name)
+		events := make([]*evdev.Event, 0)
+		for code := uint16(30); code < 38; code++ {
+			events = append(events, &evdev.Event{Type: evdev.EventKey, Code: code, Value: DOWN})
+		}
+		receiver.handle(sender.events_frame(&event_pack{dev_name: name, dev_type: type_keyboard, events: events}), reply)
+	}
+	for len(ch) > 0 {
+		<-ch
+	}
+
+	frames := sender.state_frames()
+	if len(frames) < 2 {
+		t.Fatalf("快照应分为多个包 实际%d个", len(frames))
+	}
+	listed := 0
+	for _, frame := range frames {
+		packet, err := parse_remote_packet(frame, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if packet.header.kind != remote_kind_state_part {
+			t.Fatalf("分开发送时应使用部分快照 实际类型%d", packet.header.kind)
+		}
+		listed += len(packet.state)
+		receiver.handle(frame, reply)
+		if len(ch) > 0 {
+			t.Fatalf("部分快照不应松开未列出设备的按键: %+v", (<-ch).events[0])
+		}
+	}
+	if listed != len(names) {
+		t.Fatalf("部分快照应列出全部%d个设备 实际%d个", len(names), listed)
+	}
+
+	//发送端松开的包丢失 部分快照仍会补发列出设备的松开
+	sender.events_frame(&event_pack{dev_name: names[0], dev_type: type_keyboard, events: []*evdev.Event{{Type: evdev.EventKey, Code: 30, Value: UP}}})
+	for _, frame := range sender.state_frames() {
+		receiver.handle(frame, reply)
+	}
+	if len(ch) != 1 {
+		t.Fatalf("应补发一个松开 实际%d个", len(ch))
+	}
+	pack := <-ch
+	if pack.dev_name != names[0] || len(pack.events) != 1 || pack.events[0].Code != 30 || pack.events[0].Value != UP {
+		t.Fatalf("补发的松开错误: %s %+v", pack.dev_name, pack.events)
+	}
+
+	//放得下时仍使用完整快照
+	small := new_remote_sender(nil)
+	small.events_frame(&event_pack{dev_name: "kbd", dev_type: type_keyboard, events: []*evdev.Event{{Type: evdev.EventKey, Code: 30, Value: DOWN}}})
+	frames = small.state_frames()
+	if len(frames) != 1 {
+		t.Fatalf("完整快照应只有一个包 实际%d个", len(frames))
+	}
+	if packet, err := parse_remote_packet(frames[0], false); err != nil || packet.header.kind != remote_kind_state || len(packet.state) != 1 {
+		t.Fatalf("完整快照错误: %v %+v", err, packet)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// 远程事件的预共享密钥模式
+// 包头后为<timestamp:8byte 小端unix毫秒> 受签名或加密保护 超出remote_replay_window的包被拒绝
+// 认证：包头kind带remote_flag_auth 包尾附加HMAC-SHA256(包头+时间+内容)的前16字节
+// 加密：包头kind带remote_flag_encrypt 时间后为<salt:4byte><AES-GCM密文与tag> nonce为salt+session+seq 包头与时间作为附加数据
+// 时间窗口内依靠session与seq拒绝重放的包 窗口外的包(接收端重启后、其他共用密钥的接收端)由时间拒绝 两端时间需大致同步
+
+const (
+	remote_flag_auth     = uint8(0x40)
+	remote_flag_encrypt  = uint8(0x80)
+	remote_flag_mask     = remote_flag_auth | remote_flag_encrypt
+	remote_mac_size      = 16
+	remote_salt_size     = 4
+	remote_time_size     = 8
+	remote_replay_window = time.Duration(30) * time.Second
+)
+
+type remote_cipher struct {
+	auth_key []byte
+	aead     cipher.AEAD
+	encrypt  bool //发送时加密 接收时只接受加密的包
+}
+
+func derive_remote_key(psk string, usage string) []byte {
+	mac := hmac.New(sha256.New, []byte(psk))
+	mac.Write([]byte(usage))
+	return mac.Sum(nil)
+}
+
+func new_remote_cipher(psk string, encrypt bool) (*remote_cipher, error) {
+	if psk == "" {
+		return nil, fmt.Errorf("密钥为空")
+	}
+	block, err := aes.NewCipher(derive_remote_key(psk, "go-touch-mapper encrypt"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &remote_cipher{
+		auth_key: derive_remote_key(psk, "go-touch-mapper auth"),
+		aead:     aead,
+		encrypt:  encrypt,
+	}, nil
+}
+
+func generate_remote_psk() string {
+	key := make([]byte, 24)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(key)
+}
+
+func (self *remote_cipher) mac(data []byte) []byte {
+	mac := hmac.New(sha256.New, self.auth_key)
+	mac.Write(data)
+	return mac.Sum(nil)[:remote_mac_size]
+}
+
+func (self *remote_cipher) nonce(salt []byte, header []byte) []byte {
+	nonce := make([]byte, 0, self.aead.NonceSize())
+	nonce = append(nonce, salt...)
+	nonce = append(nonce, header[4:12]...) //session+seq
+	return nonce
+}
+
+// 对一个v2数据包签名或加密 返回新的切片
+func (self *remote_cipher) seal(frame []byte) []byte {
+	header := make([]byte, remote_header_size+remote_time_size)
+	copy(header, frame[:remote_header_size])
+	binary.LittleEndian.PutUint64(header[remote_header_size:], uint64(time.Now().UnixNano()/int64(time.Millisecond)))
+	payload := frame[remote_header_size:]
+	if self.encrypt {
+		header[3] |= remote_flag_encrypt
+		salt := make([]byte, remote_salt_size)
+		if _, err := rand.Read(salt); err != nil {
+			panic(err)
+		}
+		result := append(header, salt...)
+		return self.aead.Seal(result, self.nonce(salt, header), payload, header)
+	}
+	header[3] |= remote_flag_auth
+	result := append(header, payload...)
+	return append(result, self.mac(result)...)
+}
+
+// WebSocket连接的握手 接收端发送随机挑战 发送端回复HMAC 证明持有密钥后才处理数据包
+func (self *remote_cipher) challenge_response(challenge []byte) []byte {
+	return self.mac(append([]byte("go-touch-mapper ws challenge"), challenge...))
+}
+
+func check_remote_time(data []byte) error {
+	sent := time.Unix(0, int64(binary.LittleEndian.Uint64(data[remote_header_size:]))*int64(time.Millisecond))
+	if diff := time.Since(sent); diff > remote_replay_window || diff < -remote_replay_window {
+		return fmt.Errorf("数据包时间相差%v 可能是重放或两端时间不同步", diff.Round(time.Second))
+	}
+	return nil
+}
+
+// 校验并还原为不带标记的v2数据包
+func (self *remote_cipher) open(data []byte) ([]byte, error) {
+	if len(data) < remote_header_size+remote_time_size || data[0] != remote_magic_0 || data[1] != remote_magic_1 {
+		return nil, fmt.Errorf("未认证的数据包")
+	}
+	header := data[:remote_header_size+remote_time_size]
+	flags := header[3] & remote_flag_mask
+	result := make([]byte, remote_header_size, len(data))
+	copy(result, header)
+	result[3] &^= remote_flag_mask
+	switch flags {
+	case remote_flag_encrypt:
+		if len(data) < len(header)+remote_salt_size+self.aead.Overhead() {
+			return nil, fmt.Errorf("加密数据包长度不足")
+		}
+		salt := data[len(header) : len(header)+remote_salt_size]
+		plain, err := self.aead.Open(result, self.nonce(salt, header), data[len(header)+remote_salt_size:], header)
+		if err != nil {
+			return nil, fmt.Errorf("解密失败")
+		}
+		if err := check_remote_time(data); err != nil {
+			return nil, err
+		}
+		return plain, nil
+	case remote_flag_auth:
+		if self.encrypt {
+			return nil, fmt.Errorf("已启用加密 拒绝仅认证的数据包")
+		}
+		if len(data) < len(header)+remote_mac_size {
+			return nil, fmt.Errorf("认证数据包长度不足")
+		}
+		body := data[:len(data)-remote_mac_size]
+		if !hmac.Equal(self.mac(body), data[len(data)-remote_mac_size:]) {
+			return nil, fmt.Errorf("认证失败")
+		}
+		if err := check_remote_time(data); err != nil {
+			return nil, err
+		}
+		return append(result, body[len(header):]...), nil
+	default:
+		return nil, fmt.Errorf("未认证的数据包")
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"time"
+)
+
+// 触屏输出转发 -m net
+// 映射在本机(电脑或树莓派)进行 触屏控制通过远程协议发送到运行--touch-receiver的设备 由其本地的触屏方案执行
+// 接收端在连接断开或超时后释放该发送端按下的所有触点 并根据定时发送的触点快照释放丢失松开的触点
+// 接收端的回复需要持续读取 否则tcp与ws连接的接收缓冲区写满后会阻塞接收端
+
+func handel_touch_using_net(client *remote_client) touch_control_func {
+	touch_ch := make(chan touch_control_pack, 64)
+	received_ch := make(chan remote_received)
+	go (func() {
+		dial_remote_async(client.target, client.conn_ch)
+		touches_ticker := time.NewTicker(remote_state_period)
+		defer touches_ticker.Stop()
+		beat_ticker := time.NewTicker(remote_beat_period)
+		defer beat_ticker.Stop()
+		for {
+			select {
+			case <-global_close_signal:
+				if client.conn != nil {
+					client.conn.close()
+				}
+				return
+			case client.conn = <-client.conn_ch:
+				logger.Infof("已连接触屏接收端 %s", client.name)
+				go client.receive_loop(client.conn, received_ch)
+				client.send(client.sender.touches_frame())
+			case received := <-received_ch:
+				if status := client.handle_reply(received.data); status != nil {
+					client.status = status
+				}
+			case pack := <-touch_ch:
+				client.send(client.sender.touch_frame(pack))
+			case <-touches_ticker.C:
+				client.send(client.sender.touches_frame())
+			case <-beat_ticker.C:
+				if time.Since(client.last_send) >= remote_beat_period {
+					client.send(client.sender.beat_frame())
+				}
+			}
+		}
+	})()
+	return func(control_data touch_control_pack) {
+		select {
+		case touch_ch <- control_data:
+		case <-global_close_signal:
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// 远程事件的传输方式 数据包格式与UDP相同
+// tcp: 每个数据包前加<length:2byte 小端>
+// ws:  每个数据包为一条二进制消息 由控制后台的http服务提供 路径为/remote/ws
+//      需要设置密钥 连接后接收端先发送remote_challenge_size字节的挑战 发送端回复challenge_response后才开始传输
+
+const (
+	remote_dial_timeout    = time.Duration(2) * time.Second
+	remote_reconnect_delay = time.Duration(1) * time.Second
+	remote_ws_path         = "/remote/ws"
+	remote_challenge_size  = 16
+)
+
+type remote_conn interface {
+	send(frame []byte) error
+	receive() ([]byte, error) //读取接收端回复的数据包 连接关闭时返回错误
+	close()
+	reliable() bool //流式连接发送失败即视为断开 需要重连
+}
+
+type udp_remote_conn struct {
+	conn *net.UDPConn
+}
+
+func (self *udp_remote_conn) send(frame []byte) error {
+	_, err := self.conn.Write(frame)
+	return err
+}
+
+func (self *udp_remote_conn) receive() ([]byte, error) {
+	buf := make([]byte, remote_max_packet)
+	for {
+		n, err := self.conn.Read(buf)
+		if err == nil {
+			return buf[:n], nil
+		}
+		if errors.Is(err, net.ErrClosed) {
+			return nil, err
+		}
+		time.Sleep(remote_beat_period) //对端未启动时收到的拒绝 等待重试
+	}
+}
+
+func (self *udp_remote_conn) close() {
+	self.conn.Close()
+}
+
+func (self *udp_remote_conn) reliable() bool {
+	return false
+}
+
+type tcp_remote_conn struct {
+	conn net.Conn
+	buf  []byte
+}
+
+func (self *tcp_remote_conn) send(frame []byte) error {
+	self.buf = self.buf[:0]
+	self.buf = append(self.buf, 0, 0)
+	binary.LittleEndian.PutUint16(self.buf, uint16(len(frame)))
+	self.buf = append(self.buf, frame...)
+	self.conn.SetWriteDeadline(time.Now().Add(remote_timeout))
+	_, err := self.conn.Write(self.buf)
+	return err
+}
+
+func (self *tcp_remote_conn) receive() ([]byte, error) {
+	length_buf := make([]byte, 2)
+	if _, err := io.ReadFull(self.conn, length_buf); err != nil {
+		return nil, err
+	}
+	length := int(binary.LittleEndian.Uint16(length_buf))
+	if length > remote_max_packet {
+		return nil, fmt.Errorf("数据包过长 %d", length)
+	}
+	frame := make([]byte, length)
+	if _, err := io.ReadFull(self.conn, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+func (self *tcp_remote_conn) close() {
+	self.conn.Close()
+}
+
+func (self *tcp_remote_conn) reliable() bool {
+	return true
+}
+
+type ws_remote_conn struct {
+	ws *websocket_conn
+}
+
+func (self *ws_remote_conn) send(frame []byte) error {
+	self.ws.conn.SetWriteDeadline(time.Now().Add(remote_timeout))
+	return self.ws.write_message(ws_op_binary, frame)
+}
+
+func (self *ws_remote_conn) receive() ([]byte, error) {
+	for {
+		opcode, data, err := self.ws.read_message()
+		if err != nil {
+			return nil, err
+		}
+		if opcode == ws_op_binary {
+			return data, nil
+		}
+	}
+}
+
+func (self *ws_remote_conn) close() {
+	self.ws.close()
+}
+
+func (self *ws_remote_conn) reliable() bool {
+	return true
+}
+
+func dial_remote(target *remote_target) (remote_conn, error) {
+	address := net.JoinHostPort(target.ip, fmt.Sprint(target.port))
+	switch target.scheme {
+	case "udp":
+		conn, err := net.DialUDP("udp", nil, &net.UDPAddr{
+			IP:   net.ParseIP(target.ip),
+			Port: target.port,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &udp_remote_conn{conn: conn}, nil
+	case "tcp":
+		conn, err := net.DialTimeout("tcp", address, remote_dial_timeout)
+		if err != nil {
+			return nil, err
+		}
+		if tcp_conn, ok := conn.(*net.TCPConn); ok {
+			tcp_conn.SetNoDelay(true)
+		}
+		return &tcp_remote_conn{conn: conn, buf: make([]byte, 0, remote_max_packet+2)}, nil
+	case "ws":
+		cipher, err := new_remote_cipher(target.psk, target.encrypt)
+		if err != nil {
+			return nil, fmt.Errorf("ws传输需要密钥 : %v", err)
+		}
+		ws, err := websocket_dial(address, target.path, remote_dial_timeout)
+		if err != nil {
+			return nil, err
+		}
+		ws.conn.SetDeadline(time.Now().Add(remote_dial_timeout))
+		opcode, challenge, err := ws.read_message()
+		if err == nil && (opcode != ws_op_binary || len(challenge) != remote_challenge_size) {
+			err = fmt.Errorf("无效的挑战")
+		}
+		if err == nil {
+			err = ws.write_message(ws_op_binary, cipher.challenge_response(challenge))
+		}
+		if err != nil {
+			ws.close()
+			return nil, err
+		}
+		ws.conn.SetDeadline(time.Time{})
+		return &ws_remote_conn{ws: ws}, nil
+	}
+	return nil, fmt.Errorf("unsupported scheme %s", target.scheme)
+}
+
+// 在后台连接 结果通过channel返回 避免阻塞事件发送
+func dial_remote_async(target *remote_target, result chan remote_conn) {
+	go func() {
+		for {
+			conn, err := dial_remote(target)
+			if err == nil {
+				result <- conn
+				return
+			}
+			logger.Debugf("连接%s失败 : %v", target.scheme, err)
+			select {
+			case <-global_close_signal:
+				return
+			case <-time.After(remote_reconnect_delay):
+			}
+		}
+	}()
+}
+
+//---------------------------------接收端--------------------------------------//
+
+func tcp_event_injector(receiver *remote_receiver, port int) {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		logger.Errorf("tcp error : %v", err)
+		return
+	}
+	go func() {
+		<-global_close_signal
+		listener.Close()
+	}()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-global_close_signal:
+			default:
+				logger.Errorf("tcp accept error : %v", err)
+			}
+			return
+		}
+		go handel_tcp_remote_conn(receiver, conn)
+	}
+}
+
+func handel_tcp_remote_conn(receiver *remote_receiver, conn net.Conn) {
+	defer conn.Close()
+	logger.Infof("远程TCP连接 : %s", conn.RemoteAddr())
+	sessions := make(map[uint32]bool)
+	defer receiver.end_sessions(sessions)
+	length_buf := make([]byte, 2)
+	reply := &tcp_remote_conn{conn: conn, buf: make([]byte, 0, remote_max_packet+2)} //回复状态 格式与发送端相同
+	for {
+		conn.SetReadDeadline(time.Now().Add(remote_timeout))
+		if _, err := io.ReadFull(conn, length_buf); err != nil {
+			logger.Infof("远程TCP连接断开 : %s", conn.RemoteAddr())
+			return
+		}
+		length := int(binary.LittleEndian.Uint16(length_buf))
+		if length > remote_max_packet {
+			logger.Warnf("远程TCP数据包过长 %d 断开连接 : %s", length, conn.RemoteAddr())
+			return
+		}
+		frame := make([]byte, length)
+		if _, err := io.ReadFull(conn, frame); err != nil {
+			logger.Infof("远程TCP连接断开 : %s", conn.RemoteAddr())
+			return
+		}
+		if session, ok := receiver.handle(frame, reply.send); ok {
+			sessions[session] = true
+		}
+	}
+}
+
+// 在控制后台的http服务上注册WebSocket接收端 需在serve之前调用 未设置密钥时不注册
+func register_remote_websocket(receiver *remote_receiver) {
+	if receiver.cipher == nil {
+		logger.Warnf("未设置--psk 不启用WebSocket接收端")
+		return
+	}
+	http.HandleFunc(remote_ws_path, func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket_upgrade(w, r)
+		if err != nil {
+			logger.Debugf("websocket upgrade error : %v", err)
+			return
+		}
+		defer ws.close()
+		challenge := make([]byte, remote_challenge_size)
+		if _, err := rand.Read(challenge); err != nil {
+			return
+		}
+		ws.conn.SetDeadline(time.Now().Add(remote_timeout))
+		if err := ws.write_message(ws_op_binary, challenge); err != nil {
+			return
+		}
+		opcode, response, err := ws.read_message()
+		if err != nil || opcode != ws_op_binary || !hmac.Equal(response, receiver.cipher.challenge_response(challenge)) {
+			logger.Warnf("远程WebSocket连接认证失败 : %s", r.RemoteAddr)
+			return
+		}
+		ws.conn.SetDeadline(time.Time{})
+		logger.Infof("远程WebSocket连接 : %s", r.RemoteAddr)
+		sessions := make(map[uint32]bool)
+		defer receiver.end_sessions(sessions)
+		reply := &ws_remote_conn{ws: ws}
+		for {
+			ws.conn.SetReadDeadline(time.Now().Add(remote_timeout))
+			opcode, data, err := ws.read_message()
+			if err != nil {
+				logger.Infof("远程WebSocket连接断开 : %s", r.RemoteAddr)
+				return
+			}
+			if opcode != ws_op_binary {
+				continue
+			}
+			if session, ok := receiver.handle(data, reply.send); ok {
+				sessions[session] = true
+			}
+		}
+	})
+}
+
+// 触屏接收端不启动控制后台 单独在控制后台的端口上提供ws传输
+func serve_remote_websocket(receiver *remote_receiver, port int) {
+	if receiver.cipher == nil {
+		logger.Warnf("未设置--psk 不启用WebSocket接收端")
+		return
+	}
+	register_remote_websocket(receiver)
+	logger.Infof("WebSocket接收端 ws://:%d%s", port, remote_ws_path)
+	if err := http.ListenAndServe(fmt.Sprintf(":%v", port), nil); err != nil {
+		logger.Errorf("WebSocket接收端启动失败: %v", err)
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 触屏输出到scrcpy-server -m scrcpy
+// 按scrcpy控制协议发送INJECT_TOUCH_EVENT 支持多触点、压力与屏幕尺寸
+// 未指定--scrcpy-target时在本机使用app_process启动scrcpy-server(仅开启控制)
+// 指定时连接已运行的scrcpy-server 例如 adb forward tcp:27183 localabstract:scrcpy 后使用 127.0.0.1:27183
+// 服务端发送的dummy byte、设备信息与剪贴板等消息全部读取后丢弃
+
+const (
+	scrcpy_type_inject_touch_event = 2
+
+	scrcpy_action_down = 0
+	scrcpy_action_up   = 1
+	scrcpy_action_move = 2
+
+	scrcpy_touch_event_length        = 32 //2.4起增加了action_button
+	scrcpy_touch_event_legacy_length = 28
+
+	scrcpy_default_port   = 27183
+	scrcpy_default_server = "/data/local/tmp/scrcpy-server.jar"
+	scrcpy_start_timeout  = time.Duration(5) * time.Second
+)
+
+type scrcpy_client struct {
+	network string //tcp 或 unix
+	address string
+	server  string //为空表示连接已运行的scrcpy-server
+	version string
+	legacy  bool //2.4之前的版本没有action_button
+	name    string
+	lock    sync.Mutex //cmd在连接协程与退出时都会修改
+	cmd     *exec.Cmd
+	conn    net.Conn
+	conn_ch chan net.Conn
+	touches map[int32]touch_control_pack //按下中的触点 重新连接后再次按下
+	buffer  []byte
+}
+
+// 解析scrcpy-server地址 支持 IP[:PORT] tcp://IP[:PORT] @name localabstract:name
+func parse_scrcpy_target(target string) (string, string, error) {
+	switch {
+	case strings.HasPrefix(target, "@"):
+		return "unix", target, nil
+	case strings.HasPrefix(target, "localabstract:"):
+		return "unix", "@" + strings.TrimPrefix(target, "localabstract:"), nil
+	}
+	target = strings.TrimPrefix(target, "tcp://")
+	if target == "" {
+		return "", "", fmt.Errorf("地址为空")
+	}
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		target = net.JoinHostPort(target, strconv.Itoa(scrcpy_default_port))
+	}
+	return "tcp", target, nil
+}
+
+// 版本号低于2.4时使用28字节的触屏消息
+func is_scrcpy_legacy_version(version string) (bool, error) {
+	parts := strings.SplitN(version, ".", 3)
+	if len(parts) < 2 {
+		return false, fmt.Errorf("无效的scrcpy版本 %s", version)
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return false, fmt.Errorf("无效的scrcpy版本 %s", version)
+	}
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return false, fmt.Errorf("无效的scrcpy版本 %s", version)
+	}
+	return major < 2 || (major == 2 && minor < 4), nil
+}
+
+func new_scrcpy_client(target string, server string, version string) (*scrcpy_client, error) {
+	legacy, err := is_scrcpy_legacy_version(version)
+	if err != nil {
+		return nil, err
+	}
+	client := &scrcpy_client{
+		version: version,
+		legacy:  legacy,
+		conn_ch: make(chan net.Conn),
+		touches: make(map[int32]touch_control_pack),
+		buffer:  make([]byte, scrcpy_touch_event_length),
+	}
+	if legacy {
+		client.buffer = client.buffer[:scrcpy_touch_event_legacy_length]
+	}
+	if target != "" {
+		client.network, client.address, err = parse_scrcpy_target(target)
+		if err != nil {
+			return nil, err
+		}
+		client.name = target
+	} else {
+		if server == "" {
+			server = scrcpy_default_server
+		}
+		if _, err := os.Stat(server); err != nil {
+			return nil, fmt.Errorf("找不到scrcpy-server %s", server)
+		}
+		client.server = server
+		client.network = "unix"
+		client.name = server
+	}
+	return client, nil
+}
+
+// 启动本机的scrcpy-server 每次使用新的scid 监听 localabstract:scrcpy_<scid>
+func (self *scrcpy_client) start_server() error {
+	scid := fmt.Sprintf("%08x", rand.Uint32()&0x7fffffff)
+	self.address = "@scrcpy_" + scid
+	cmd := exec.Command("app_process", "/", "com.genymobile.scrcpy.Server", self.version,
+		"scid="+scid, "log_level=warn", "tunnel_forward=true", "video=false", "audio=false", "control=true")
+	cmd.Env = append(os.Environ(), "CLASSPATH="+self.server)
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	self.cmd = cmd
+	go cmd.Wait()
+	return nil
+}
+
+func (self *scrcpy_client) stop_server() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.cmd != nil {
+		self.cmd.Process.Kill()
+		self.cmd = nil
+	}
+}
+
+func (self *scrcpy_client) connect() (net.Conn, error) {
+	if self.server == "" {
+		return net.DialTimeout(self.network, self.address, remote_reconnect_delay)
+	}
+	self.stop_server()
+	if err := self.start_server(); err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(scrcpy_start_timeout)
+	for { //等待scrcpy-server开始监听
+		conn, err := net.Dial(self.network, self.address)
+		if err == nil {
+			return conn, nil
+		}
+		if time.Now().After(deadline) {
+			self.stop_server()
+			return nil, err
+		}
+		select {
+		case <-global_close_signal:
+			self.stop_server()
+			return nil, err
+		case <-time.After(time.Millisecond * 100):
+		}
+	}
+}
+
+func (self *scrcpy_client) connect_async(result chan net.Conn) {
+	go func() {
+		for {
+			conn, err := self.connect()
+			if err == nil {
+				go io.Copy(ioutil.Discard, conn) //dummy byte、设备信息与设备消息
+				select {
+				case result <- conn:
+				case <-global_close_signal:
+					conn.Close()
+				}
+				return
+			}
+			logger.Debugf("连接scrcpy-server失败 : %v", err)
+			select {
+			case <-global_close_signal:
+				return
+			case <-time.After(remote_reconnect_delay):
+			}
+		}
+	}()
+}
+
+// 与inputManager相同 按当前方向换算为屏幕坐标
+func scrcpy_touch_position(pack touch_control_pack) (int32, int32, uint16, uint16) {
+	width, height := pack.screen_x, pack.screen_y
+	if orientation := global_orientation.current(); orientation == 0 || orientation == 2 {
+		width, height = pack.screen_y, pack.screen_x
+	}
+	x := int32(int64(pack.x) * int64(width) / 0x7ffffffe)
+	y := int32(int64(pack.y) * int64(height) / 0x7ffffffe)
+	return x, y, uint16(width), uint16(height)
+}
+
+// pressure为1-255 0表示未指定 按下与移动时使用1.0
+func scrcpy_touch_pressure(action byte, pressure int32) uint16 {
+	if action == scrcpy_action_up {
+		return 0
+	}
+	if pressure <= 0 || pressure >= 255 {
+		return 0xffff
+	}
+	return uint16(pressure * 0xffff / 255)
+}
+
+func (self *scrcpy_client) encode(action byte, pack touch_control_pack) []byte {
+	buf := self.buffer
+	x, y, width, height := scrcpy_touch_position(pack)
+	buf[0] = scrcpy_type_inject_touch_event
+	buf[1] = action
+	binary.BigEndian.PutUint64(buf[2:], uint64(pack.id))
+	binary.BigEndian.PutUint32(buf[10:], uint32(x))
+	binary.BigEndian.PutUint32(buf[14:], uint32(y))
+	binary.BigEndian.PutUint16(buf[18:], width)
+	binary.BigEndian.PutUint16(buf[20:], height)
+	binary.BigEndian.PutUint16(buf[22:], scrcpy_touch_pressure(action, pack.pressure))
+	if self.legacy {
+		binary.BigEndian.PutUint32(buf[24:], 0) //buttons
+	} else {
+		binary.BigEndian.PutUint32(buf[24:], 0) //action_button
+		binary.BigEndian.PutUint32(buf[28:], 0) //buttons
+	}
+	return buf
+}
+
+func (self *scrcpy_client) send(action byte, pack touch_control_pack) {
+	if self.conn == nil {
+		return
+	}
+	if _, err := self.conn.Write(self.encode(action, pack)); err != nil {
+		logger.Warnf("scrcpy-server连接断开 : %v", err)
+		self.conn.Close()
+		self.conn = nil
+		self.connect_async(self.conn_ch)
+	}
+}
+
+func (self *scrcpy_client) handel(pack touch_control_pack) {
+	switch pack.action {
+	case TouchActionRequire:
+		self.touches[pack.id] = pack
+		self.send(scrcpy_action_down, pack)
+	case TouchActionMove:
+		if _, ok := self.touches[pack.id]; ok {
+			self.touches[pack.id] = pack
+			self.send(scrcpy_action_move, pack)
+		}
+	case TouchActionRelease:
+		if last, ok := self.touches[pack.id]; ok {
+			delete(self.touches, pack.id)
+			self.send(scrcpy_action_up, last)
+		}
+	}
+}
+
+func handel_touch_using_scrcpy(client *scrcpy_client) touch_control_func {
+	touch_ch := make(chan touch_control_pack, 64)
+	go (func() {
+		client.connect_async(client.conn_ch)
+		for {
+			select {
+			case <-global_close_signal:
+				if client.conn != nil {
+					client.conn.Close()
+				}
+				client.stop_server()
+				return
+			case client.conn = <-client.conn_ch:
+				logger.Infof("已连接scrcpy-server %s", client.name)
+				for _, pack := range client.touches { //断开期间按下的触点
+					client.send(scrcpy_action_down, pack)
+				}
+			case pack := <-touch_ch:
+				client.handel(pack)
+			}
+		}
+	})()
+	return func(control_data touch_control_pack) {
+		select {
+		case touch_ch <- control_data:
+		case <-global_close_signal:
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// 在本机监听模拟已运行的scrcpy-server 通过--scrcpy-target的方式连接
+func connect_fake_scrcpy_server(t *testing.T, version string) (*scrcpy_client, net.Conn) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("无法监听本地端口: %v", err)
+	}
+	defer listener.Close()
+	client, err := new_scrcpy_client(listener.Addr().String(), "", version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+	client.conn, err = client.connect()
+	if err != nil {
+		t.Fatalf("连接模拟的scrcpy-server失败: %v", err)
+	}
+	server, ok := <-accepted
+	if !ok {
+		t.Fatal("模拟的scrcpy-server未收到连接")
+	}
+	t.Cleanup(func() {
+		client.conn.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+type scrcpy_test_event struct {
+	action, width, height, pressure uint16
+	pointer                         uint64
+	x, y                            uint32
+}
+
+func read_scrcpy_event(t *testing.T, server net.Conn, length int) scrcpy_test_event {
+	t.Helper()
+	buf := make([]byte, length)
+	server.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := io.ReadFull(server, buf); err != nil {
+		t.Fatalf("读取触屏消息失败: %v", err)
+	}
+	if buf[0] != scrcpy_type_inject_touch_event {
+		t.Fatalf("消息类型错误: %v", buf)
+	}
+	for _, b := range buf[24:] { //action_button与buttons
+		if b != 0 {
+			t.Fatalf("按键字段应为0: %v", buf)
+		}
+	}
+	return scrcpy_test_event{
+		action:   uint16(buf[1]),
+		pointer:  binary.BigEndian.Uint64(buf[2:10]),
+		x:        binary.BigEndian.Uint32(buf[10:14]),
+		y:        binary.BigEndian.Uint32(buf[14:18]),
+		width:    binary.BigEndian.Uint16(buf[18:20]),
+		height:   binary.BigEndian.Uint16(buf[20:22]),
+		pressure: binary.BigEndian.Uint16(buf[22:24]),
+	}
+}
+
+func TestScrcpyTouchEvents(t *testing.T) {
+	orientation := global_orientation.current()
+	defer set_device_orientation(orientation, "test")
+	set_device_orientation(0, "test")
+
+	for _, test := range []struct {
+		version string
+		length  int
+	}{
+		{"2.3", scrcpy_touch_event_legacy_length},
+		{"2.4", scrcpy_touch_event_length},
+		{"3.1", scrcpy_touch_event_length},
+	} {
+		client, server := connect_fake_scrcpy_server(t, test.version)
+		//竖屏时SCREEN的SIZE为[长边, 短边] 宽为短边
+		client.handel(touch_control_pack{action: TouchActionRequire, id: 7, x: 0x7ffffffe / 2, y: 0x7ffffffe / 2, screen_x: 2400, screen_y: 1080})
+		event := read_scrcpy_event(t, server, test.length)
+		if event.action != scrcpy_action_down || event.pointer != 7 || event.x != 540 || event.y != 1200 || event.width != 1080 || event.height != 2400 {
+			t.Fatalf("v%s 按下消息错误: %+v", test.version, event)
+		}
+		if event.pressure != 0xffff {
+			t.Fatalf("v%s 未指定的压力应为0xffff: %#x", test.version, event.pressure)
+		}
+
+		client.handel(touch_control_pack{action: TouchActionMove, id: 7, x: 0, y: 0x7ffffffe, screen_x: 2400, screen_y: 1080, pressure: 128})
+		event = read_scrcpy_event(t, server, test.length)
+		if event.action != scrcpy_action_move || event.pointer != 7 || event.x != 0 || event.y != 2400 || event.pressure != 0x8080 {
+			t.Fatalf("v%s 移动消息错误: %+v", test.version, event)
+		}
+
+		//松开时使用最后的位置 压力为0
+		client.handel(touch_control_pack{action: TouchActionRelease, id: 7})
+		event = read_scrcpy_event(t, server, test.length)
+		if event.action != scrcpy_action_up || event.pointer != 7 || event.y != 2400 || event.width != 1080 || event.pressure != 0 {
+			t.Fatalf("v%s 松开消息错误: %+v", test.version, event)
+		}
+
+		//未按下的触点不发送
+		client.handel(touch_control_pack{action: TouchActionMove, id: 8, screen_x: 2400, screen_y: 1080})
+		client.handel(touch_control_pack{action: TouchActionRelease, id: 8})
+		server.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		if n, _ := server.Read(make([]byte, 1)); n != 0 {
+			t.Fatalf("v%s 不应发送未按下的触点", test.version)
+		}
+	}
+
+	//横屏时宽为长边
+	set_device_orientation(1, "test")
+	client, server := connect_fake_scrcpy_server(t, "2.4")
+	client.handel(touch_control_pack{action: TouchActionRequire, id: 1, x: 0x7ffffffe, y: 0x7ffffffe / 2, screen_x: 2400, screen_y: 1080})
+	event := read_scrcpy_event(t, server, scrcpy_touch_event_length)
+	if event.x != 2400 || event.y != 540 || event.width != 2400 || event.height != 1080 {
+		t.Fatalf("横屏按下消息错误: %+v", event)
+	}
+}
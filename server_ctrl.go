@@ -16,6 +16,7 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"strconv"
 	"sync"
 )
 
@@ -140,6 +141,34 @@ func serve(port int, mapperFilePath string, reloadConfigureFunc func(mapperFileP
 		logger.Info("配置文件已更新并重新加载")
 	})
 
+	http.HandleFunc("/orientation/get", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int32{"orientation": global_orientation.current()})
+	})
+	http.HandleFunc("/orientation/set", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "仅支持POST请求", http.StatusMethodNotAllowed)
+			return
+		}
+		orientation, err := strconv.Atoi(r.FormValue("orientation"))
+		if err != nil || !set_device_orientation(int32(orientation), "控制后台") {
+			http.Error(w, "方向参数错误 可用选值有 0(竖屏) 1(横屏) 2(反向竖屏) 3(反向横屏)", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte("屏幕方向已设置"))
+	})
+
+	http.HandleFunc("/remote/discover", func(w http.ResponseWriter, r *http.Request) {
+		receivers, err := discover_remote_receivers(remote_discovery_timeout)
+		if err != nil {
+			http.Error(w, "搜索接收端失败", http.StatusInternalServerError)
+			logger.Errorf("搜索接收端失败: %v", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(receivers)
+	})
+
 	interfaces, err := net.Interfaces()
 	if err != nil {
 		panic(err)
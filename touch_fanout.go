@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bitly/go-simplejson"
+)
+
+// 触屏输出分发 -m uinput+record:/sdcard/touch.log 或 -m outputs:/path/outputs.json
+// 第一个输出为主输出 在调用方直接执行 其余输出各自使用一个协程与队列 慢的输出不会阻塞主输出
+// 队列积压超过fanout_queue_limit时丢弃该输出的移动 按下与松开始终保留
+// 文件中OUTPUTS的每一项: {"MODE": "otg", "ARG": "", "TRANSFORM": {"ROTATE": 1, "FLIP_X": false, "FLIP_Y": false, "REGION": [0, 0, 1, 1], "SIZE": [1920, 1080]}}
+
+const (
+	fanout_queue_limit = 256
+	fanout_warn_period = 5 * time.Second
+	touch_outputs_mode = "outputs"
+	touch_record_mode  = "record"
+)
+
+// 输出的坐标变换 依次为旋转、翻转、映射到区域 均作用于归一化坐标
+type touch_transform struct {
+	rotate int        //顺时针旋转90度的次数
+	flip_x bool       //左右翻转
+	flip_y bool       //上下翻转
+	region [4]float64 //x0 y0 x1 y1 比例
+	size   [2]int32   //屏幕尺寸 0表示不修改
+}
+
+type touch_output struct {
+	mode      string
+	arg       string
+	transform *touch_transform //nil表示不变换
+}
+
+func (self *touch_output) String() string {
+	if self.arg == "" {
+		return self.mode
+	}
+	return self.mode + ":" + self.arg
+}
+
+func (self *touch_transform) apply(pack touch_control_pack) touch_control_pack {
+	if self.size[0] > 0 && self.size[1] > 0 {
+		pack.screen_x, pack.screen_y = self.size[0], self.size[1]
+	}
+	switch pack.action {
+	case TouchActionRequire, TouchActionMove:
+		x, y := pack.x, pack.y
+		switch self.rotate {
+		case 1:
+			x, y = 0x7ffffffe-y, x
+		case 2:
+			x, y = 0x7ffffffe-x, 0x7ffffffe-y
+		case 3:
+			x, y = y, 0x7ffffffe-x
+		}
+		if self.flip_x {
+			x = 0x7ffffffe - x
+		}
+		if self.flip_y {
+			y = 0x7ffffffe - y
+		}
+		pack.x = int32(self.region[0]*0x7ffffffe + float64(x)*(self.region[2]-self.region[0]))
+		pack.y = int32(self.region[1]*0x7ffffffe + float64(y)*(self.region[3]-self.region[1]))
+	case TouchActionResetResolution:
+		if self.size[0] > 0 && self.size[1] > 0 {
+			pack.x, pack.y = self.size[0], self.size[1]
+		} else if self.rotate%2 == 1 {
+			pack.x, pack.y = pack.y, pack.x
+		}
+	}
+	return pack
+}
+
+func parse_touch_transform(config *simplejson.Json) (*touch_transform, error) {
+	if _, ok := config.CheckGet("TRANSFORM"); !ok {
+		return nil, nil
+	}
+	transform_config := config.Get("TRANSFORM")
+	transform := &touch_transform{
+		rotate: transform_config.Get("ROTATE").MustInt(0),
+		flip_x: transform_config.Get("FLIP_X").MustBool(false),
+		flip_y: transform_config.Get("FLIP_Y").MustBool(false),
+		region: [4]float64{0, 0, 1, 1},
+	}
+	if transform.rotate < 0 || transform.rotate > 3 {
+		return nil, fmt.Errorf("ROTATE只能为0-3")
+	}
+	if region := transform_config.Get("REGION").MustArray(); len(region) > 0 {
+		if len(region) != 4 {
+			return nil, fmt.Errorf("REGION需要4个数值 [x0, y0, x1, y1]")
+		}
+		for i := range transform.region {
+			value, err := transform_config.Get("REGION").GetIndex(i).Float64()
+			if err != nil || value < 0 || value > 1 {
+				return nil, fmt.Errorf("REGION的数值应为0-1之间的比例")
+			}
+			transform.region[i] = value
+		}
+		if transform.region[2] < transform.region[0] || transform.region[3] < transform.region[1] {
+			return nil, fmt.Errorf("REGION的x1 y1不能小于x0 y0")
+		}
+	}
+	if size := transform_config.Get("SIZE").MustArray(); len(size) > 0 {
+		if len(size) != 2 {
+			return nil, fmt.Errorf("SIZE需要2个数值 [width, height]")
+		}
+		transform.size[0] = int32(transform_config.Get("SIZE").GetIndex(0).MustInt())
+		transform.size[1] = int32(transform_config.Get("SIZE").GetIndex(1).MustInt())
+	}
+	return transform, nil
+}
+
+// 解析-m参数 多个输出以+分隔 每个输出为 模式[:参数]
+func parse_touch_outputs(mode string) ([]*touch_output, error) {
+	if mode == touch_outputs_mode || strings.HasPrefix(mode, touch_outputs_mode+":") {
+		path := strings.TrimPrefix(strings.TrimPrefix(mode, touch_outputs_mode), ":")
+		if path == "" {
+			return nil, fmt.Errorf("需要指定输出配置文件 例如-m outputs:./outputs.json")
+		}
+		return load_touch_outputs_file(path)
+	}
+	outputs := make([]*touch_output, 0)
+	for _, item := range strings.Split(mode, "+") {
+		output := &touch_output{}
+		if i := strings.Index(item, ":"); i >= 0 {
+			output.mode, output.arg = item[:i], item[i+1:]
+		} else {
+			output.mode = item
+		}
+		if output.mode == "" {
+			return nil, fmt.Errorf("无效的输出 %s", mode)
+		}
+		outputs = append(outputs, output)
+	}
+	return outputs, nil
+}
+
+// 读取文件中的OUTPUTS 可以直接写在映射配置文件中
+func load_touch_outputs_file(path string) ([]*touch_output, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config, err := simplejson.NewJson(content)
+	if err != nil {
+		return nil, err
+	}
+	outputs := make([]*touch_output, 0)
+	for i := range config.Get("OUTPUTS").MustArray() {
+		output_config := config.Get("OUTPUTS").GetIndex(i)
+		output := &touch_output{
+			mode: output_config.Get("MODE").MustString(""),
+			arg:  output_config.Get("ARG").MustString(""),
+		}
+		if output.mode == "" || output.mode == touch_outputs_mode {
+			return nil, fmt.Errorf("OUTPUTS[%d] 无效的MODE", i)
+		}
+		if output.transform, err = parse_touch_transform(output_config); err != nil {
+			return nil, fmt.Errorf("OUTPUTS[%d] %v", i, err)
+		}
+		outputs = append(outputs, output)
+	}
+	if len(outputs) == 0 {
+		return nil, fmt.Errorf("%s 中没有OUTPUTS", path)
+	}
+	return outputs, nil
+}
+
+// 创建非主输出使用的触屏方案 不处理键鼠与屏幕方向 参数未指定时使用对应的命令行参数
+type touch_sink_options struct {
+	clone_touch  bool
+	touch_device string
+	display_id   int
+	tty_path     string
+	net_target   string
+	psk          string
+	encrypt      bool
+
+	scrcpy_target  string
+	scrcpy_server  string
+	scrcpy_version string
+}
+
+func create_touch_sink(output *touch_output, options *touch_sink_options) (touch_control_func, error) {
+	switch output.mode {
+	case "uinput":
+		return handel_touch_using_uinput_touch(get_clone_touch_index(options.clone_touch || output.arg == "clone", options.touch_device)), nil
+	case "inputmanager":
+		display_id := options.display_id
+		if output.arg != "" {
+			if _, err := fmt.Sscanf(output.arg, "%d", &display_id); err != nil {
+				return nil, fmt.Errorf("无效的显示器ID %s", output.arg)
+			}
+		}
+		return handel_touch_using_input_manager(display_id), nil
+	case "hid":
+		path := output.arg
+		if path == "" {
+			path = options.tty_path
+		}
+		if path == hid_auto_path || path == hid_auto_all_path {
+			found, err := find_hid_tty_path(path == hid_auto_all_path)
+			if err != nil {
+				return nil, err
+			}
+			path = found
+		}
+		if path == "" {
+			return nil, fmt.Errorf("hid输出需要指定串口 例如hid:/dev/ttyACM0")
+		}
+		return handel_touch_using_hid_manager(path), nil
+	case "otg":
+		return handel_touch_using_otg_manager(), nil
+	case "direct":
+		device := output.arg
+		if device == "" {
+			device = options.touch_device
+		}
+		return handel_touch_using_direct_touch(get_direct_touch_index(device)), nil
+	case "net":
+		target := output.arg
+		if target == "" {
+			target = options.net_target
+		}
+		if target == "" {
+			return nil, fmt.Errorf("net输出需要指定接收端 例如net:192.168.1.64")
+		}
+		if !strings.Contains(target, "://") {
+			target = "tcp://" + target
+		}
+		client, err := new_remote_client(target, options.psk, options.encrypt)
+		if err != nil {
+			return nil, err
+		}
+		return handel_touch_using_net(client), nil
+	case "scrcpy":
+		target := output.arg
+		if target == "" {
+			target = options.scrcpy_target
+		}
+		client, err := new_scrcpy_client(target, options.scrcpy_server, options.scrcpy_version)
+		if err != nil {
+			return nil, err
+		}
+		return handel_touch_using_scrcpy(client), nil
+	case touch_record_mode:
+		return handel_touch_using_record(output.arg)
+	}
+	return nil, fmt.Errorf("未知的输出%s", output.mode)
+}
+
+// 记录所有触屏控制 每行为 <unix毫秒> <action> <id> <x> <y> <pressure> <size> <screen_x> <screen_y> <tool>
+// action: 0按下 1松开 2移动 3分辨率(x y为屏幕尺寸)
+func handel_touch_using_record(path string) (touch_control_func, error) {
+	if path == "" {
+		return nil, fmt.Errorf("record输出需要指定文件 例如record:/sdcard/touch.log")
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	logger.Infof("触屏控制将记录到 %s", path)
+	var lock sync.Mutex
+	writer := bufio.NewWriter(file)
+	closed := false
+	go func() {
+		<-global_close_signal
+		lock.Lock()
+		defer lock.Unlock()
+		closed = true
+		writer.Flush()
+		file.Close()
+	}()
+	return func(control_data touch_control_pack) {
+		lock.Lock()
+		defer lock.Unlock()
+		if closed {
+			return
+		}
+		fmt.Fprintf(writer, "%d %d %d %d %d %d %d %d %d %d\n", time.Now().UnixNano()/int64(time.Millisecond),
+			control_data.action, control_data.id, control_data.x, control_data.y,
+			control_data.pressure, control_data.size, control_data.screen_x, control_data.screen_y, control_data.tool)
+		writer.Flush()
+	}, nil
+}
+
+type fanout_sink struct {
+	name      string
+	touch     touch_control_func
+	transform *touch_transform
+	lock      sync.Mutex
+	queue     []touch_control_pack
+	signal    chan bool
+	dropped   int
+}
+
+func (self *fanout_sink) push(pack touch_control_pack) {
+	self.lock.Lock()
+	if len(self.queue) >= fanout_queue_limit && pack.action == TouchActionMove {
+		self.dropped++
+		self.lock.Unlock()
+		return
+	}
+	self.queue = append(self.queue, pack)
+	self.lock.Unlock()
+	select {
+	case self.signal <- true:
+	default:
+	}
+}
+
+func (self *fanout_sink) loop() {
+	last_warn := time.Time{}
+	for {
+		select {
+		case <-global_close_signal:
+			return
+		case <-self.signal:
+		}
+		self.lock.Lock()
+		queue := self.queue
+		self.queue = nil
+		dropped := self.dropped
+		if dropped > 0 && time.Since(last_warn) > fanout_warn_period {
+			self.dropped = 0
+			last_warn = time.Now()
+		} else {
+			dropped = 0
+		}
+		self.lock.Unlock()
+		if dropped > 0 {
+			logger.Warnf("输出%s处理过慢 已丢弃%d个移动", self.name, dropped)
+		}
+		for _, pack := range queue {
+			if self.transform != nil {
+				pack = self.transform.apply(pack)
+			}
+			self.touch(pack)
+		}
+	}
+}
+
+func handel_touch_using_fanout(primary touch_control_func, primary_transform *touch_transform, outputs []*touch_output, options *touch_sink_options) touch_control_func {
+	sinks := make([]*fanout_sink, 0, len(outputs))
+	for _, output := range outputs {
+		touch, err := create_touch_sink(output, options)
+		if err != nil {
+			logger.Errorf("创建输出%s失败: %v", output, err)
+			os.Exit(1)
+		}
+		sink := &fanout_sink{
+			name:      output.String(),
+			touch:     touch,
+			transform: output.transform,
+			signal:    make(chan bool, 1),
+		}
+		go sink.loop()
+		sinks = append(sinks, sink)
+		logger.Infof("触屏控制同时输出到 %s", sink.name)
+	}
+	return func(control_data touch_control_pack) {
+		for _, sink := range sinks {
+			sink.push(control_data)
+		}
+		if primary_transform != nil {
+			control_data = primary_transform.apply(control_data)
+		}
+		primary(control_data)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/bitly/go-simplejson"
+)
+
+const touch_max = 0x7ffffffe
+
+func TestTouchTransformApply(t *testing.T) {
+	full := [4]float64{0, 0, 1, 1}
+	for _, test := range []struct {
+		name      string
+		transform touch_transform
+		in        touch_control_pack
+		want      touch_control_pack
+	}{
+		{"不变换", touch_transform{region: full},
+			touch_control_pack{action: TouchActionRequire, x: 100, y: 200},
+			touch_control_pack{action: TouchActionRequire, x: 100, y: 200}},
+		{"旋转1", touch_transform{rotate: 1, region: full},
+			touch_control_pack{action: TouchActionMove, x: 100, y: 200},
+			touch_control_pack{action: TouchActionMove, x: touch_max - 200, y: 100}},
+		{"旋转2", touch_transform{rotate: 2, region: full},
+			touch_control_pack{action: TouchActionMove, x: 100, y: 200},
+			touch_control_pack{action: TouchActionMove, x: touch_max - 100, y: touch_max - 200}},
+		{"旋转3", touch_transform{rotate: 3, region: full},
+			touch_control_pack{action: TouchActionMove, x: 100, y: 200},
+			touch_control_pack{action: TouchActionMove, x: 200, y: touch_max - 100}},
+		{"左右翻转", touch_transform{flip_x: true, region: full},
+			touch_control_pack{action: TouchActionRequire, x: 100, y: 200},
+			touch_control_pack{action: TouchActionRequire, x: touch_max - 100, y: 200}},
+		{"上下翻转", touch_transform{flip_y: true, region: full},
+			touch_control_pack{action: TouchActionRequire, x: 100, y: 200},
+			touch_control_pack{action: TouchActionRequire, x: 100, y: touch_max - 200}},
+		{"先旋转后翻转", touch_transform{rotate: 1, flip_x: true, region: full},
+			touch_control_pack{action: TouchActionRequire, x: 100, y: 200},
+			touch_control_pack{action: TouchActionRequire, x: 200, y: 100}},
+		{"右半区域", touch_transform{region: [4]float64{0.5, 0, 1, 1}},
+			touch_control_pack{action: TouchActionRequire, x: 0, y: touch_max},
+			touch_control_pack{action: TouchActionRequire, x: touch_max / 2, y: touch_max}},
+		{"右半区域右下角", touch_transform{region: [4]float64{0.5, 0, 1, 1}},
+			touch_control_pack{action: TouchActionRequire, x: touch_max, y: touch_max},
+			touch_control_pack{action: TouchActionRequire, x: touch_max, y: touch_max}},
+		{"下半区域中心", touch_transform{region: [4]float64{0, 0.5, 1, 1}},
+			touch_control_pack{action: TouchActionRequire, x: touch_max / 2, y: touch_max / 2},
+			touch_control_pack{action: TouchActionRequire, x: touch_max / 2, y: touch_max/2 + touch_max/4}},
+		{"旋转后映射到区域", touch_transform{rotate: 2, region: [4]float64{0, 0, 0.5, 0.5}},
+			touch_control_pack{action: TouchActionRequire, x: 0, y: 0},
+			touch_control_pack{action: TouchActionRequire, x: touch_max / 2, y: touch_max / 2}},
+		{"SIZE覆盖屏幕尺寸", touch_transform{region: full, size: [2]int32{1920, 1080}},
+			touch_control_pack{action: TouchActionRequire, x: 1, y: 2, screen_x: 2400, screen_y: 1080},
+			touch_control_pack{action: TouchActionRequire, x: 1, y: 2, screen_x: 1920, screen_y: 1080}},
+		{"松开不变换坐标", touch_transform{rotate: 1, flip_x: true, region: [4]float64{0.5, 0.5, 1, 1}},
+			touch_control_pack{action: TouchActionRelease, id: 3, x: 100, y: 200},
+			touch_control_pack{action: TouchActionRelease, id: 3, x: 100, y: 200}},
+		{"分辨率不旋转", touch_transform{rotate: 2, region: full},
+			touch_control_pack{action: TouchActionResetResolution, x: 1080, y: 2400},
+			touch_control_pack{action: TouchActionResetResolution, x: 1080, y: 2400}},
+		{"分辨率旋转90度时交换", touch_transform{rotate: 1, region: full},
+			touch_control_pack{action: TouchActionResetResolution, x: 1080, y: 2400},
+			touch_control_pack{action: TouchActionResetResolution, x: 2400, y: 1080}},
+		{"分辨率使用SIZE", touch_transform{rotate: 1, region: full, size: [2]int32{1920, 1080}},
+			touch_control_pack{action: TouchActionResetResolution, x: 1080, y: 2400},
+			touch_control_pack{action: TouchActionResetResolution, x: 1920, y: 1080, screen_x: 1920, screen_y: 1080}},
+		{"SIZE只指定一项时不生效", touch_transform{region: full, size: [2]int32{1920, 0}},
+			touch_control_pack{action: TouchActionResetResolution, x: 1080, y: 2400},
+			touch_control_pack{action: TouchActionResetResolution, x: 1080, y: 2400}},
+	} {
+		if got := test.transform.apply(test.in); got != test.want {
+			t.Errorf("%s: %+v 应为 %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestParseTouchTransform(t *testing.T) {
+	for _, test := range []struct {
+		config string
+		want   *touch_transform
+		err    bool
+	}{
+		{`{}`, nil, false},
+		{`{"TRANSFORM":{}}`, &touch_transform{region: [4]float64{0, 0, 1, 1}}, false},
+		{`{"TRANSFORM":{"ROTATE":3,"FLIP_X":true,"FLIP_Y":true,"REGION":[0.25,0,0.75,1],"SIZE":[1920,1080]}}`,
+			&touch_transform{rotate: 3, flip_x: true, flip_y: true, region: [4]float64{0.25, 0, 0.75, 1}, size: [2]int32{1920, 1080}}, false},
+		{`{"TRANSFORM":{"REGION":[0.5,0.5,0.5,0.5]}}`, &touch_transform{region: [4]float64{0.5, 0.5, 0.5, 0.5}}, false},
+		{`{"TRANSFORM":{"ROTATE":4}}`, nil, true},
+		{`{"TRANSFORM":{"ROTATE":-1}}`, nil, true},
+		{`{"TRANSFORM":{"REGION":[0,0,1]}}`, nil, true},
+		{`{"TRANSFORM":{"REGION":[0,0,1.5,1]}}`, nil, true},
+		{`{"TRANSFORM":{"REGION":[-0.1,0,1,1]}}`, nil, true},
+		{`{"TRANSFORM":{"REGION":[0.6,0,0.4,1]}}`, nil, true},
+		{`{"TRANSFORM":{"REGION":[0,0.6,1,0.4]}}`, nil, true},
+		{`{"TRANSFORM":{"REGION":[0,"0",1,1]}}`, nil, true},
+		{`{"TRANSFORM":{"SIZE":[1920]}}`, nil, true},
+	} {
+		config, err := simplejson.NewJson([]byte(test.config))
+		if err != nil {
+			t.Fatal(err)
+		}
+		transform, err := parse_touch_transform(config)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s 应返回错误", test.config)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.config, err)
+		} else if (transform == nil) != (test.want == nil) || (transform != nil && *transform != *test.want) {
+			t.Errorf("%s: %+v 应为 %+v", test.config, transform, test.want)
+		}
+	}
+}
+
+func TestParseTouchOutputs(t *testing.T) {
+	for _, test := range []struct {
+		mode string
+		want []string
+		err  bool
+	}{
+		{"uinput", []string{"uinput"}, false},
+		{"uinput+record:/sdcard/touch.log", []string{"uinput", "record:/sdcard/touch.log"}, false},
+		{"hid:/dev/ttyACM0+net:tcp://192.168.1.64:61069", []string{"hid:/dev/ttyACM0", "net:tcp://192.168.1.64:61069"}, false},
+		{"inputmanager:2", []string{"inputmanager:2"}, false},
+		{"uinput+", nil, true},
+		{":arg", nil, true},
+		{"outputs", nil, true},
+		{"outputs:", nil, true},
+	} {
+		outputs, err := parse_touch_outputs(test.mode)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s 应返回错误", test.mode)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.mode, err)
+			continue
+		}
+		if len(outputs) != len(test.want) {
+			t.Errorf("%s: 输出数量%d 应为%d", test.mode, len(outputs), len(test.want))
+			continue
+		}
+		for i, output := range outputs {
+			if output.String() != test.want[i] || output.transform != nil {
+				t.Errorf("%s: 第%d个输出为%s 应为%s", test.mode, i, output, test.want[i])
+			}
+		}
+	}
+}
+
+func TestLoadTouchOutputsFile(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	path := write("outputs.json", `{"OUTPUTS":[
+		{"MODE":"uinput"},
+		{"MODE":"otg","TRANSFORM":{"ROTATE":1,"REGION":[0,0,0.5,1],"SIZE":[1920,1080]}},
+		{"MODE":"record","ARG":"/sdcard/touch.log"}
+	]}`)
+	outputs, err := parse_touch_outputs("outputs:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outputs) != 3 || outputs[0].String() != "uinput" || outputs[1].String() != "otg" || outputs[2].String() != "record:/sdcard/touch.log" {
+		t.Fatalf("读取的输出错误: %v", outputs)
+	}
+	if outputs[0].transform != nil || outputs[2].transform != nil {
+		t.Fatal("未指定TRANSFORM的输出不应变换")
+	}
+	want := touch_transform{rotate: 1, region: [4]float64{0, 0, 0.5, 1}, size: [2]int32{1920, 1080}}
+	if outputs[1].transform == nil || *outputs[1].transform != want {
+		t.Fatalf("TRANSFORM错误: %+v", outputs[1].transform)
+	}
+
+	for name, content := range map[string]string{
+		"empty.json":      `{"OUTPUTS":[]}`,
+		"no_mode.json":    `{"OUTPUTS":[{"ARG":"x"}]}`,
+		"nested.json":     `{"OUTPUTS":[{"MODE":"outputs","ARG":"a.json"}]}`,
+		"bad_region.json": `{"OUTPUTS":[{"MODE":"otg","TRANSFORM":{"REGION":[0,0,2,1]}}]}`,
+		"invalid.json":    `{"OUTPUTS":`,
+	} {
+		if _, err := load_touch_outputs_file(write(name, content)); err == nil {
+			t.Errorf("%s 应返回错误", name)
+		}
+	}
+	if _, err := load_touch_outputs_file(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("文件不存在时应返回错误")
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"time"
+
+	"github.com/kenshaw/evdev"
+)
+
+// 触控板与数位板的读取
+// 触控板在读取时转换为鼠标事件(单指移动 双指滚动 轻触点击) 之后与普通鼠标完全一致
+// 数位板的绝对坐标归一化到0~0x7ffffffe 由handler直接映射到屏幕位置
+
+const (
+	touchpad_max_slots      = 10
+	touchpad_rel_per_width  = 1600                                  //手指划过整个触控板宽度对应的鼠标移动量
+	touchpad_scroll_steps   = 16                                    //手指划过整个触控板高度对应的滚轮格数
+	touchpad_tap_time       = time.Duration(180) * time.Millisecond //短于此时间的轻触视为点击
+	touchpad_tap_move_ratio = 0.03                                  //轻触时允许的移动距离 占宽度的比例
+)
+
+type touchpad_slot struct {
+	active bool
+	x      int32
+	y      int32
+}
+
+type touchpad_state struct {
+	slots       [touchpad_max_slots]touchpad_slot
+	last_slots  [touchpad_max_slots]touchpad_slot
+	slot        int32
+	width       float64
+	height      float64
+	speed       float64
+	rest_x      float64 //换算后的小数部分累计
+	rest_y      float64
+	scroll_x    float64
+	scroll_y    float64
+	tap_start   time.Time
+	tap_fingers int     //本次触摸期间的最大手指数
+	tap_moved   float64 //本次触摸期间的累计移动距离
+}
+
+func new_rel_event(code evdev.RelativeType, value int32) *evdev.Event {
+	return &evdev.Event{Type: evdev.EventRelative, Code: uint16(code), Value: value}
+}
+
+func new_key_event(code evdev.KeyType, value int32) *evdev.Event {
+	return &evdev.Event{Type: evdev.EventKey, Code: uint16(code), Value: value}
+}
+
+func (self *touchpad_state) active_count(slots *[touchpad_max_slots]touchpad_slot) int {
+	count := 0
+	for _, slot := range slots {
+		if slot.active {
+			count++
+		}
+	}
+	return count
+}
+
+// 根据前后两帧的触点状态计算鼠标事件
+func (self *touchpad_state) frame() []*evdev.Event {
+	result := make([]*evdev.Event, 0)
+	count := self.active_count(&self.slots)
+	last_count := self.active_count(&self.last_slots)
+	if last_count == 0 && count > 0 {
+		self.tap_start = time.Now()
+		self.tap_fingers = 0
+		self.tap_moved = 0
+	}
+	if count > self.tap_fingers {
+		self.tap_fingers = count
+	}
+	var dx, dy float64
+	moved := 0
+	for i := 0; i < touchpad_max_slots; i++ {
+		if self.slots[i].active && self.last_slots[i].active {
+			dx += float64(self.slots[i].x - self.last_slots[i].x)
+			dy += float64(self.slots[i].y - self.last_slots[i].y)
+			moved++
+		}
+	}
+	if moved > 0 && count == last_count { //手指数量变化的一帧不计算移动 避免跳动
+		dx /= float64(moved)
+		dy /= float64(moved)
+		self.tap_moved += math.Abs(dx) + math.Abs(dy)
+		if count == 1 {
+			self.rest_x += dx * touchpad_rel_per_width / self.width * self.speed
+			self.rest_y += dy * touchpad_rel_per_width / self.width * self.speed
+			rel_x, rel_y := int32(self.rest_x), int32(self.rest_y)
+			self.rest_x -= float64(rel_x)
+			self.rest_y -= float64(rel_y)
+			if rel_x != 0 {
+				result = append(result, new_rel_event(evdev.RelativeX, rel_x))
+			}
+			if rel_y != 0 {
+				result = append(result, new_rel_event(evdev.RelativeY, rel_y))
+			}
+		} else if count == 2 { //双指滚动 手指向下移动对应滚轮向上
+			self.scroll_x += dx * touchpad_scroll_steps / self.height
+			self.scroll_y += dy * touchpad_scroll_steps / self.height
+			wheel_x, wheel_y := int32(self.scroll_x), int32(self.scroll_y)
+			self.scroll_x -= float64(wheel_x)
+			self.scroll_y -= float64(wheel_y)
+			if wheel_x != 0 {
+				result = append(result, new_rel_event(evdev.RelativeHWheel, -wheel_x))
+			}
+			if wheel_y != 0 {
+				result = append(result, new_rel_event(evdev.RelativeWheel, wheel_y))
+			}
+		}
+	}
+	if count == 0 {
+		self.scroll_x = 0
+		self.scroll_y = 0
+	}
+	self.last_slots = self.slots
+	return result
+}
+
+// 全部手指抬起时判断是否为轻触 单指左键 双指右键
+func (self *touchpad_state) tap_button() (evdev.KeyType, bool) {
+	if self.active_count(&self.slots) != 0 || self.tap_start.IsZero() {
+		return 0, false
+	}
+	defer func() { self.tap_start = time.Time{} }()
+	if time.Since(self.tap_start) > touchpad_tap_time || self.tap_moved > self.width*touchpad_tap_move_ratio {
+		return 0, false
+	}
+	switch self.tap_fingers {
+	case 1:
+		return evdev.BtnLeft, true
+	case 2:
+		return evdev.BtnRight, true
+	}
+	return 0, false
+}
+
+func touchpad_dev_reader(event_reader chan *event_pack, index int, settings *device_settings, stop chan bool) {
+	fd, err := os.OpenFile(fmt.Sprintf("/dev/input/event%d", index), os.O_RDONLY, 0)
+	if err != nil {
+		logger.Errorf("读取设备失败 : %v", err)
+		return
+	}
+	d := evdev.Open(fd)
+	defer d.Close()
+	event_ch := d.Poll(context.Background())
+	dev_name := d.Name()
+	abs := d.AbsoluteTypes()
+	_, multi_touch := abs[evdev.AbsoluteMTSlot]
+	x_axis, y_axis := abs[evdev.AbsoluteX], abs[evdev.AbsoluteY]
+	if multi_touch {
+		x_axis, y_axis = abs[evdev.AbsoluteMTPositionX], abs[evdev.AbsoluteMTPositionY]
+	}
+	state := &touchpad_state{
+		width:  math.Max(float64(x_axis.Max-x_axis.Min), 1),
+		height: math.Max(float64(y_axis.Max-y_axis.Min), 1),
+		speed:  settings.mouse_speed,
+	}
+	logger.Infof("开始读取设备 : %s", dev_name)
+	grab_ch, release := grab_device(d, settings.grab)
+	defer release()
+	held := make(held_keys)
+	send := func(events []*evdev.Event) {
+		held.track(events)
+		event_reader <- &event_pack{
+			dev_name: dev_name,
+			dev_type: type_mouse,
+			events:   events,
+		}
+	}
+	buttons := make([]*evdev.Event, 0)
+	for {
+		select {
+		case <-global_close_signal:
+			logger.Infof("释放设备 : %s", dev_name)
+			return
+		case <-stop:
+			logger.Infof("设备规则已改变 释放设备 : %s", dev_name)
+			held.release(event_reader, dev_name, type_mouse)
+			return
+		case grab := <-grab_ch:
+			set_device_grab(d, grab)
+		case event := <-event_ch:
+			if event == nil {
+				logger.Warnf("移除设备 : %s", dev_name)
+				return
+			}
+			switch event.Type {
+			case evdev.SyncReport:
+				events := append(state.frame(), buttons...)
+				buttons = make([]*evdev.Event, 0)
+				if len(events) > 0 {
+					send(events)
+				}
+				if button, ok := state.tap_button(); ok {
+					send([]*evdev.Event{new_key_event(button, DOWN)})
+					send([]*evdev.Event{new_key_event(button, UP)})
+				}
+			case evdev.EventKey:
+				switch evdev.KeyType(event.Code) {
+				case evdev.BtnLeft, evdev.BtnRight, evdev.BtnMiddle: //物理按键直接转发
+					buttons = append(buttons, &evdev.Event{Type: evdev.EventKey, Code: event.Code, Value: event.Value})
+					state.tap_start = time.Time{}
+				case evdev.BtnTouch:
+					if !multi_touch {
+						state.slots[0].active = event.Value == DOWN
+					}
+				}
+			case evdev.EventAbsolute:
+				if multi_touch {
+					switch evdev.AbsoluteType(event.Code) {
+					case evdev.AbsoluteMTSlot:
+						state.slot = event.Value
+					case evdev.AbsoluteMTTrackingID:
+						if state.slot >= 0 && state.slot < touchpad_max_slots {
+							state.slots[state.slot].active = event.Value != -1
+						}
+					case evdev.AbsoluteMTPositionX:
+						if state.slot >= 0 && state.slot < touchpad_max_slots {
+							state.slots[state.slot].x = event.Value
+						}
+					case evdev.AbsoluteMTPositionY:
+						if state.slot >= 0 && state.slot < touchpad_max_slots {
+							state.slots[state.slot].y = event.Value
+						}
+					}
+				} else {
+					switch evdev.AbsoluteType(event.Code) {
+					case evdev.AbsoluteX:
+						state.slots[0].x = event.Value
+					case evdev.AbsoluteY:
+						state.slots[0].y = event.Value
+					}
+				}
+			}
+		}
+	}
+}
+
+// 数位板 ABS_X/ABS_Y归一化后与BTN_TOUCH一起发送 笔的侧键作为普通按键事件
+func tablet_dev_reader(event_reader chan *event_pack, index int, settings *device_settings, stop chan bool) {
+	fd, err := os.OpenFile(fmt.Sprintf("/dev/input/event%d", index), os.O_RDONLY, 0)
+	if err != nil {
+		logger.Errorf("读取设备失败 : %v", err)
+		return
+	}
+	d := evdev.Open(fd)
+	defer d.Close()
+	event_ch := d.Poll(context.Background())
+	events := make([]*evdev.Event, 0)
+	dev_name := d.Name()
+	x_axis := d.AbsoluteTypes()[evdev.AbsoluteX]
+	y_axis := d.AbsoluteTypes()[evdev.AbsoluteY]
+	normalize := func(value int32, axis evdev.Axis) int32 {
+		if axis.Max <= axis.Min {
+			return 0
+		}
+		if value < axis.Min {
+			value = axis.Min
+		} else if value > axis.Max {
+			value = axis.Max
+		}
+		return int32(int64(value-axis.Min) * 0x7ffffffe / int64(axis.Max-axis.Min))
+	}
+	logger.Infof("开始读取设备 : %s", dev_name)
+	grab_ch, release := grab_device(d, settings.grab)
+	defer release()
+	held := make(held_keys)
+	for {
+		select {
+		case <-global_close_signal:
+			logger.Infof("释放设备 : %s", dev_name)
+			return
+		case <-stop:
+			logger.Infof("设备规则已改变 释放设备 : %s", dev_name)
+			held.release(event_reader, dev_name, type_tablet)
+			return
+		case grab := <-grab_ch:
+			set_device_grab(d, grab)
+		case event := <-event_ch:
+			if event == nil {
+				logger.Warnf("移除设备 : %s", dev_name)
+				return
+			} else if event.Type == evdev.SyncReport {
+				if len(events) > 0 {
+					held.track(events)
+					event_reader <- &event_pack{
+						dev_name: dev_name,
+						dev_type: type_tablet,
+						events:   events,
+					}
+					events = make([]*evdev.Event, 0)
+				}
+			} else if event.Type == evdev.EventAbsolute {
+				switch evdev.AbsoluteType(event.Code) {
+				case evdev.AbsoluteX:
+					event.Event.Value = normalize(event.Event.Value, x_axis)
+					events = append(events, &event.Event)
+				case evdev.AbsoluteY:
+					event.Event.Value = normalize(event.Event.Value, y_axis)
+					events = append(events, &event.Event)
+				}
+			} else if event.Type == evdev.EventKey {
+				events = append(events, &event.Event)
+			}
+		}
+	}
+}
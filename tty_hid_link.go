@@ -0,0 +1,351 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"go.bug.st/serial"
+	"go.bug.st/serial/enumerator"
+)
+
+// 串口HID链路 负责打开串口 查询固件版本 以及v3协议的分帧与应答
+// v3帧: 0xF6 <len> <type> <seq> <data...> <crc16 le>
+// len为type+seq+data的长度 crc16(CCITT)覆盖len至data
+// 接收方逐字节寻找帧头 长度或校验错误时从帧头后一字节重新寻找 固件对错误帧回复NAK
+// 发送方收到NAK或应答超时后重发完整触点状态与未应答的命令 串口断开后按--tty-path重新打开
+// 固件对内容错误的帧回复带序号的NAK 重新同步时回复序号0的NAK 发送方不使用序号0
+
+const (
+	hid_magic_framed     = 0xF6
+	hid_type_contacts    = 0x01
+	hid_type_command     = 0x02
+	hid_type_contacts_ex = 0x03 //v4
+	hid_type_ack         = 0x80
+	hid_type_nak         = 0x81
+	hid_framed_max_len   = 2 + 1 + 10*hid_contact_ex //与固件的FRAMED_MAX_LEN相同 超出视为错误
+	hid_baud_rate        = 2000000
+	hid_ack_window       = 4
+	hid_ack_timeout      = 200 * time.Millisecond
+	hid_link_timeout     = 2 * time.Second
+	hid_reconnect_period = time.Second
+	hid_auto_path        = "auto"
+	hid_auto_all_path    = "auto-all" //向所有USB串口发送版本查询 可能干扰其他串口设备
+	hid_esp32_vid        = "303A"     //乐鑫 ESP32-S3原生USB
+)
+
+// 打开串口的方法 可替换为伪终端等用于模拟固件
+var hid_open_port = func(path string) (serial.Port, error) {
+	return OpenSerialWritePipe(path, hid_baud_rate)
+}
+
+func hid_crc16(data []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+func hid_framed(kind, seq uint8, data []byte) []byte {
+	frame := make([]byte, 0, len(data)+6)
+	frame = append(frame, hid_magic_framed, uint8(len(data)+2), kind, seq)
+	frame = append(frame, data...)
+	crc := hid_crc16(frame[1:])
+	return append(frame, uint8(crc), uint8(crc>>8))
+}
+
+type hid_ack struct {
+	seq uint8
+	ok  bool
+}
+
+// 固件输出中文本行与v3帧混合 帧外的字节按行处理
+type hid_parser struct {
+	line     []byte
+	frame    []byte //nil表示正在寻找帧头
+	on_line  func(string)
+	on_frame func(kind, seq uint8, data []byte)
+	on_error func()
+}
+
+func (self *hid_parser) feed(data []byte) {
+	for _, b := range data {
+		if self.frame == nil {
+			if b == hid_magic_framed {
+				self.frame = make([]byte, 0, 16)
+			} else if b == '\n' {
+				self.on_line(strings.TrimSpace(string(self.line)))
+				self.line = self.line[:0]
+			} else if len(self.line) < 256 {
+				self.line = append(self.line, b)
+			}
+			continue
+		}
+		self.frame = append(self.frame, b)
+		n := int(self.frame[0])
+		if n < 2 || n > hid_framed_max_len {
+			self.resync()
+			continue
+		}
+		if len(self.frame) < n+3 {
+			continue
+		}
+		if binary.LittleEndian.Uint16(self.frame[n+1:]) != hid_crc16(self.frame[:n+1]) {
+			self.resync()
+			continue
+		}
+		frame := self.frame
+		self.frame = nil
+		self.on_frame(frame[1], frame[2], frame[3:n+1])
+	}
+}
+
+func (self *hid_parser) resync() {
+	rest := self.frame
+	self.frame = nil
+	if self.on_error != nil {
+		self.on_error()
+	}
+	self.feed(rest)
+}
+
+type hid_link struct {
+	path         string
+	port         serial.Port
+	version      int
+	max_contacts int //0表示不限制
+	seq          uint8
+	lines        chan string
+	acks         chan hid_ack
+	closed       chan bool
+	close_once   sync.Once
+}
+
+func open_hid_link(path string) (*hid_link, error) {
+	port, err := hid_open_port(path)
+	if err != nil {
+		return nil, err
+	}
+	link := &hid_link{
+		path:   path,
+		port:   port,
+		lines:  make(chan string, 8),
+		acks:   make(chan hid_ack, 16),
+		closed: make(chan bool),
+	}
+	port.ResetInputBuffer()
+	go link.loop_read()
+	if err := link.negotiate(); err != nil {
+		link.close()
+		return nil, err
+	}
+	return link, nil
+}
+
+func (self *hid_link) loop_read() {
+	parser := &hid_parser{
+		on_line: func(line string) {
+			if strings.HasPrefix(line, "GTHID ") {
+				select {
+				case self.lines <- line:
+				default:
+				}
+			} else if line != "" {
+				logger.Debugf("固件输出: %s", line)
+			}
+		},
+		on_frame: func(kind, seq uint8, data []byte) {
+			switch kind {
+			case hid_type_ack, hid_type_nak:
+				select {
+				case self.acks <- hid_ack{seq: seq, ok: kind == hid_type_ack}:
+				default:
+				}
+			}
+		},
+		on_error: func() {
+			logger.Debugf("串口数据校验失败 重新同步")
+		},
+	}
+	buf := make([]byte, 256)
+	for {
+		n, err := self.port.Read(buf)
+		if err != nil {
+			self.close()
+			return
+		}
+		parser.feed(buf[:n])
+	}
+}
+
+// 查询固件版本 旧固件会忽略该命令 无回复则使用v1协议
+func (self *hid_link) negotiate() error {
+	self.version, self.max_contacts = 1, 0
+	for i := 0; i < hid_hello_retry; i++ {
+		if err := self.write(hid_command(hid_cmd_hello, 0, 0)); err != nil {
+			return err
+		}
+		select {
+		case <-self.closed:
+			return fmt.Errorf("串口已关闭")
+		case line := <-self.lines:
+			var version, max_contacts int
+			if _, err := fmt.Sscanf(line, "GTHID %d %d", &version, &max_contacts); err == nil {
+				self.version, self.max_contacts = version, max_contacts
+				return nil
+			}
+		case <-time.After(hid_hello_wait):
+		}
+	}
+	return nil
+}
+
+func (self *hid_link) write(data []byte) error {
+	_, err := self.port.Write(data)
+	if err != nil {
+		self.close()
+	}
+	return err
+}
+
+// 序号0保留给固件重新同步时的NAK
+func (self *hid_link) write_framed(kind uint8, data []byte) (uint8, error) {
+	if self.seq++; self.seq == 0 {
+		self.seq = 1
+	}
+	return self.seq, self.write(hid_framed(kind, self.seq, data))
+}
+
+func (self *hid_link) close() {
+	self.close_once.Do(func() {
+		close(self.closed)
+		self.port.Close()
+	})
+}
+
+func open_hid_link_async(path string, result chan *hid_link) {
+	go func() {
+		for {
+			link, err := open_hid_link(path)
+			if err == nil {
+				select {
+				case result <- link:
+				case <-global_close_signal:
+					link.close()
+				}
+				return
+			}
+			logger.Debugf("打开串口%s失败 : %v", path, err)
+			select {
+			case <-global_close_signal:
+				return
+			case <-time.After(hid_reconnect_period):
+			}
+		}
+	}()
+}
+
+type hid_tty_candidate struct {
+	path    string
+	esp32   bool
+	version int
+	product string
+}
+
+func (self *hid_tty_candidate) String() string {
+	desc := self.path
+	if self.product != "" {
+		desc += " " + self.product
+	}
+	if self.esp32 {
+		desc += " [ESP32-S3]"
+	}
+	if self.version >= 2 {
+		desc += fmt.Sprintf(" [hid_touch v%d]", self.version)
+	}
+	return desc
+}
+
+// --tty-path auto 只向乐鑫VID的USB串口发送版本查询 优先选择回复的hid_touch固件
+// --tty-path auto-all 向所有USB串口发送版本查询 用于使用USB转串口芯片连接的ESP32-S3
+// 多个设备符合条件时列出候选并要求手动指定
+func find_hid_tty_path(probe_all bool) (string, error) {
+	ports, err := enumerator.GetDetailedPortsList()
+	if err != nil {
+		return "", err
+	}
+	candidates := []*hid_tty_candidate{}
+	for _, port := range ports {
+		if !port.IsUSB {
+			continue
+		}
+		esp32 := strings.EqualFold(port.VID, hid_esp32_vid)
+		if !esp32 && !probe_all {
+			logger.Debugf("跳过非乐鑫串口 %s %s", port.Name, port.Product)
+			continue
+		}
+		candidates = append(candidates, &hid_tty_candidate{
+			path:    port.Name,
+			esp32:   esp32,
+			product: port.Product,
+		})
+	}
+	if len(candidates) == 0 {
+		if !probe_all {
+			return "", fmt.Errorf("未找到乐鑫VID(%s)的USB串口 通过USB转串口芯片连接时请使用--tty-path %s", hid_esp32_vid, hid_auto_all_path)
+		}
+		return "", fmt.Errorf("未找到USB串口设备")
+	}
+	var wg sync.WaitGroup
+	for _, candidate := range candidates {
+		wg.Add(1)
+		go func(candidate *hid_tty_candidate) {
+			defer wg.Done()
+			link, err := open_hid_link(candidate.path)
+			if err != nil {
+				logger.Debugf("打开串口%s失败 : %v", candidate.path, err)
+				return
+			}
+			candidate.version = link.version
+			link.close()
+		}(candidate)
+	}
+	wg.Wait()
+	matched := []*hid_tty_candidate{}
+	for _, candidate := range candidates {
+		if candidate.version >= 2 {
+			matched = append(matched, candidate)
+		}
+	}
+	if len(matched) == 0 {
+		for _, candidate := range candidates {
+			if candidate.esp32 {
+				matched = append(matched, candidate)
+			}
+		}
+	}
+	if len(matched) == 1 {
+		return matched[0].path, nil
+	}
+	list := matched
+	if len(matched) == 0 {
+		list = candidates
+	}
+	for _, candidate := range list {
+		logger.Infof("候选串口: %s", candidate)
+	}
+	if len(matched) == 0 {
+		return "", fmt.Errorf("没有设备回复hid_touch固件版本查询 也没有ESP32-S3设备 请确认已刷入固件 或使用--tty-path手动指定")
+	}
+	return "", fmt.Errorf("找到%d个可能的设备 请拔出多余设备 或使用--tty-path手动指定其中之一", len(matched))
+}
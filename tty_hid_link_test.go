@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"go.bug.st/serial"
+	"golang.org/x/sys/unix"
+)
+
+// 在伪终端的主端模拟hid_touch固件 从端由hid_open_port作为串口打开
+type fake_hid_firmware struct {
+	master      *os.File
+	lock        sync.Mutex
+	nak_next    map[uint8]bool //收到该类型的下一帧时回复序号0的NAK 模拟重新同步
+	reject_next map[uint8]bool //收到该类型的下一帧时回复带序号的NAK 模拟内容错误
+	frames      chan fake_hid_frame
+}
+
+type fake_hid_frame struct {
+	kind uint8
+	seq  uint8
+	data []byte
+}
+
+func open_test_pty(t *testing.T) (*os.File, string) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY|unix.O_NONBLOCK, 0)
+	if err != nil {
+		t.Skipf("无法打开伪终端: %v", err)
+	}
+	if err := unix.IoctlSetPointerInt(int(master.Fd()), unix.TIOCSPTLCK, 0); err != nil {
+		master.Close()
+		t.Skipf("无法解锁伪终端: %v", err)
+	}
+	n, err := unix.IoctlGetInt(int(master.Fd()), unix.TIOCGPTN)
+	if err != nil {
+		master.Close()
+		t.Skipf("无法获取伪终端编号: %v", err)
+	}
+	return master, fmt.Sprintf("/dev/pts/%d", n)
+}
+
+func (self *fake_hid_firmware) nak(kind uint8) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.nak_next[kind] = true
+}
+
+func (self *fake_hid_firmware) reject(kind uint8) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.reject_next[kind] = true
+}
+
+func (self *fake_hid_firmware) reply(kind, seq uint8) {
+	self.master.Write(hid_framed(kind, seq, nil))
+}
+
+// 与固件相同 逐字节寻找帧头 版本查询回复GTHID 分帧逐帧应答
+func (self *fake_hid_firmware) loop() {
+	buf := make([]byte, 0, 1024)
+	read := make([]byte, 256)
+	for {
+		n, err := self.master.Read(read)
+		if err != nil {
+			close(self.frames)
+			return
+		}
+		buf = append(buf, read[:n]...)
+		for len(buf) > 0 {
+			if buf[0] == hid_magic_report {
+				if len(buf) < 12 {
+					break
+				}
+				if buf[1] == hid_cmd_other && buf[2] == hid_cmd_hello {
+					self.master.Write([]byte("GTHID 4 10\n"))
+				}
+				buf = buf[12:]
+				continue
+			}
+			if buf[0] != hid_magic_framed {
+				buf = buf[1:]
+				continue
+			}
+			if len(buf) < 2 {
+				break
+			}
+			size := int(buf[1])
+			if len(buf) < size+4 {
+				break
+			}
+			if size < 2 || binary.LittleEndian.Uint16(buf[size+2:]) != hid_crc16(buf[1:size+2]) {
+				self.reply(hid_type_nak, 0)
+				buf = buf[1:]
+				continue
+			}
+			frame := fake_hid_frame{kind: buf[2], seq: buf[3], data: append([]byte{}, buf[4:size+2]...)}
+			buf = buf[size+4:]
+			self.lock.Lock()
+			nak := self.nak_next[frame.kind]
+			delete(self.nak_next, frame.kind)
+			reject := self.reject_next[frame.kind]
+			delete(self.reject_next, frame.kind)
+			self.lock.Unlock()
+			if nak {
+				self.reply(hid_type_nak, 0)
+				continue
+			}
+			if reject {
+				self.reply(hid_type_nak, frame.seq)
+				continue
+			}
+			self.reply(hid_type_ack, frame.seq)
+			self.frames <- frame
+		}
+	}
+}
+
+// 等待指定类型的帧 期间收到的其他帧被丢弃
+func (self *fake_hid_firmware) expect(t *testing.T, kind uint8) fake_hid_frame {
+	t.Helper()
+	timeout := time.After(3 * time.Second)
+	for {
+		select {
+		case frame, ok := <-self.frames:
+			if !ok {
+				t.Fatalf("等待类型%#x时串口已关闭", kind)
+			}
+			if frame.kind == kind {
+				return frame
+			}
+		case <-timeout:
+			t.Fatalf("未收到类型%#x的帧", kind)
+		}
+	}
+}
+
+func (self *fake_hid_firmware) quiet(t *testing.T, kind uint8, d time.Duration) {
+	t.Helper()
+	timeout := time.After(d)
+	for {
+		select {
+		case frame, ok := <-self.frames:
+			if ok && frame.kind == kind {
+				t.Fatalf("不应收到类型%#x的帧", kind)
+			}
+		case <-timeout:
+			return
+		}
+	}
+}
+
+func TestHidParserResync(t *testing.T) {
+	frames := []fake_hid_frame{}
+	errors := 0
+	parser := &hid_parser{
+		on_line:  func(string) {},
+		on_frame: func(kind, seq uint8, data []byte) { frames = append(frames, fake_hid_frame{kind: kind, seq: seq}) },
+		on_error: func() { errors++ },
+	}
+	corrupted := hid_framed(hid_type_ack, 1, nil)
+	corrupted[len(corrupted)-1] ^= 0xff
+	data := []byte{hid_magic_framed, 0x00, hid_magic_framed, 0x7f}
+	data = append(data, hid_framed(hid_type_ack, 2, nil)...) //被截断的帧中包含完整的帧
+	data = append(data, corrupted...)
+	data = append(data, hid_framed(hid_type_nak, 0, nil)...)
+	for _, b := range data { //逐字节送入 模拟串口分段
+		parser.feed([]byte{b})
+	}
+	if len(frames) != 2 || frames[0].seq != 2 || frames[1].kind != hid_type_nak {
+		t.Fatalf("重新同步后的帧错误: %+v", frames)
+	}
+	if errors == 0 {
+		t.Fatal("错误帧未触发重新同步")
+	}
+}
+
+func TestHidManagerOverPty(t *testing.T) {
+	firmwares := make(chan *fake_hid_firmware, 4)
+	open_port := hid_open_port
+	defer func() { hid_open_port = open_port }()
+	hid_open_port = func(path string) (serial.Port, error) {
+		master, slave := open_test_pty(t)
+		firmware := &fake_hid_firmware{master: master, nak_next: make(map[uint8]bool), reject_next: make(map[uint8]bool), frames: make(chan fake_hid_frame, 64)}
+		go firmware.loop()
+		port, err := serial.Open(slave, &serial.Mode{BaudRate: 115200})
+		if err != nil {
+			master.Close()
+			return nil, err
+		}
+		firmwares <- firmware
+		return port, nil
+	}
+
+	touch := handel_touch_using_hid_manager("pty")
+	firmware := <-firmwares
+
+	//分辨率命令被NAK后重发
+	firmware.nak(hid_type_command)
+	touch(touch_control_pack{action: TouchActionResetResolution, x: 1080, y: 2400})
+	command := firmware.expect(t, hid_type_command)
+	if command.data[0] != hid_cmd_size || binary.LittleEndian.Uint32(command.data[1:5]) != 1080 || binary.LittleEndian.Uint32(command.data[5:9]) != 2400 {
+		t.Fatalf("分辨率命令内容错误: %v", command.data)
+	}
+	firmware.quiet(t, hid_type_command, 3*hid_ack_timeout) //应答后不再重发
+
+	//v4触点帧 按原样发送压力与大小
+	touch(touch_control_pack{action: TouchActionRequire, id: 3, x: 100, y: 200, pressure: 128, size: 7})
+	frame := firmware.expect(t, hid_type_contacts_ex)
+	if frame.data[0] != 1 || len(frame.data) != 1+hid_contact_ex {
+		t.Fatalf("触点帧长度错误: %v", frame.data)
+	}
+	item := frame.data[1:]
+	if item[0] != 1 || item[1] != 3 || binary.LittleEndian.Uint32(item[2:6]) != 100 || binary.LittleEndian.Uint32(item[6:10]) != 200 || item[10] != 128 || item[11] != 7 {
+		t.Fatalf("触点内容错误: %v", item)
+	}
+
+	//触点帧被NAK后重发完整状态
+	firmware.nak(hid_type_contacts_ex)
+	touch(touch_control_pack{action: TouchActionMove, id: 3, x: 150, y: 250})
+	frame = firmware.expect(t, hid_type_contacts_ex)
+	if binary.LittleEndian.Uint32(frame.data[3:7]) != 150 {
+		t.Fatalf("NAK后重发的触点错误: %v", frame.data)
+	}
+
+	//断开后重新连接 重发分辨率与仍按下的触点
+	firmware.master.Close()
+	select {
+	case firmware = <-firmwares:
+	case <-time.After(3 * hid_reconnect_period):
+		t.Fatal("串口断开后未重新连接")
+	}
+	command = firmware.expect(t, hid_type_command)
+	if binary.LittleEndian.Uint32(command.data[1:5]) != 1080 {
+		t.Fatalf("重连后分辨率命令错误: %v", command.data)
+	}
+	frame = firmware.expect(t, hid_type_contacts_ex)
+	if frame.data[0] != 1 || frame.data[1] != 1 || frame.data[2] != 3 {
+		t.Fatalf("重连后未重发按下的触点: %v", frame.data)
+	}
+
+	//松开后发送tip=0 收到应答后移除
+	touch(touch_control_pack{action: TouchActionRelease, id: 3})
+	frame = firmware.expect(t, hid_type_contacts_ex)
+	if frame.data[0] != 1 || frame.data[1] != 0 {
+		t.Fatalf("松开帧错误: %v", frame.data)
+	}
+	touch(touch_control_pack{action: TouchActionRequire, id: 4, x: 1, y: 1})
+	frame = firmware.expect(t, hid_type_contacts_ex)
+	if frame.data[0] != 1 || frame.data[2] != 4 {
+		t.Fatalf("已松开的触点未移除: %v", frame.data)
+	}
+	if frame.data[11] != 0 { //未指定的压力为0 由固件按最大压力处理
+		t.Fatalf("未指定的压力应为0: %v", frame.data)
+	}
+
+	//松开帧被拒绝时立即再次按下 先重发松开 应答后再按下
+	firmware.reject(hid_type_contacts_ex)
+	touch(touch_control_pack{action: TouchActionRelease, id: 4})
+	touch(touch_control_pack{action: TouchActionRequire, id: 4, x: 5, y: 5})
+	frame = firmware.expect(t, hid_type_contacts_ex)
+	if frame.data[0] != 1 || frame.data[1] != 0 || frame.data[2] != 4 {
+		t.Fatalf("再次按下前未重发松开: %v", frame.data)
+	}
+	frame = firmware.expect(t, hid_type_contacts_ex)
+	if frame.data[0] != 1 || frame.data[1] != 1 || frame.data[2] != 4 || binary.LittleEndian.Uint32(frame.data[3:7]) != 5 {
+		t.Fatalf("松开送达后未再次按下: %v", frame.data)
+	}
+}
@@ -2,33 +2,316 @@ package main
 
 import (
 	"encoding/binary"
+	"os"
+	"sort"
+	"time"
+)
+
+// 串口HID协议 由固件对版本查询的回复决定
+// v1: 0xF4 <action> <id> <x u32> <y u32> <count> 每个变化的触点发送一个单触点报告
+// v2: 0xF5 <count> { <tip> <id> <x u32> <y u32> } * count 每个周期将全部活动触点合并为一帧
+// v3: 内容与v2相同 使用带长度与校验的分帧(见tty_hid_link.go) 固件逐帧应答用于流控
+// v4: 分帧类型0x03 <count> { <tip> <id> <x u32> <y u32> <pressure> <width> } * count 其余与v3相同
+// 命令: 0xF4 0x03 <sub> <x u32> <y u32> <0> 旧固件会忽略0x03命令 因此用其查询固件版本 新固件回复 "GTHID <version> <max_contacts>"
 
-	"go.bug.st/serial"
+const (
+	hid_magic_report = 0xF4
+	hid_magic_frame  = 0xF5
+	hid_cmd_other    = 0x03
+	hid_cmd_size     = 0x00
+	hid_cmd_hello    = 0xFE
+	hid_contact_size = 10
+	hid_contact_ex   = 12 //v4 带压力与接触宽度
+	hid_frame_tick   = 2 * time.Millisecond
+	hid_hello_wait   = 300 * time.Millisecond
+	hid_hello_retry  = 3
 )
 
-func handel_touch_using_hid_manager(port serial.Port) touch_control_func {
-	var buf [12]byte
-	buf[0] = 0xF4
-	setReport := func(action uint8, id uint8, x, y uint32) {
-		buf[1] = action
-		buf[2] = id
-		binary.LittleEndian.PutUint32(buf[3:7], x)
-		binary.LittleEndian.PutUint32(buf[7:11], y)
-		buf[11] = 0
+func hid_command(sub uint8, x, y uint32) []byte {
+	buf := make([]byte, 12)
+	buf[0] = hid_magic_report
+	buf[1] = hid_cmd_other
+	buf[2] = sub
+	binary.LittleEndian.PutUint32(buf[3:7], x)
+	binary.LittleEndian.PutUint32(buf[7:11], y)
+	return buf
+}
+
+type hid_contact struct {
+	tip          bool
+	changed      bool //v1 需要发送
+	x, y         uint32
+	pressure     uint8 //0表示未指定 固件按最大压力处理
+	size         uint8
+	release_seq  uint8 //v3 松开状态所在帧的序号 收到应答后移除
+	release_sent bool
+	repress      bool //松开送达前再次按下 送达后以next按下 保证固件能看到松开
+	next         hid_contact_pos
+}
+
+type hid_contact_pos struct {
+	x, y           uint32
+	pressure, size uint8
+}
+
+func log_hid_link(link *hid_link) {
+	if link.version < 2 {
+		logger.Warn("固件未回复版本信息 使用v1单触点协议 建议更新hid_touch固件")
+	} else {
+		logger.Infof("固件协议版本 v%d 最大触点数 %d", link.version, link.max_contacts)
 	}
+}
 
+// 触点状态由单独的协程维护 每个周期若有变化则发送一帧包含全部活动触点
+// 松开的触点以tip=0发送后移除 松开送达固件前再次按下则暂存位置 送达后再按下 保证主机能看到松开
+// 串口断开后自动重连 连接后重发当前全部触点与分辨率
+func handel_touch_using_hid_manager(path string) touch_control_func {
+	link, err := open_hid_link(path)
+	if err != nil {
+		logger.Errorf("无法打开串口: %v", err)
+		os.Exit(1)
+	}
+	log_hid_link(link)
+	touch_ch := make(chan touch_control_pack, 64)
+	go (func() {
+		contacts := make(map[uint8]*hid_contact)
+		dirty := false
+		inflight := make(map[uint8]bool) //v3 已发送未应答的帧序号
+		last_ack, last_send := time.Now(), time.Now()
+		var size []byte            //最近一次设置分辨率的命令
+		var pending_command []byte //v3 已发送但未收到应答的命令 NAK或超时后重发
+		var pending_seq uint8
+		link_ch := make(chan *hid_link)
+		acks, closed := link.acks, link.closed
+
+		write_command := func(command []byte) {
+			if link.version >= 3 {
+				if len(inflight) == 0 {
+					last_ack = time.Now()
+				}
+				pending_command = command
+				if seq, err := link.write_framed(hid_type_command, command[2:11]); err == nil {
+					pending_seq = seq
+					inflight[seq] = true
+					last_send = time.Now()
+				}
+			} else {
+				link.write(command)
+			}
+		}
+		//松开已送达 有暂存的按下时转为按下 否则移除
+		finish_release := func(id uint8, contact *hid_contact) {
+			if !contact.repress {
+				delete(contacts, id)
+				return
+			}
+			contact.tip, contact.changed, contact.release_sent, contact.repress = true, true, false, false
+			contact.x, contact.y = contact.next.x, contact.next.y
+			contact.pressure, contact.size = contact.next.pressure, contact.next.size
+			dirty = true
+		}
+		//重发未应答的命令与完整触点状态
+		resend := func() {
+			if pending_command != nil {
+				write_command(pending_command)
+			}
+			dirty = true
+		}
+		flush := func() {
+			if link == nil || !dirty {
+				return
+			}
+			ids := make([]int, 0, len(contacts))
+			for id := range contacts {
+				ids = append(ids, int(id))
+			}
+			sort.Ints(ids)
+			if link.version < 2 {
+				var buf [12]byte
+				buf[0] = hid_magic_report
+				dirty = false
+				for _, id := range ids {
+					contact := contacts[uint8(id)]
+					if !contact.changed {
+						continue
+					}
+					buf[1], buf[2] = 0x00, uint8(id)
+					binary.LittleEndian.PutUint32(buf[3:7], 0)
+					binary.LittleEndian.PutUint32(buf[7:11], 0)
+					if contact.tip {
+						buf[1] = 0x01
+						binary.LittleEndian.PutUint32(buf[3:7], contact.x)
+						binary.LittleEndian.PutUint32(buf[7:11], contact.y)
+					}
+					if link.write(buf[:]) != nil {
+						dirty = true
+						return
+					}
+					contact.changed = false
+					if !contact.tip {
+						finish_release(uint8(id), contact)
+					}
+				}
+				return
+			}
+			if link.version >= 3 && len(inflight) >= hid_ack_window {
+				return
+			}
+			kind, item_size := uint8(hid_type_contacts), hid_contact_size
+			if link.version >= 4 {
+				kind, item_size = hid_type_contacts_ex, hid_contact_ex
+			}
+			data := make([]byte, 1, 1+len(ids)*item_size)
+			data[0] = uint8(len(ids))
+			for _, id := range ids {
+				contact := contacts[uint8(id)]
+				var item [hid_contact_ex]byte
+				if contact.tip {
+					item[0] = 1
+				}
+				item[1] = uint8(id)
+				binary.LittleEndian.PutUint32(item[2:6], contact.x)
+				binary.LittleEndian.PutUint32(item[6:10], contact.y)
+				item[10], item[11] = contact.pressure, contact.size
+				data = append(data, item[:item_size]...)
+			}
+			if link.version >= 3 {
+				if len(inflight) == 0 {
+					last_ack = time.Now()
+				}
+				seq, err := link.write_framed(kind, data)
+				if err != nil {
+					return
+				}
+				inflight[seq] = true
+				last_send = time.Now()
+				dirty = false
+				for _, contact := range contacts {
+					if !contact.tip && !contact.release_sent {
+						contact.release_seq, contact.release_sent = seq, true
+					}
+				}
+			} else {
+				if link.write(append([]byte{hid_magic_frame}, data...)) != nil {
+					return
+				}
+				dirty = false
+				for id, contact := range contacts {
+					if !contact.tip {
+						finish_release(id, contact)
+					}
+				}
+			}
+		}
+
+		ticker := time.NewTicker(hid_frame_tick)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-global_close_signal:
+				if link != nil {
+					link.close()
+				}
+				return
+			case <-closed:
+				logger.Warnf("串口%s连接断开 正在重新连接", path)
+				link, acks, closed = nil, nil, nil
+				open_hid_link_async(path, link_ch)
+			case link = <-link_ch:
+				logger.Infof("串口%s已重新连接", path)
+				log_hid_link(link)
+				acks, closed = link.acks, link.closed
+				inflight = make(map[uint8]bool)
+				pending_command = nil
+				if size != nil {
+					write_command(size)
+				}
+				for _, contact := range contacts {
+					contact.changed = true
+					contact.release_sent = false
+				}
+				dirty = len(contacts) > 0
+				flush()
+			case ack := <-acks:
+				last_ack = time.Now()
+				if !ack.ok && ack.seq == 0 { //固件重新同步 无法确定丢失的是哪一帧 清空窗口后全部重发
+					inflight = make(map[uint8]bool)
+					resend()
+					continue
+				}
+				if !inflight[ack.seq] { //超时或重新同步后已重发的帧
+					continue
+				}
+				delete(inflight, ack.seq)
+				if !ack.ok { //固件认为内容错误的帧
+					resend()
+					continue
+				}
+				if pending_command != nil && ack.seq == pending_seq {
+					pending_command = nil
+				}
+				for id, contact := range contacts {
+					if contact.release_sent && int8(ack.seq-contact.release_seq) >= 0 {
+						finish_release(id, contact)
+					}
+				}
+			case <-ticker.C:
+				if link != nil && len(inflight) > 0 {
+					if time.Since(last_ack) > hid_link_timeout {
+						logger.Warnf("固件超过%v无应答", hid_link_timeout)
+						link.close()
+						continue
+					}
+					if time.Since(last_send) > hid_ack_timeout {
+						inflight = make(map[uint8]bool)
+						resend()
+					}
+				}
+				flush()
+			case control_data := <-touch_ch:
+				id := uint8(control_data.id)
+				contact, ok := contacts[id]
+				switch control_data.action {
+				case TouchActionRequire, TouchActionMove:
+					x, y := rotateAbsoluteXY(control_data.x, control_data.y)
+					if ok && !contact.tip { //松开尚未送达 暂存 送达后再按下
+						contact.repress = true
+						contact.next = hid_contact_pos{x: uint32(x), y: uint32(y), pressure: uint8(control_data.pressure), size: uint8(control_data.size)}
+						continue
+					}
+					if !ok {
+						if link != nil && link.max_contacts > 0 && len(contacts) >= link.max_contacts {
+							logger.Warnf("触点数超过固件上限 %d 忽略触点 %d", link.max_contacts, id)
+							continue
+						}
+						contact = &hid_contact{}
+						contacts[id] = contact
+					}
+					contact.tip, contact.changed, contact.release_sent = true, true, false
+					contact.x, contact.y = uint32(x), uint32(y)
+					contact.pressure, contact.size = uint8(control_data.pressure), uint8(control_data.size)
+					dirty = true
+				case TouchActionRelease:
+					if ok && contact.tip {
+						contact.tip, contact.changed = false, true
+						dirty = true
+					} else if ok {
+						contact.repress = false //暂存的按下在送达前已松开
+					}
+				case TouchActionResetResolution:
+					size = hid_command(hid_cmd_size, uint32(control_data.x), uint32(control_data.y))
+					if link != nil {
+						flush()
+						write_command(size)
+					}
+				}
+			}
+		}
+	})()
 	return func(control_data touch_control_pack) {
-		switch control_data.action {
-		case TouchActionRequire, TouchActionMove:
-			x, y := rotateAbsoluteXY(control_data.x, control_data.y)
-			setReport(0x01, uint8(control_data.id), uint32(x), uint32(y))
-			port.Write(buf[:])
-		case TouchActionRelease:
-			setReport(0x00, uint8(control_data.id), 0, 0)
-			port.Write(buf[:])
-		case TouchActionResetResolution:
-			setReport(0x03, uint8(control_data.id), uint32(control_data.x), uint32(control_data.y))
-			port.Write(buf[:])
+		select {
+		case touch_ch <- control_data:
+		case <-global_close_signal:
 		}
 	}
 }
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/bitly/go-simplejson"
+	"github.com/kenshaw/evdev"
+)
+
+const (
+	absX     = 0x00
+	absY     = 0x01
+	absZ     = 0x02
+	absRX    = 0x03
+	absRY    = 0x04
+	absRZ    = 0x05
+	absHat0X = 0x10
+	absHat0Y = 0x11
+)
+
+const (
+	gamepad_stick_min   = -32768
+	gamepad_stick_max   = 32767
+	gamepad_trigger_max = 1023
+)
+
+var gamepad_btn_name_2_code map[string]uint16 = map[string]uint16{
+	"BTN_A":      0x130,
+	"BTN_B":      0x131,
+	"BTN_X":      0x133,
+	"BTN_Y":      0x134,
+	"BTN_LB":     0x136,
+	"BTN_RB":     0x137,
+	"BTN_SELECT": 0x13a,
+	"BTN_START":  0x13b,
+	"BTN_HOME":   0x13c,
+	"BTN_LS":     0x13d,
+	"BTN_RS":     0x13e,
+}
+
+var gamepad_stick_name_2_code map[string]uint16 = map[string]uint16{
+	"LS_X": absX,
+	"LS_Y": absY,
+	"RS_X": absRX,
+	"RS_Y": absRY,
+}
+
+var gamepad_trigger_name_2_code map[string]uint16 = map[string]uint16{
+	"LT": absZ,
+	"RT": absRZ,
+}
+
+// 方向键与摇杆方向 [轴名称,方向]
+var gamepad_direction_names map[string][]string = map[string][]string{
+	"BTN_DPAD_UP":    {"HAT0Y", "-"},
+	"BTN_DPAD_DOWN":  {"HAT0Y", "+"},
+	"BTN_DPAD_LEFT":  {"HAT0X", "-"},
+	"BTN_DPAD_RIGHT": {"HAT0X", "+"},
+	"LS_UP":          {"LS_Y", "-"},
+	"LS_DOWN":        {"LS_Y", "+"},
+	"LS_LEFT":        {"LS_X", "-"},
+	"LS_RIGHT":       {"LS_X", "+"},
+	"RS_UP":          {"RS_Y", "-"},
+	"RS_DOWN":        {"RS_Y", "+"},
+	"RS_LEFT":        {"RS_X", "-"},
+	"RS_RIGHT":       {"RS_X", "+"},
+}
+
+func create_u_input_gamepad() *os.File {
+	deviceFile, err := os.OpenFile("/dev/uinput", syscall.O_WRONLY|syscall.O_NONBLOCK, 0660)
+	if err != nil {
+		logger.Errorf("create u_input gamepad error:%v", err)
+		return nil
+	}
+	ioctl(deviceFile.Fd(), UISETEVBIT(), evSyn)
+	ioctl(deviceFile.Fd(), UISETEVBIT(), evKey)
+	ioctl(deviceFile.Fd(), UISETEVBIT(), evAbs)
+	for _, code := range gamepad_btn_name_2_code {
+		ioctl(deviceFile.Fd(), UISETKEYBIT(), uintptr(code))
+	}
+
+	var absMin [absCnt]int32
+	var absMax [absCnt]int32
+	var absFuzz [absCnt]int32
+	var absFlat [absCnt]int32
+	for _, code := range gamepad_stick_name_2_code {
+		ioctl(deviceFile.Fd(), UISETABSBIT(), uintptr(code))
+		absMin[code] = gamepad_stick_min
+		absMax[code] = gamepad_stick_max
+		absFuzz[code] = 16
+		absFlat[code] = 128
+	}
+	for _, code := range gamepad_trigger_name_2_code {
+		ioctl(deviceFile.Fd(), UISETABSBIT(), uintptr(code))
+		absMin[code] = 0
+		absMax[code] = gamepad_trigger_max
+	}
+	for _, code := range []uint16{absHat0X, absHat0Y} {
+		ioctl(deviceFile.Fd(), UISETABSBIT(), uintptr(code))
+		absMin[code] = -1
+		absMax[code] = 1
+	}
+
+	uiDev := UinputUserDev{
+		Name: toUInputName([]byte(uinput_gamepad_dev_name)),
+		ID: InputID{
+			BusType: 0x03, //BUS_USB 让游戏按照xbox手柄识别
+			Vendor:  0x045e,
+			Product: 0x028e,
+			Version: 0x0110,
+		},
+		EffectsMax: 0,
+		AbsMax:     absMax,
+		AbsMin:     absMin,
+		AbsFuzz:    absFuzz,
+		AbsFlat:    absFlat,
+	}
+	deviceFile.Write(uInputDevToBytes(uiDev))
+	if err := createDevice(deviceFile); err != nil {
+		logger.Errorf("create u_input gamepad error:%v", err)
+		deviceFile.Close()
+		return nil
+	}
+	return deviceFile
+}
+
+// fd由调用方创建 创建失败时不启用虚拟手柄
+func handel_u_input_gamepad(u_input chan *u_input_control_pack, fd *os.File) {
+	ev_sync := evdev.Event{Type: EV_SYN, Code: 0, Value: 0}
+	logger.Infof("已创建虚拟手柄 : %s", uinput_gamepad_dev_name)
+	for {
+		select {
+		case <-global_close_signal:
+			fd.Close()
+			return
+		case pack := <-u_input:
+			switch pack.action {
+			case UInput_gamepad_btn:
+				send_u_input_events(fd, []*evdev.Event{{Type: EV_KEY, Code: uint16(pack.arg1), Value: pack.arg2}, &ev_sync})
+			case UInput_gamepad_abs:
+				send_u_input_events(fd, []*evdev.Event{{Type: EV_ABS, Code: uint16(pack.arg1), Value: pack.arg2}, &ev_sync})
+			}
+		}
+	}
+}
+
+// 将键鼠与手柄输入转换为虚拟手柄的状态 仅在映射关闭时工作
+type v_gamepad struct {
+	out             chan *u_input_control_pack
+	lock            sync.Mutex
+	key_map         map[string]string //键鼠按键 => 手柄按键或摇杆方向
+	direction_state map[string]bool   //按键控制的摇杆方向与方向键状态
+	mouse_stick     string            //鼠标移动控制的摇杆 LS或RS 为空则不控制
+	mouse_speed_x   float64
+	mouse_speed_y   float64
+	mouse_acc_x     int32
+	mouse_acc_y     int32
+	mouse_out_x     float64
+	mouse_out_y     float64
+}
+
+func init_v_gamepad(out chan *u_input_control_pack, config *simplejson.Json) *v_gamepad {
+	gamepad := &v_gamepad{
+		out:             out,
+		direction_state: make(map[string]bool),
+	}
+	gamepad.load_config(config)
+	return gamepad
+}
+
+func (self *v_gamepad) load_config(config *simplejson.Json) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	gamepad_config := config.Get("GAMEPAD")
+	self.key_map = make(map[string]string)
+	for key, target := range gamepad_config.Get("KEY_MAP").MustMap() {
+		target_name, ok := target.(string)
+		if !ok || !is_gamepad_target(target_name) {
+			logger.Warnf("GAMEPAD映射 %s => %v 不是可用的手柄按键", key, target)
+			continue
+		}
+		self.key_map[key] = target_name
+	}
+	self.mouse_stick = gamepad_config.Get("MOUSE").Get("STICK").MustString("")
+	if self.mouse_stick != "" && self.mouse_stick != "LS" && self.mouse_stick != "RS" {
+		logger.Warnf("GAMEPAD鼠标摇杆 %s 无效,可用值为 LS RS", self.mouse_stick)
+		self.mouse_stick = ""
+	}
+	self.mouse_speed_x = gamepad_config.Get("MOUSE").Get("SPEED").GetIndex(0).MustFloat64(0.05)
+	self.mouse_speed_y = gamepad_config.Get("MOUSE").Get("SPEED").GetIndex(1).MustFloat64(0.05)
+}
+
+func is_gamepad_target(name string) bool {
+	if _, ok := gamepad_btn_name_2_code[name]; ok {
+		return true
+	}
+	if _, ok := gamepad_direction_names[name]; ok {
+		return true
+	}
+	return name == "BTN_LT" || name == "BTN_RT"
+}
+
+func (self *v_gamepad) send(action int8, code uint16, value int32) {
+	select { //调用方持有self.lock 退出后输出协程不再接收
+	case self.out <- &u_input_control_pack{
+		action: action,
+		arg1:   int32(code),
+		arg2:   value,
+	}:
+	case <-global_close_signal:
+	}
+}
+
+func (self *v_gamepad) send_direction_axis(axis string) { //根据两个方向按键的状态计算轴的值
+	value := int32(0)
+	for name, direction := range gamepad_direction_names {
+		if direction[0] != axis || !self.direction_state[name] {
+			continue
+		}
+		if direction[1] == "-" {
+			value -= 1
+		} else {
+			value += 1
+		}
+	}
+	if axis == "HAT0X" || axis == "HAT0Y" {
+		code := uint16(absHat0X)
+		if axis == "HAT0Y" {
+			code = absHat0Y
+		}
+		self.send(UInput_gamepad_abs, code, value)
+	} else if value < 0 {
+		self.send(UInput_gamepad_abs, gamepad_stick_name_2_code[axis], gamepad_stick_min)
+	} else if value > 0 {
+		self.send(UInput_gamepad_abs, gamepad_stick_name_2_code[axis], gamepad_stick_max)
+	} else {
+		self.send(UInput_gamepad_abs, gamepad_stick_name_2_code[axis], 0)
+	}
+}
+
+// 直接以手柄按键名称输出 如果不是手柄按键则返回false
+func (self *v_gamepad) key(name string, up_down int32) bool {
+	if up_down != DOWN && up_down != UP {
+		return is_gamepad_target(name) //长按重复事件直接忽略
+	}
+	if code, ok := gamepad_btn_name_2_code[name]; ok {
+		self.send(UInput_gamepad_btn, code, up_down)
+		return true
+	}
+	if direction, ok := gamepad_direction_names[name]; ok {
+		self.lock.Lock()
+		self.direction_state[name] = up_down == DOWN
+		self.send_direction_axis(direction[0])
+		self.lock.Unlock()
+		return true
+	}
+	if name == "BTN_LT" || name == "BTN_RT" {
+		self.send(UInput_gamepad_abs, gamepad_trigger_name_2_code[name[4:]], up_down*gamepad_trigger_max)
+		return true
+	}
+	return false
+}
+
+// 按照GAMEPAD.KEY_MAP转换键鼠按键 未配置则返回false
+func (self *v_gamepad) mapped_key(key_name string, up_down int32) bool {
+	self.lock.Lock()
+	target, ok := self.key_map[key_name]
+	self.lock.Unlock()
+	if !ok {
+		return false
+	}
+	return self.key(target, up_down)
+}
+
+// 手柄摇杆与扳机的模拟量 value范围0-1
+func (self *v_gamepad) axis(name string, value float64) bool {
+	if code, ok := gamepad_stick_name_2_code[name]; ok {
+		self.send(UInput_gamepad_abs, code, int32(value*(gamepad_stick_max-gamepad_stick_min))+gamepad_stick_min)
+		return true
+	}
+	if code, ok := gamepad_trigger_name_2_code[name]; ok {
+		self.send(UInput_gamepad_abs, code, int32(value*gamepad_trigger_max))
+		return true
+	}
+	return false
+}
+
+func (self *v_gamepad) mouse_move(x, y int32) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.mouse_stick == "" {
+		return false
+	}
+	self.mouse_acc_x += x
+	self.mouse_acc_y += y
+	return true
+}
+
+func (self *v_gamepad) reset() { //切换到映射模式时 所有按键与摇杆回中
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, code := range gamepad_btn_name_2_code {
+		self.send(UInput_gamepad_btn, code, UP)
+	}
+	for _, code := range gamepad_stick_name_2_code {
+		self.send(UInput_gamepad_abs, code, 0)
+	}
+	for _, code := range gamepad_trigger_name_2_code {
+		self.send(UInput_gamepad_abs, code, 0)
+	}
+	self.send(UInput_gamepad_abs, absHat0X, 0)
+	self.send(UInput_gamepad_abs, absHat0Y, 0)
+	self.direction_state = make(map[string]bool)
+	self.mouse_acc_x, self.mouse_acc_y = 0, 0
+	self.mouse_out_x, self.mouse_out_y = 0, 0
+}
+
+func clamp_stick(value float64) float64 {
+	if value > 1 {
+		return 1
+	} else if value < -1 {
+		return -1
+	}
+	return value
+}
+
+func (self *v_gamepad) loop_handel_mouse_stick() { //鼠标移动量转换为摇杆偏移 平滑后回中
+	for {
+		select {
+		case <-global_close_signal:
+			return
+		default:
+			self.lock.Lock()
+			if self.mouse_stick != "" {
+				target_x := clamp_stick(float64(self.mouse_acc_x) * self.mouse_speed_x)
+				target_y := clamp_stick(float64(self.mouse_acc_y) * self.mouse_speed_y)
+				self.mouse_acc_x, self.mouse_acc_y = 0, 0
+				out_x := self.mouse_out_x*0.5 + target_x*0.5
+				out_y := self.mouse_out_y*0.5 + target_y*0.5
+				if out_x > -0.01 && out_x < 0.01 {
+					out_x = 0
+				}
+				if out_y > -0.01 && out_y < 0.01 {
+					out_y = 0
+				}
+				if out_x != self.mouse_out_x || out_y != self.mouse_out_y {
+					self.mouse_out_x, self.mouse_out_y = out_x, out_y
+					self.send(UInput_gamepad_abs, gamepad_stick_name_2_code[self.mouse_stick+"_X"], int32(out_x*gamepad_stick_max))
+					self.send(UInput_gamepad_abs, gamepad_stick_name_2_code[self.mouse_stick+"_Y"], int32(out_y*gamepad_stick_max))
+				}
+			}
+			self.lock.Unlock()
+			time.Sleep(time.Duration(4) * time.Millisecond) //250HZ
+		}
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"os/exec"
 	"strconv"
 	"strings"
@@ -49,6 +50,8 @@ func create_u_input_touch_screen(width int32, height int32) *os.File {
 
 	ioctl(deviceFile.Fd(), UISETABSBIT(), absMtTouchMajor)
 	ioctl(deviceFile.Fd(), UISETABSBIT(), absMtWidthMajor)
+	ioctl(deviceFile.Fd(), UISETABSBIT(), absMtPressure)
+	ioctl(deviceFile.Fd(), UISETABSBIT(), absMtToolType)
 	ioctl(deviceFile.Fd(), UISETABSBIT(), absMtPositionX)
 	ioctl(deviceFile.Fd(), UISETABSBIT(), absMtPositionY)
 
@@ -59,6 +62,8 @@ func create_u_input_touch_screen(width int32, height int32) *os.File {
 	absMin[absMtPositionY] = 0
 	absMin[absMtTouchMajor] = 0
 	absMin[absMtWidthMajor] = 0
+	absMin[absMtPressure] = 0
+	absMin[absMtToolType] = mtToolFinger
 	absMin[absMtSlot] = 0
 	absMin[absMtTrackingId] = 0
 
@@ -71,7 +76,9 @@ func create_u_input_touch_screen(width int32, height int32) *os.File {
 
 	absMax[absMtTouchMajor] = 255
 	absMax[absMtWidthMajor] = 0
-	absMax[absMtSlot] = 9
+	absMax[absMtPressure] = 255
+	absMax[absMtToolType] = mtToolPalm
+	absMax[absMtSlot] = touch_slot_count - 1
 	absMax[absMtTrackingId] = 65535
 
 	uiDev := UinputUserDev{
@@ -93,64 +100,105 @@ func create_u_input_touch_screen(width int32, height int32) *os.File {
 	return deviceFile
 }
 
-// func create_u_input_touch_screen(index int) *os.File {
-// 	fd, err := os.OpenFile(fmt.Sprintf("/dev/input/event%d", index), os.O_RDONLY, 0)
-// 	if err != nil {
-// 		logger.Errorf("读取设备失败 : %v", err)
-// 		return nil
-// 	}
-// 	d := evdev.Open(fd)
-// 	defer d.Close()
-
-// 	deviceFile, err := os.OpenFile("/dev/uinput", syscall.O_WRONLY|syscall.O_NONBLOCK, 0660)
-// 	if err != nil {
-// 		logger.Errorf("create u_input touch_screen error:%v", err)
-// 		return nil
-// 	}
-
-// 	ioctl(deviceFile.Fd(), UISETEVBIT(), evKey)
-// 	for key := range d.KeyTypes() {
-// 		ioctl(deviceFile.Fd(), UISETKEYBIT(), uintptr(key)) //一个是BTN_TOUCH 一个不知道是啥
-// 	}
-
-// 	ioctl(deviceFile.Fd(), UISETEVBIT(), evAbs)
-// 	var initAbsVal [absCnt]int32
-// 	var initAbsMin [absCnt]int32
-// 	var initAbsMax [absCnt]int32
-// 	var initAbsFuzz [absCnt]int32
-// 	var initAbsFlat [absCnt]int32
-// 	var initAbsRes [absCnt]int32
-
-// 	for key, value := range d.AbsoluteTypes() {
-// 		ioctl(deviceFile.Fd(), UISETABSBIT(), uintptr(key))
-// 		initAbsVal[key] = value.Val
-// 		initAbsMin[key] = value.Min
-// 		initAbsMax[key] = value.Max
-// 		initAbsFuzz[key] = value.Fuzz
-// 		initAbsFlat[key] = value.Flat
-// 		initAbsRes[key] = value.Res
-// 	}
-
-// 	ioctl(deviceFile.Fd(), UISETPROPBIT(), inputPropDirect)
-
-// 	uiDev := UinputUserDev{
-// 		Name: toUInputName([]byte("v_touch_screen_KKK")),
-// 		ID: InputID{
-// 			BusType: 0,
-// 			Vendor:  randUInt16Num(0x2000),
-// 			Product: randUInt16Num(0x2000),
-// 			Version: randUInt16Num(0x20),
-// 		},
-// 		EffectsMax: 0,
-// 		AbsMax:     initAbsMax,
-// 		AbsMin:     initAbsMin,
-// 		AbsFuzz:    initAbsFlat,
-// 		AbsFlat:    initAbsFlat,
-// 	}
-// 	deviceFile.Write(uInputDevToBytes(uiDev))
-// 	createDevice(deviceFile)
-// 	return deviceFile
-// }
+// 触屏各轴的范围 压力、接触面积与工具类型的Maximum不大于Minimum时表示设备不支持
+type touch_abs_ranges struct {
+	x, y, pressure, major, tool AbsInfo
+}
+
+func get_touch_abs_ranges(axes map[evdev.AbsoluteType]evdev.Axis) touch_abs_ranges {
+	to_info := func(code evdev.AbsoluteType) AbsInfo {
+		axis := axes[code]
+		return AbsInfo{Minimum: axis.Min, Maximum: axis.Max}
+	}
+	return touch_abs_ranges{
+		x:        to_info(evdev.AbsoluteMTPositionX),
+		y:        to_info(evdev.AbsoluteMTPositionY),
+		pressure: to_info(evdev.AbsoluteMTPressure),
+		major:    to_info(evdev.AbsoluteMTTouchMajor),
+		tool:     to_info(evdev.AbsoluteMTToolType),
+	}
+}
+
+// 复制真实触屏的名称、ID、按键、坐标范围、分辨率与属性创建虚拟触屏 返回各轴范围用于缩放
+// 坐标范围与分辨率需要UI_DEV_SETUP/UI_ABS_SETUP(内核4.5以上) 触点数与TouchHandler可分配的数量一致
+func create_u_input_touch_screen_clone(index int) (*os.File, touch_abs_ranges, error) {
+	var ranges touch_abs_ranges
+	fd, err := os.OpenFile(fmt.Sprintf("/dev/input/event%d", index), os.O_RDONLY, 0)
+	if err != nil {
+		return nil, ranges, err
+	}
+	d := evdev.Open(fd)
+	defer d.Close()
+	name := d.Name()
+	id := d.ID()
+	keys := d.KeyTypes()
+	axes := d.AbsoluteTypes()
+	var props [inputPropCnt / 8]byte
+	ioctl(fd.Fd(), EVIOCGPROP(), uintptr(unsafe.Pointer(&props[0])))
+
+	x, ok_x := axes[evdev.AbsoluteMTPositionX]
+	y, ok_y := axes[evdev.AbsoluteMTPositionY]
+	if !ok_x || !ok_y || x.Max <= x.Min || y.Max <= y.Min {
+		return nil, ranges, fmt.Errorf("%s 不是多点触屏", name)
+	}
+	ranges = get_touch_abs_ranges(axes)
+
+	deviceFile, err := os.OpenFile("/dev/uinput", syscall.O_WRONLY|syscall.O_NONBLOCK, 0660)
+	if err != nil {
+		return nil, ranges, err
+	}
+	ioctl(deviceFile.Fd(), UISETEVBIT(), evKey)
+	ioctl(deviceFile.Fd(), UISETKEYBIT(), btnTouch)
+	for key := range keys {
+		ioctl(deviceFile.Fd(), UISETKEYBIT(), uintptr(key))
+	}
+	for i := 0; i < inputPropCnt; i++ {
+		if props[i/8]&(1<<(i%8)) != 0 {
+			ioctl(deviceFile.Fd(), UISETPROPBIT(), uintptr(i))
+		}
+	}
+	ioctl(deviceFile.Fd(), UISETEVBIT(), evAbs)
+	axes[evdev.AbsoluteMTSlot] = evdev.Axis{Min: 0, Max: touch_slot_count - 1}
+	if tracking, ok := axes[evdev.AbsoluteMTTrackingID]; !ok || tracking.Max < touch_slot_count {
+		axes[evdev.AbsoluteMTTrackingID] = evdev.Axis{Min: 0, Max: 65535}
+	}
+	for code, axis := range axes {
+		ioctl(deviceFile.Fd(), UISETABSBIT(), uintptr(code))
+		setup := UinputAbsSetup{
+			Code: uint16(code),
+			AbsInfo: AbsInfo{
+				Minimum:    axis.Min,
+				Maximum:    axis.Max,
+				Fuzz:       axis.Fuzz,
+				Flat:       axis.Flat,
+				Resolution: axis.Res,
+			},
+		}
+		if err := ioctl(deviceFile.Fd(), UIABSSETUP(), uintptr(unsafe.Pointer(&setup))); err != nil {
+			deviceFile.Close()
+			return nil, ranges, fmt.Errorf("UI_ABS_SETUP失败: %v", err)
+		}
+	}
+	setup := UinputSetup{
+		ID: InputID{
+			BusType: uint16(id.BusType),
+			Vendor:  id.Vendor,
+			Product: id.Product,
+			Version: id.Version,
+		},
+		Name: toUInputName([]byte(name)),
+	}
+	if err := ioctl(deviceFile.Fd(), UIDEVSETUP(), uintptr(unsafe.Pointer(&setup))); err != nil {
+		deviceFile.Close()
+		return nil, ranges, fmt.Errorf("UI_DEV_SETUP失败: %v", err)
+	}
+	if err := createDevice(deviceFile); err != nil {
+		deviceFile.Close()
+		return nil, ranges, err
+	}
+	logger.Infof("已复制触屏 %s 创建虚拟触屏 X:[%d,%d] Y:[%d,%d]", name, x.Min, x.Max, y.Min, y.Max)
+	return deviceFile, ranges, nil
+}
 
 func create_u_input_mouse_keyboard() *os.File {
 	deviceFile, err := os.OpenFile("/dev/uinput", syscall.O_WRONLY|syscall.O_NONBLOCK, 0660)
@@ -191,23 +239,24 @@ func create_u_input_mouse_keyboard() *os.File {
 	return deviceFile
 }
 
-func handel_u_input_mouse_keyboard(u_input chan *u_input_control_pack) {
+func send_u_input_events(fd *os.File, events []*evdev.Event) {
+	if fd == nil {
+		logger.Warnf("fd is nil,pass %v", events)
+		return
+	}
 	sizeofEvent := int(unsafe.Sizeof(evdev.Event{}))
-	sendEvents := func(fd *os.File, events []*evdev.Event) {
-		if fd == nil {
-			logger.Warnf("fd is nil,pass %v", events)
-			return
-		}
-
-		buf := make([]byte, sizeofEvent*len(events))
-		for i, event := range events {
-			copy(buf[i*sizeofEvent:], (*(*[1<<27 - 1]byte)(unsafe.Pointer(event)))[:sizeofEvent])
-		}
-		n, err := fd.Write(buf)
-		if err != nil {
-			logger.Errorf("write %v bytes error:%v", n, err)
-		}
+	buf := make([]byte, sizeofEvent*len(events))
+	for i, event := range events {
+		copy(buf[i*sizeofEvent:], (*(*[1<<27 - 1]byte)(unsafe.Pointer(event)))[:sizeofEvent])
+	}
+	n, err := fd.Write(buf)
+	if err != nil {
+		logger.Errorf("write %v bytes error:%v", n, err)
 	}
+}
+
+func handel_u_input_mouse_keyboard(u_input chan *u_input_control_pack) {
+	sendEvents := send_u_input_events
 	ev_sync := evdev.Event{Type: EV_SYN, Code: 0, Value: 0}
 	fd := create_u_input_mouse_keyboard()
 	for {
@@ -244,6 +293,9 @@ const (
 	ABS_MT_POSITION_Y  = 0x36
 	ABS_MT_SLOT        = 0x2F
 	ABS_MT_TRACKING_ID = 0x39
+	ABS_MT_PRESSURE    = 0x3A
+	ABS_MT_TOUCH_MAJOR = 0x30
+	ABS_MT_TOOL_TYPE   = 0x37
 	EV_SYN             = 0x00
 	EV_KEY             = 0x01
 	EV_REL             = 0x02
@@ -284,13 +336,87 @@ func makeEventsMMap(size int) EventMap {
 	return EventMap{data: byteSlice, Events: eventSlice}
 }
 
-func handel_touch_using_uinput_touch() touch_control_func {
+// 压力、接触面积与工具类型 按设备范围缩放后插入到事件的SYN之前 设备不支持时不发送
+// 压力为0时安卓视为悬停 因此未指定的压力按最大值发送 未指定的接触面积不发送
+// 只用于按下与移动 松开时直接写入
+type touch_attr_writer struct {
+	fd     int
+	ranges touch_abs_ranges
+	events EventMap
+}
+
+func new_touch_attr_writer(fd int, ranges touch_abs_ranges) *touch_attr_writer {
+	return &touch_attr_writer{fd: fd, ranges: ranges, events: makeEventsMMap(4 * 24)}
+}
+
+// data为以SYN结尾的事件序列
+func (self *touch_attr_writer) write(data []byte, control_data touch_control_pack) {
+	scale := func(value int32, info AbsInfo) int32 {
+		return info.Minimum + int32(int64(value)*int64(info.Maximum-info.Minimum)/255)
+	}
+	n := 0
+	if self.ranges.pressure.Maximum > self.ranges.pressure.Minimum {
+		pressure := control_data.pressure
+		if pressure <= 0 {
+			pressure = 255
+		}
+		self.events.Events[n] = evdev.Event{Type: EV_ABS, Code: ABS_MT_PRESSURE, Value: scale(pressure, self.ranges.pressure)}
+		n++
+	}
+	if control_data.size > 0 && self.ranges.major.Maximum > self.ranges.major.Minimum {
+		self.events.Events[n] = evdev.Event{Type: EV_ABS, Code: ABS_MT_TOUCH_MAJOR, Value: scale(control_data.size, self.ranges.major)}
+		n++
+	}
+	if self.ranges.tool.Maximum > self.ranges.tool.Minimum { //内核会过滤未变化的值
+		tool := control_data.tool
+		if tool < self.ranges.tool.Minimum || tool > self.ranges.tool.Maximum {
+			tool = mtToolFinger
+		}
+		self.events.Events[n] = evdev.Event{Type: EV_ABS, Code: ABS_MT_TOOL_TYPE, Value: tool}
+		n++
+	}
+	if n == 0 {
+		unix.Write(self.fd, data)
+		return
+	}
+	self.events.Events[n] = evdev.Event{Type: EV_SYN, Code: 0, Value: 0}
+	unix.Write(self.fd, data[:len(data)-24])
+	unix.Write(self.fd, self.events.data[:(n+1)*24])
+}
+
+// clone_index不小于0时复制该触屏的属性 坐标按其范围缩放
+func handel_touch_using_uinput_touch(clone_index int) touch_control_func {
 	var count int32 = 0    //BTN_TOUCH 申请时为1 则按下 释放时为0 则松开
 	var last_id int32 = -1 //ABS_MT_SLOT last_id每次动作后修改 如果不等则额外发送MT_SLOT事件
-	w, h := get_wm_size()
-	logger.Infof("已创建虚拟触屏 : %vx%v", w, h)
-	fd := create_u_input_touch_screen(w, h)
+	var fd *os.File
+	var ranges touch_abs_ranges
+	if clone_index >= 0 {
+		var err error
+		fd, ranges, err = create_u_input_touch_screen_clone(clone_index)
+		if err != nil {
+			logger.Warnf("复制触屏失败 使用默认虚拟触屏: %v", err)
+		}
+	}
+	if fd == nil {
+		w, h := get_wm_size()
+		logger.Infof("已创建虚拟触屏 : %vx%v", w, h)
+		fd = create_u_input_touch_screen(w, h)
+		ranges = touch_abs_ranges{
+			x:        AbsInfo{Minimum: 0, Maximum: 0x7ffffffe},
+			y:        AbsInfo{Minimum: 0, Maximum: 0x7ffffffe},
+			pressure: AbsInfo{Minimum: 0, Maximum: 255},
+			major:    AbsInfo{Minimum: 0, Maximum: 255},
+			tool:     AbsInfo{Minimum: mtToolFinger, Maximum: mtToolPalm},
+		}
+	}
+	abs_x, abs_y := ranges.x, ranges.y
+	scaleXY := func(x, y int32) (int32, int32) {
+		x, y = rotateAbsoluteXY(x, y)
+		return abs_x.Minimum + int32(int64(x)*int64(abs_x.Maximum-abs_x.Minimum)/0x7ffffffe),
+			abs_y.Minimum + int32(int64(y)*int64(abs_y.Maximum-abs_y.Minimum)/0x7ffffffe)
+	}
 	unixFd := int(fd.Fd())
+	attrs := new_touch_attr_writer(unixFd, ranges)
 	go func() {
 		<-global_close_signal
 		fd.Close()
@@ -350,21 +476,21 @@ func handel_touch_using_uinput_touch() touch_control_func {
 			return
 		}
 		if control_data.action == TouchActionRequire {
-			x, y := rotateAbsoluteXY(control_data.x, control_data.y)
+			x, y := scaleXY(control_data.x, control_data.y)
 			last_id = control_data.id
 			if count += 1; count == 1 {
 				require_init.Events[0].Value = control_data.id
 				require_init.Events[1].Value = control_data.id
 				require_init.Events[3].Value = x
 				require_init.Events[4].Value = y
-				unix.Write(unixFd, require_init.data)
+				attrs.write(require_init.data, control_data)
 				// packChan <- pack{data: require_init.data, ts: start}
 			} else {
 				require.Events[0].Value = control_data.id
 				require.Events[1].Value = control_data.id
 				require.Events[2].Value = x
 				require.Events[3].Value = y
-				unix.Write(unixFd, require.data)
+				attrs.write(require.data, control_data)
 				// packChan <- pack{data: require.data, ts: start}
 
 			}
@@ -391,19 +517,19 @@ func handel_touch_using_uinput_touch() touch_control_func {
 				}
 			}
 		} else if control_data.action == TouchActionMove {
-			x, y := rotateAbsoluteXY(control_data.x, control_data.y)
+			x, y := scaleXY(control_data.x, control_data.y)
 			if last_id != control_data.id {
 				last_id = control_data.id
 				switch_move.Events[0].Value = control_data.id
 				switch_move.Events[1].Value = x
 				switch_move.Events[2].Value = y
-				unix.Write(unixFd, switch_move.data)
+				attrs.write(switch_move.data, control_data)
 				// packChan <- pack{data: switch_move.data, ts: start}
 
 			} else {
 				move.Events[0].Value = x
 				move.Events[1].Value = y
-				unix.Write(unixFd, move.data)
+				attrs.write(move.data, control_data)
 				// packChan <- pack{data: move.data, ts: start}
 			}
 		}
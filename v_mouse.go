@@ -72,8 +72,8 @@ func init_v_mouse_controller(
 					if n > 0 {
 						data := make([]byte, n)
 						copy(data, readBuffer[:n])
-						global_device_orientation = int32(data[0])
 						logger.Debugf("从 %s 接收到 vpoint上报屏幕方向 %d ", remoteAddr.String(), int32(data[0]))
+						set_device_orientation(int32(data[0]), "vPointer")
 					}
 				}
 			}
@@ -120,7 +120,7 @@ func (self *v_mouse_controller) get_max_xy_val() (int32, int32) {
 	if global_is_wordking_remote {
 		return global_screen_x, global_screen_y
 	} else {
-		if global_device_orientation == 0 || global_device_orientation == 2 {
+		if orientation := global_orientation.current(); orientation == 0 || orientation == 2 {
 			return self.screen_x, self.screen_y
 		} else {
 			return self.screen_y, self.screen_x
@@ -179,7 +179,7 @@ func (self *v_mouse_controller) display_mouse_control(show, downing bool, abs_x,
 	} else {
 		downing_int = 0
 	}
-	fmt_str := fmt.Sprintf("%d,%d,%d,%d,%d", abs_x, abs_y, show_int, downing_int, global_device_orientation)
+	fmt_str := fmt.Sprintf("%d,%d,%d,%d,%d", abs_x, abs_y, show_int, downing_int, global_orientation.current())
 	self.udp_write_ch <- []byte(fmt_str)
 }
 
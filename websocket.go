@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 最小的WebSocket实现(RFC6455) 只支持远程事件所需的二进制/文本消息 ping与close 不支持分片与扩展
+
+const (
+	ws_op_continuation = 0x0
+	ws_op_text         = 0x1
+	ws_op_binary       = 0x2
+	ws_op_close        = 0x8
+	ws_op_ping         = 0x9
+	ws_op_pong         = 0xa
+	ws_guid            = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	ws_max_message     = 64 * 1024
+)
+
+// 除同源页面外允许连接的Origin 由--ws-origin设置
+var websocket_allowed_origins = make(map[string]bool)
+
+// 浏览器会附带Origin 拒绝其他网页发起的跨站连接 非浏览器客户端不发送Origin
+func websocket_origin_allowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if websocket_allowed_origins[origin] {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+type websocket_conn struct {
+	conn        net.Conn
+	reader      *bufio.Reader
+	write_lock  sync.Mutex
+	mask_output bool //客户端发送的帧必须加掩码
+}
+
+func websocket_accept_key(key string) string {
+	hash := sha1.Sum([]byte(key + ws_guid))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+func header_contains(header http.Header, name string, value string) bool {
+	for _, item := range strings.Split(header.Get(name), ",") {
+		if strings.EqualFold(strings.TrimSpace(item), value) {
+			return true
+		}
+	}
+	return false
+}
+
+// 在http handler中升级为WebSocket连接
+func websocket_upgrade(w http.ResponseWriter, r *http.Request) (*websocket_conn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != "GET" || key == "" || !header_contains(r.Header, "Connection", "upgrade") || !header_contains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "需要WebSocket连接", http.StatusBadRequest)
+		return nil, fmt.Errorf("not a websocket handshake")
+	}
+	if !websocket_origin_allowed(r) {
+		http.Error(w, "不允许跨站连接", http.StatusForbidden)
+		logger.Warnf("拒绝跨站WebSocket连接 Origin:%s 来自:%s", r.Header.Get("Origin"), r.RemoteAddr)
+		return nil, fmt.Errorf("origin %s not allowed", r.Header.Get("Origin"))
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "不支持WebSocket", http.StatusInternalServerError)
+		return nil, fmt.Errorf("http.Hijacker not supported")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + websocket_accept_key(key) + "\r\n\r\n"
+	if _, err := rw.WriteString(response); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &websocket_conn{conn: conn, reader: rw.Reader}, nil
+}
+
+// 连接 ws://host:port/path
+func websocket_dial(host string, path string, timeout time.Duration) (*websocket_conn, error) {
+	conn, err := net.DialTimeout("tcp", host, timeout)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+	request := "GET " + path + " HTTP/1.1\r\n" +
+		"Host: " + host + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write([]byte(request)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols || response.Header.Get("Sec-WebSocket-Accept") != websocket_accept_key(key) {
+		conn.Close()
+		return nil, fmt.Errorf("websocket handshake failed: %s", response.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	return &websocket_conn{conn: conn, reader: reader, mask_output: true}, nil
+}
+
+func (self *websocket_conn) write_message(opcode byte, data []byte) error {
+	self.write_lock.Lock()
+	defer self.write_lock.Unlock()
+	frame := make([]byte, 0, len(data)+14)
+	frame = append(frame, 0x80|opcode)
+	mask_bit := byte(0)
+	if self.mask_output {
+		mask_bit = 0x80
+	}
+	switch {
+	case len(data) < 126:
+		frame = append(frame, mask_bit|byte(len(data)))
+	case len(data) <= 0xffff:
+		frame = append(frame, mask_bit|126, 0, 0)
+		binary.BigEndian.PutUint16(frame[len(frame)-2:], uint16(len(data)))
+	default:
+		frame = append(frame, mask_bit|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[len(frame)-8:], uint64(len(data)))
+	}
+	if self.mask_output {
+		mask := make([]byte, 4)
+		rand.Read(mask)
+		frame = append(frame, mask...)
+		for i, b := range data {
+			frame = append(frame, b^mask[i%4])
+		}
+	} else {
+		frame = append(frame, data...)
+	}
+	_, err := self.conn.Write(frame)
+	return err
+}
+
+// 读取一条数据消息 自动回复ping 收到close时返回io.EOF
+func (self *websocket_conn) read_message() (byte, []byte, error) {
+	for {
+		head := make([]byte, 2)
+		if _, err := io.ReadFull(self.reader, head); err != nil {
+			return 0, nil, err
+		}
+		if head[0]&0x80 == 0 || head[0]&0x0f == ws_op_continuation {
+			return 0, nil, fmt.Errorf("websocket fragmented frames not supported")
+		}
+		opcode := head[0] & 0x0f
+		length := uint64(head[1] & 0x7f)
+		switch length {
+		case 126:
+			ext := make([]byte, 2)
+			if _, err := io.ReadFull(self.reader, ext); err != nil {
+				return 0, nil, err
+			}
+			length = uint64(binary.BigEndian.Uint16(ext))
+		case 127:
+			ext := make([]byte, 8)
+			if _, err := io.ReadFull(self.reader, ext); err != nil {
+				return 0, nil, err
+			}
+			length = binary.BigEndian.Uint64(ext)
+		}
+		if length > ws_max_message {
+			return 0, nil, fmt.Errorf("websocket message too large: %d", length)
+		}
+		var mask []byte
+		if head[1]&0x80 != 0 {
+			mask = make([]byte, 4)
+			if _, err := io.ReadFull(self.reader, mask); err != nil {
+				return 0, nil, err
+			}
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(self.reader, payload); err != nil {
+			return 0, nil, err
+		}
+		if mask != nil {
+			for i := range payload {
+				payload[i] ^= mask[i%4]
+			}
+		}
+		switch opcode {
+		case ws_op_ping:
+			self.write_message(ws_op_pong, payload)
+		case ws_op_pong:
+		case ws_op_close:
+			self.write_message(ws_op_close, nil)
+			return 0, nil, io.EOF
+		default:
+			return opcode, payload, nil
+		}
+	}
+}
+
+func (self *websocket_conn) close() error {
+	return self.conn.Close()
+}